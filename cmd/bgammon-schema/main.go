@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"codeberg.org/tslocum/bgammon"
+	"codeberg.org/tslocum/bgammon/pkg/server"
+)
+
+func main() {
+	var output string
+	var protocol string
+	flag.StringVar(&output, "o", "", "Output file (default standard output)")
+	flag.StringVar(&protocol, "protocol", "", "Update the command reference in the specified protocol specification")
+	flag.Parse()
+
+	if protocol != "" {
+		err := updateCommandReference(protocol)
+		if err != nil {
+			log.Fatalf("failed to update command reference: %s", err)
+		}
+	}
+
+	schema, err := bgammon.Schema()
+	if err != nil {
+		log.Fatalf("failed to generate schema: %s", err)
+	}
+
+	if output == "" {
+		os.Stdout.Write(schema)
+		return
+	}
+	err = os.WriteFile(output, schema, 0644)
+	if err != nil {
+		log.Fatalf("failed to write schema: %s", err)
+	}
+}
+
+// updateCommandReference replaces the command reference in the specified
+// file with the reference generated from the server's command registry.
+func updateCommandReference(path string) error {
+	const begin, end = "<!-- BEGIN COMMAND REFERENCE -->\n", "<!-- END COMMAND REFERENCE -->"
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	start, stop := bytes.Index(buf, []byte(begin)), bytes.Index(buf, []byte(end))
+	if start == -1 || stop < start {
+		return fmt.Errorf("command reference markers not found in %s", path)
+	}
+	updated := append([]byte{}, buf[:start+len(begin)]...)
+	updated = append(updated, server.CommandReference()...)
+	updated = append(updated, buf[stop:]...)
+	return os.WriteFile(path, updated, 0644)
+}
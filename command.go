@@ -8,7 +8,13 @@ const (
 	CommandRegister      = "register"      // Register an account.
 	CommandRegisterJSON  = "registerjson"  // Register an account and enable JSON messages.
 	CommandResetPassword = "resetpassword" // Request password reset link via email.
+	CommandResume        = "resume"        // Resume a session after reconnecting.
+	CommandStartTLS      = "starttls"      // Upgrade connection to TLS.
 	CommandPassword      = "password"      // Change password.
+	CommandTwoFactor     = "twofactor"     // Enable or disable two-factor authentication.
+	CommandAPIToken      = "apitoken"      // Create or revoke an API token.
+	CommandDeleteAccount = "deleteaccount" // Schedule account deletion.
+	CommandOTP           = "otp"           // Provide two-factor authentication code when logging in.
 	CommandSet           = "set"           // Change account setting.
 	CommandAchievements  = "achievements"  // Retrieve achievement IDs, names and descriptions.
 	CommandReplay        = "replay"        // Retrieve replay.
@@ -29,6 +35,8 @@ const (
 	CommandRematch       = "rematch"       // Offer (or accept) a rematch after a match has been finished.
 	CommandFollow        = "follow"        // Follow a player.
 	CommandUnfollow      = "unfollow"      // Un-follow a player.
+	CommandWho           = "who"           // List online players.
+	CommandReport        = "report"        // Report a player to the server staff.
 	CommandBoard         = "board"         // Print current board state in human-readable form.
 	CommandPong          = "pong"          // Response to server ping.
 	CommandDisconnect    = "disconnect"    // Disconnect from server.
@@ -39,14 +47,84 @@ const (
 	CommandKick          = "kick"          // Kick a user from the server.
 	CommandBan           = "ban"           // Ban an IP address or account.
 	CommandUnban         = "unban"         // Unban an IP address or account.
+	CommandMute          = "mute"          // Prevent a user from chatting.
+	CommandUnmute        = "unmute"        // Allow a muted user to chat.
 	CommandShutdown      = "shutdown"      // Prevent the creation of new matches.
+	CommandGrant         = "grant"         // Grant a staff role to an account.
+	CommandRevoke        = "revoke"        // Revoke a staff role from an account.
+	CommandAudit         = "audit"         // Retrieve log of staff actions.
+	CommandReports       = "reports"       // List, view, claim or resolve player reports.
 )
 
+// CommandRequest is a JSON formatted command. Arguments are specified by name,
+// as listed in CommandArguments. Events sent in response to the command
+// include the request ID.
+type CommandRequest struct {
+	Type string
+	Args map[string]interface{} `json:",omitempty"`
+	ID   string                 `json:",omitempty"`
+}
+
+// CommandArguments lists the names of the arguments of each command in the
+// order they are specified in text commands. Alternative names are separated
+// by a slash. Array values are expanded into multiple arguments.
+var CommandArguments = map[string][]string{
+	CommandLogin:         {"client", "username", "password"},
+	CommandRegister:      {"client", "email", "username", "password"},
+	CommandResetPassword: {"email"},
+	CommandResume:        {"token"},
+	CommandStartTLS:      {},
+	CommandPassword:      {"old", "new"},
+	CommandTwoFactor:     {"action", "code"},
+	CommandAPIToken:      {"action"},
+	CommandDeleteAccount: {"password"},
+	CommandOTP:           {"code"},
+	CommandSet:           {"name", "value", "password"},
+	CommandAchievements:  {},
+	CommandReplay:        {"id"},
+	CommandHistory:       {"username", "page"},
+	CommandHelp:          {"command"},
+	CommandJSON:          {"value"},
+	CommandSay:           {"message"},
+	CommandList:          {},
+	CommandCreate:        {"visibility", "password", "points", "variant", "name"},
+	CommandJoin:          {"match", "password"},
+	CommandLeave:         {},
+	CommandDouble:        {},
+	CommandResign:        {},
+	CommandRoll:          {},
+	CommandMove:          {"moves"},
+	CommandReset:         {},
+	CommandOk:            {"value"},
+	CommandRematch:       {},
+	CommandFollow:        {"username"},
+	CommandUnfollow:      {"username"},
+	CommandWho:           {"filters"},
+	CommandReport:        {"username", "reason"},
+	CommandBoard:         {},
+	CommandPong:          {"message"},
+	CommandDisconnect:    {},
+	CommandMOTD:          {"message"},
+	CommandBroadcast:     {"message"},
+	CommandDefcon:        {"level"},
+	CommandRename:        {"old", "new"},
+	CommandKick:          {"username", "reason"},
+	CommandBan:           {"target", "duration", "reason"},
+	CommandUnban:         {"target"},
+	CommandMute:          {"username", "duration", "reason"},
+	CommandUnmute:        {"username"},
+	CommandShutdown:      {"minutes", "reason"},
+	CommandGrant:         {"username", "role"},
+	CommandRevoke:        {"username", "role"},
+	CommandAudit:         {"username", "page"},
+	CommandReports:       {"action/status", "id/page", "resolution"},
+}
+
 type EventType string
 
 const (
 	EventTypeWelcome      = "welcome"
-	EventTypeHelp         = "help"
+	EventTypeHelp         = "help" // Deprecated: Help is sent via notice events.
 	EventTypePing         = "ping"
 	EventTypeNotice       = "notice"
 	EventTypeSay          = "say"
@@ -67,18 +145,28 @@ const (
 	EventTypeAchievements = "achievements"
 	EventTypeReplay       = "replay"
 	EventTypeHistory      = "history"
+	EventTypeOnline       = "online"
+	EventTypeSession      = "session"
+	EventTypeOTP          = "otp"
 )
 
 var HelpText = map[string]string{
 	CommandLogin:         "[username] [password] - Log in. A random username is assigned when none is provided.",
-	CommandRegister:      "<email> <username> <password> - Register an account. A valid email address must be provided.",
+	CommandRegister:      "<email> <username> <password> - Register an account. A valid email address must be provided. Guests may register without disconnecting.",
 	CommandResetPassword: "<email> - Request a password reset link via email.",
+	CommandResume:        "<token> - Resume a session after reconnecting. Events sent while disconnected are replayed.",
+	CommandStartTLS:      "- Upgrade an unencrypted TCP connection to TLS. This must be the first command sent, and is only available when enabled by the server. Clients start TLS negotiation after the server responds with starttls.",
+	CommandTwoFactor:     "[enable/confirm <code>/disable <code>] - View two-factor authentication status, enable two-factor authentication, confirm enrolment using a code from your authenticator application or disable two-factor authentication.",
+	CommandAPIToken:      "<new/revoke> - Create a new API token, replacing any existing token, or revoke your API token. API tokens authorize requests to the HTTP API on behalf of your account.",
+	CommandOTP:           "<code> - Provide a two-factor authentication code (or recovery code) when logging in.",
 	CommandPassword:      "<old> <new> - Change account password.",
-	CommandSet:           "<name> <value> - Change account setting. Available settings: highlight, pips and moves.",
+	CommandDeleteAccount: "<password>/cancel - Schedule your account to be deleted after a grace period, or cancel a scheduled deletion.",
+	CommandSet:           "<name> <value> - Change account setting. Available settings: highlight, pips and moves. Change your email address with: set email <address> <password>",
 	CommandAchievements:  "- Retrieve achievement IDs, names and descriptions.",
 	CommandReplay:        "<id> - Retrieve replay of the specified game.",
 	CommandHistory:       "<username> [page] - Retrieve match history of the specified player.",
 	CommandHelp:          "[command] - Request help for all commands, or optionally a specific command.",
+	CommandJSON:          "<on/off> - Enable or disable JSON formatted messages.",
 	CommandSay:           "<message> - Send a chat message. This command can only be used after creating or joining a match.",
 	CommandList:          "- List all matches.",
 	CommandCreate:        "<public>/<private [password]> <points> <variant> [name] - Create a match. A variant value of 0 represents a standard game, a value of 1 represents an acey-deucey game and a value of 2 represents a tabula game.",
@@ -93,15 +181,23 @@ var HelpText = map[string]string{
 	CommandRematch:       "- Request (or accept) a rematch after a match has been finished.",
 	CommandFollow:        "<username> - Follow a player. A notification is shown whenever a followed player goes online or offline.",
 	CommandUnfollow:      "<username> - Un-follow a player.",
+	CommandWho:           "[filter]... - List online players. Filter by status (idle, playing, spectating or seeking), by followed players (following) or by username.",
+	CommandReport:        "<username> <reason> - Report a player to the server staff. When reporting a player in your current match, the match replay and recent chat are included.",
 	CommandBoard:         "- Request current match state.",
 	CommandPong:          "<message> - Sent in response to server ping event to prevent the connection from timing out.",
 	CommandDisconnect:    "- Disconnect from the server.",
-	CommandMOTD:          "[message] - View (or set) message of the day. Specifying a new message of the day is only available to server administrators.",
-	CommandBroadcast:     "<message> - Send a message to all players. This command is only available to server administrators.",
+	CommandMOTD:          "[message] - View (or set) message of the day. Specifying a new message of the day is only available to server administrators and moderators.",
+	CommandBroadcast:     "<message> - Send a message to all players. This command is only available to server administrators, moderators and tournament directors.",
 	CommandDefcon:        "[level] - Apply restrictions to guests to prevent abuse. Levels:\n1. Disallow new accounts from being registered.\n2. Only registered users may connect.\n3. Only registered users may chat and set custom match titles.\n4. Warning message is broadcast to all users.\n5. Normal operation.",
 	CommandRename:        "<old> <new> - Rename an account.",
 	CommandKick:          "<username> [reason] - Kick a user from the server.",
-	CommandBan:           "<username> [reason] - Ban a user by IP addresss and account (if logged in).",
-	CommandUnban:         "<IP>/<username> - Unban a user by IP address or account.",
+	CommandBan:           "<username>/<IP>/<network> [duration] [reason] - Ban a user by IP addresss and account (if logged in), or ban an IP address or network (in CIDR notation). Durations are specified as a number followed by m (minutes), h (hours), d (days) or w (weeks). Bans are permanent when no duration is specified.",
+	CommandUnban:         "<IP>/<network>/<username> - Unban a user by IP address, network or account.",
+	CommandMute:          "<username> <duration> [reason] - Prevent a user from chatting for the specified duration.",
+	CommandUnmute:        "<username> - Allow a muted user to chat.",
 	CommandShutdown:      "<minutes> <reason> - Prevent the creation of new matches and periodically warn players about the server shutting down. This command is only available to server administrators.",
+	CommandGrant:         "<username> <role> - Grant a staff role (admin, mod or td) to an account. This command is only available to server administrators.",
+	CommandRevoke:        "<username> <role> - Revoke a staff role (admin, mod or td) from an account. This command is only available to server administrators.",
+	CommandAudit:         "[username] [page] - Retrieve log of staff actions, optionally only those performed by or targeting the specified user. This command is only available to server administrators and moderators.",
+	CommandReports:       "[open/claimed/resolved/all] [page] / view <id> / claim <id> / resolve <id> <resolution> - List, view, claim or resolve player reports. This command is only available to server administrators and moderators.",
 }
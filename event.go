@@ -18,16 +18,31 @@ const (
 	SpeedInstant int8 = 3
 )
 
+const (
+	StatusIdle       = "idle"
+	StatusPlaying    = "playing"
+	StatusSpectating = "spectating"
+	StatusSeeking    = "seeking"
+)
+
 type Event struct {
-	Type   string
-	Player string
+	Type      string
+	Player    string
+	RequestID string `json:",omitempty"` // ID of the JSON formatted command which the event is in response to.
+}
+
+// SetRequestID sets the ID of the JSON formatted command which the event is in response to.
+func (e *Event) SetRequestID(id string) {
+	e.RequestID = id
 }
 
 type EventWelcome struct {
 	Event
-	PlayerName string
-	Clients    int
-	Games      int
+	PlayerName   string
+	Clients      int
+	Games        int
+	Protocol     int
+	Capabilities []string
 }
 
 type EventPing struct {
@@ -189,6 +204,60 @@ type EventHistory struct {
 	CasualTabulaMulti      int
 }
 
+type OnlinePlayer struct {
+	Name     string
+	Rating   int
+	Status   string
+	Match    int  // Match ID, or 0 when idle.
+	Followed bool // Whether the player is followed by the requesting user.
+}
+
+type EventOnline struct {
+	Event
+	Players []OnlinePlayer
+}
+
+// EventSession provides a token which may be used to resume the session after
+// reconnecting.
+type EventSession struct {
+	Event
+	Token string
+}
+
+// EventOTP is sent after logging in with a password to an account which has
+// two-factor authentication enabled. Clients must respond with the otp command.
+type EventOTP struct {
+	Event
+}
+
+// events maps event types to functions which return a new event of that type.
+var events = map[string]func() interface{}{
+	EventTypeWelcome:      func() interface{} { return &EventWelcome{} },
+	EventTypePing:         func() interface{} { return &EventPing{} },
+	EventTypeNotice:       func() interface{} { return &EventNotice{} },
+	EventTypeSay:          func() interface{} { return &EventSay{} },
+	EventTypeList:         func() interface{} { return &EventList{} },
+	EventTypeFailedCreate: func() interface{} { return &EventFailedCreate{} },
+	EventTypeJoined:       func() interface{} { return &EventJoined{} },
+	EventTypeFailedJoin:   func() interface{} { return &EventFailedJoin{} },
+	EventTypeLeft:         func() interface{} { return &EventLeft{} },
+	EventTypeFailedLeave:  func() interface{} { return &EventFailedLeave{} },
+	EventTypeBoard:        func() interface{} { return &EventBoard{} },
+	EventTypeRolled:       func() interface{} { return &EventRolled{} },
+	EventTypeFailedRoll:   func() interface{} { return &EventFailedRoll{} },
+	EventTypeMoved:        func() interface{} { return &EventMoved{} },
+	EventTypeFailedMove:   func() interface{} { return &EventFailedMove{} },
+	EventTypeFailedOk:     func() interface{} { return &EventFailedOk{} },
+	EventTypeWin:          func() interface{} { return &EventWin{} },
+	EventTypeSettings:     func() interface{} { return &EventSettings{} },
+	EventTypeAchievements: func() interface{} { return &EventAchievements{} },
+	EventTypeReplay:       func() interface{} { return &EventReplay{} },
+	EventTypeHistory:      func() interface{} { return &EventHistory{} },
+	EventTypeOnline:       func() interface{} { return &EventOnline{} },
+	EventTypeSession:      func() interface{} { return &EventSession{} },
+	EventTypeOTP:          func() interface{} { return &EventOTP{} },
+}
+
 func DecodeEvent(message []byte) (interface{}, error) {
 	e := &Event{}
 	err := json.Unmarshal(message, e)
@@ -196,53 +265,11 @@ func DecodeEvent(message []byte) (interface{}, error) {
 		return nil, err
 	}
 
-	var ev interface{}
-	switch e.Type {
-	case EventTypeWelcome:
-		ev = &EventWelcome{}
-	case EventTypePing:
-		ev = &EventPing{}
-	case EventTypeNotice:
-		ev = &EventNotice{}
-	case EventTypeSay:
-		ev = &EventSay{}
-	case EventTypeList:
-		ev = &EventList{}
-	case EventTypeFailedCreate:
-		ev = &EventFailedCreate{}
-	case EventTypeJoined:
-		ev = &EventJoined{}
-	case EventTypeFailedJoin:
-		ev = &EventFailedJoin{}
-	case EventTypeLeft:
-		ev = &EventLeft{}
-	case EventTypeFailedLeave:
-		ev = &EventFailedLeave{}
-	case EventTypeBoard:
-		ev = &EventBoard{}
-	case EventTypeRolled:
-		ev = &EventRolled{}
-	case EventTypeFailedRoll:
-		ev = &EventFailedRoll{}
-	case EventTypeMoved:
-		ev = &EventMoved{}
-	case EventTypeFailedMove:
-		ev = &EventFailedMove{}
-	case EventTypeFailedOk:
-		ev = &EventFailedOk{}
-	case EventTypeWin:
-		ev = &EventWin{}
-	case EventTypeSettings:
-		ev = &EventSettings{}
-	case EventTypeAchievements:
-		ev = &EventAchievements{}
-	case EventTypeReplay:
-		ev = &EventReplay{}
-	case EventTypeHistory:
-		ev = &EventHistory{}
-	default:
+	newEvent, ok := events[e.Type]
+	if !ok {
 		return nil, fmt.Errorf("failed to decode event: unknown event type: %s", e.Type)
 	}
+	ev := newEvent()
 
 	err = json.Unmarshal(message, ev)
 	if err != nil {
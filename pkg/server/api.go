@@ -0,0 +1,415 @@
+//go:build full
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"codeberg.org/tslocum/bgammon"
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is the path prefix of the current version of the HTTP API.
+const apiPrefix = "/api/v1"
+
+const (
+	apiDefaultLimit = 50
+	apiMaxLimit     = 100
+)
+
+// apiPage is a page of results. More is set when additional pages are available.
+type apiPage struct {
+	Page    int
+	Limit   int
+	More    bool
+	Results any
+}
+
+type apiError struct {
+	Error string
+}
+
+type apiPlayer struct {
+	Username     string
+	Icon         int
+	Status       string // Empty when the player is offline.
+	Match        int    // ID of the match the player is in, if any.
+	Ratings      map[string]int
+	Achievements []*apiAchievement
+}
+
+type apiAchievement struct {
+	ID          int
+	Name        string
+	Description string
+	Replay      int
+	Timestamp   int64
+}
+
+type apiReplay struct {
+	ID        int
+	Timestamp int64
+	Player1   string
+	Player2   string
+	Replay    string
+}
+
+type apiChallengeRequest struct {
+	Opponent string
+	Points   int
+	Variant  int8
+	Name     string
+}
+
+type apiChallenge struct {
+	Match    int
+	Password string
+}
+
+// handleAPI registers the HTTP API routes.
+func (s *Server) handleAPI(handle func(path string, f func(http.ResponseWriter, *http.Request)) *mux.Route) {
+	handle(apiPrefix+"/matches", s.handleAPIMatches).Methods(http.MethodGet)
+	handle(apiPrefix+"/players/{username:[A-Za-z0-9_\\-]+}", s.handleAPIPlayer).Methods(http.MethodGet)
+	handle(apiPrefix+"/players/{username:[A-Za-z0-9_\\-]+}/ratings", s.handleAPIPlayerRatings).Methods(http.MethodGet)
+	handle(apiPrefix+"/players/{username:[A-Za-z0-9_\\-]+}/achievements", s.handleAPIPlayerAchievements).Methods(http.MethodGet)
+	handle(apiPrefix+"/players/{username:[A-Za-z0-9_\\-]+}/history", s.handleAPIPlayerHistory).Methods(http.MethodGet)
+	handle(apiPrefix+"/replays/{id:[0-9]+}", s.handleAPIReplay).Methods(http.MethodGet)
+	handle(apiPrefix+"/challenges", s.handleAPIChallenge).Methods(http.MethodPost)
+}
+
+func (s *Server) writeAPIResponse(w http.ResponseWriter, status int, v any) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Printf("failed to marshal %+v: %s", v, err)
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+func (s *Server) writeAPIError(w http.ResponseWriter, status int, message string) {
+	s.writeAPIResponse(w, status, &apiError{Error: message})
+}
+
+// apiPaging returns the requested page number and page size.
+func apiPaging(r *http.Request) (page int, limit int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = apiDefaultLimit
+	} else if limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+	return page, limit
+}
+
+// apiVariant returns the variant specified via the variant query parameter, or
+// -1 when no variant was specified. ok is false when the variant is invalid.
+func apiVariant(r *http.Request) (variant int8, ok bool) {
+	v := r.URL.Query().Get("variant")
+	if v == "" {
+		return -1, true
+	}
+	switch v {
+	case "0", "backgammon":
+		return bgammon.VariantBackgammon, true
+	case "1", "acey":
+		return bgammon.VariantAceyDeucey, true
+	case "2", "tabula":
+		return bgammon.VariantTabula, true
+	default:
+		return -1, false
+	}
+}
+
+func (s *Server) handleAPIMatches(w http.ResponseWriter, r *http.Request) {
+	page, limit := apiPaging(r)
+	variant, ok := apiVariant(r)
+	if !ok {
+		s.writeAPIError(w, http.StatusBadRequest, "Invalid variant.")
+		return
+	}
+	query := r.URL.Query()
+	points, _ := strconv.Atoi(query.Get("points"))
+	open := query.Get("open") == "1" || query.Get("open") == "true"
+	private := query.Get("private")
+
+	matches := []*bgammon.GameListing{}
+	s.gamesLock.RLock()
+	for _, g := range s.games {
+		listing := g.listing(nil)
+		switch {
+		case listing == nil,
+			variant != -1 && g.Variant != variant,
+			points != 0 && int(g.Points) != points,
+			open && listing.Players >= 2,
+			(private == "0" || private == "false") && listing.Password,
+			(private == "1" || private == "true") && !listing.Password:
+			continue
+		}
+		matches = append(matches, listing)
+	}
+	s.gamesLock.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID < matches[j].ID
+	})
+	result := &apiPage{
+		Page:    page,
+		Limit:   limit,
+		Results: []*bgammon.GameListing{},
+	}
+	offset := (page - 1) * limit
+	if offset < len(matches) {
+		end := offset + limit
+		if end < len(matches) {
+			result.More = true
+		} else {
+			end = len(matches)
+		}
+		result.Results = matches[offset:end]
+	}
+	s.writeAPIResponse(w, http.StatusOK, result)
+}
+
+// apiAccount returns the account specified in the request path. An error
+// response is written and nil is returned when the account is not found.
+func (s *Server) apiAccount(w http.ResponseWriter, r *http.Request) *account {
+	a, err := accountByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		s.logger.Printf("failed to retrieve account: %s", err)
+		s.writeAPIError(w, http.StatusInternalServerError, "Failed to retrieve player.")
+		return nil
+	} else if a == nil {
+		s.writeAPIError(w, http.StatusNotFound, "Player not found.")
+		return nil
+	}
+	return a
+}
+
+func apiRatings(a *account) map[string]int {
+	ratings := make(map[string]int)
+	for _, matchType := range []int{matchTypeCasual, matchTypeRated} {
+		r, prefix := a.casual, "casual"
+		if matchType == matchTypeRated {
+			r, prefix = a.competitive, "rated"
+		}
+		for _, variant := range []int8{bgammon.VariantBackgammon, bgammon.VariantAceyDeucey, bgammon.VariantTabula} {
+			name := "backgammon"
+			switch variant {
+			case bgammon.VariantAceyDeucey:
+				name = "acey"
+			case bgammon.VariantTabula:
+				name = "tabula"
+			}
+			ratings[prefix+"_"+name+"_single"] = r.getRating(variant, false) / 100
+			ratings[prefix+"_"+name+"_multi"] = r.getRating(variant, true) / 100
+		}
+	}
+	return ratings
+}
+
+func apiAchievements(a *account) []*apiAchievement {
+	achievements := []*apiAchievement{}
+	for i, id := range a.achievementIDs {
+		info := Achievements[id]
+		achievements = append(achievements, &apiAchievement{
+			ID:          id,
+			Name:        info[0],
+			Description: info[1],
+			Replay:      a.achievementGames[i],
+			Timestamp:   a.achievementDates[i],
+		})
+	}
+	return achievements
+}
+
+func (s *Server) handleAPIPlayer(w http.ResponseWriter, r *http.Request) {
+	a := s.apiAccount(w, r)
+	if a == nil {
+		return
+	}
+
+	p := &apiPlayer{
+		Username:     string(a.username),
+		Icon:         a.icon,
+		Ratings:      apiRatings(a),
+		Achievements: apiAchievements(a),
+	}
+	for _, player := range s.cachedOnline() {
+		if strings.EqualFold(player.Name, p.Username) {
+			p.Status, p.Match = player.Status, player.Match
+			break
+		}
+	}
+	s.writeAPIResponse(w, http.StatusOK, p)
+}
+
+func (s *Server) handleAPIPlayerRatings(w http.ResponseWriter, r *http.Request) {
+	a := s.apiAccount(w, r)
+	if a == nil {
+		return
+	}
+	s.writeAPIResponse(w, http.StatusOK, apiRatings(a))
+}
+
+func (s *Server) handleAPIPlayerAchievements(w http.ResponseWriter, r *http.Request) {
+	a := s.apiAccount(w, r)
+	if a == nil {
+		return
+	}
+	s.writeAPIResponse(w, http.StatusOK, apiAchievements(a))
+}
+
+func (s *Server) handleAPIPlayerHistory(w http.ResponseWriter, r *http.Request) {
+	a := s.apiAccount(w, r)
+	if a == nil {
+		return
+	}
+	page, limit := apiPaging(r)
+	variant, ok := apiVariant(r)
+	if !ok {
+		s.writeAPIError(w, http.StatusBadRequest, "Invalid variant.")
+		return
+	}
+
+	entries, err := searchMatchHistory(string(a.username), r.URL.Query().Get("opponent"), variant, (page-1)*limit, limit+1)
+	if err != nil {
+		s.logger.Printf("failed to retrieve match history: %s", err)
+		s.writeAPIError(w, http.StatusInternalServerError, "Failed to retrieve match history.")
+		return
+	}
+	result := &apiPage{
+		Page:    page,
+		Limit:   limit,
+		Results: []*historyEntry{},
+	}
+	if len(entries) > limit {
+		entries, result.More = entries[:limit], true
+	}
+	if len(entries) != 0 {
+		result.Results = entries
+	}
+	s.writeAPIResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) handleAPIReplay(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		s.writeAPIError(w, http.StatusNotFound, "Replay not found.")
+		return
+	}
+
+	timestamp, player1, player2, replay, err := matchInfo(id)
+	if err != nil {
+		s.logger.Printf("failed to retrieve match: %s", err)
+		s.writeAPIError(w, http.StatusInternalServerError, "Failed to retrieve replay.")
+		return
+	} else if len(replay) == 0 {
+		s.writeAPIError(w, http.StatusNotFound, "Replay not found.")
+		return
+	}
+	s.writeAPIResponse(w, http.StatusOK, &apiReplay{
+		ID:        id,
+		Timestamp: timestamp,
+		Player1:   player1,
+		Player2:   player2,
+		Replay:    string(replay),
+	})
+}
+
+// authenticateAPIToken authenticates a request using the API token provided
+// via the Authorization header. An error response is written and 0 is returned
+// when authentication fails.
+func (s *Server) authenticateAPIToken(w http.ResponseWriter, r *http.Request) int {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bgammon.org"`)
+		s.writeAPIError(w, http.StatusUnauthorized, "API token required.")
+		return 0
+	}
+	address := s.hashIP(s.requestAddress(r))
+	if s.logins.locked(address) != 0 {
+		s.writeAPIError(w, http.StatusTooManyRequests, "Too many failed login attempts.")
+		return 0
+	}
+	id, err := accountIDByAPIToken(hashAPIToken(strings.TrimSpace(token), s.passwordSalt))
+	if err != nil {
+		s.logger.Printf("failed to authenticate API token: %s", err)
+		s.writeAPIError(w, http.StatusInternalServerError, "Failed to authenticate API token.")
+		return 0
+	} else if id == 0 {
+		s.logins.fail(address)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bgammon.org"`)
+		s.writeAPIError(w, http.StatusUnauthorized, "Invalid API token.")
+		return 0
+	}
+	s.logins.clear(address)
+	return id
+}
+
+// handleAPIChallenge creates a private match on behalf of a player who is
+// logged in and invites their opponent to join it.
+func (s *Server) handleAPIChallenge(w http.ResponseWriter, r *http.Request) {
+	id := s.authenticateAPIToken(w, r)
+	if id == 0 {
+		return
+	}
+
+	req := &apiChallengeRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(req)
+	if err != nil {
+		s.writeAPIError(w, http.StatusBadRequest, "Invalid request.")
+		return
+	} else if req.Points < 1 || req.Points > 127 {
+		s.writeAPIError(w, http.StatusBadRequest, "Points must be between 1 and 127.")
+		return
+	} else if req.Variant != bgammon.VariantBackgammon && req.Variant != bgammon.VariantAceyDeucey && req.Variant != bgammon.VariantTabula {
+		s.writeAPIError(w, http.StatusBadRequest, "Invalid variant.")
+		return
+	}
+
+	s.apiChallenge(w, r, id, req)
+}
+
+// apiChallenge requests a challenge on behalf of the player logged in to the
+// specified account. Matches are created by the command handler.
+func (s *Server) apiChallenge(w http.ResponseWriter, r *http.Request, id int, req *apiChallengeRequest) {
+	password := []byte(generateAPIToken()[:8])
+	result := make(chan *challengeResult, 1)
+	s.queueCommand(serverCommand{
+		challenge: &challenge{
+			account:  id,
+			opponent: []byte(req.Opponent),
+			name:     []byte(strings.TrimSpace(req.Name)),
+			password: password,
+			points:   int8(req.Points),
+			variant:  req.Variant,
+			result:   result,
+		},
+	})
+
+	select {
+	case res := <-result:
+		if res.status != http.StatusCreated {
+			s.writeAPIError(w, res.status, res.message)
+			return
+		}
+		s.writeAPIResponse(w, http.StatusCreated, &apiChallenge{
+			Match:    res.match,
+			Password: string(password),
+		})
+	case <-s.done:
+		s.writeAPIError(w, http.StatusServiceUnavailable, "The server is shutting down.")
+	case <-r.Context().Done():
+	}
+}
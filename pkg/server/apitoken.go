@@ -0,0 +1,28 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// apiTokenLength is the number of random bytes in an API token.
+const apiTokenLength = 24
+
+// generateAPIToken returns a new API token. Only the hash of the token is stored.
+func generateAPIToken() string {
+	b := make([]byte, apiTokenLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panicf("failed to generate API token: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashAPIToken(token string, salt string) string {
+	h := sha256.New()
+	h.Write([]byte(token + salt))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Server event types.
+const (
+	EventMatchCreated        = "matchcreated"
+	EventPlayerJoined        = "playerjoined"
+	EventPlayerLeft          = "playerleft"
+	EventRoll                = "roll"
+	EventMove                = "move"
+	EventDouble              = "double"
+	EventGameWon             = "gamewon"
+	EventMatchEnded          = "matchended"
+	EventAchievementUnlocked = "achievementunlocked"
+	EventAccountRegistered   = "accountregistered"
+)
+
+// subscriptionBufferSize is the number of events buffered for each
+// subscription. Events published while a subscription's buffer is full are
+// dropped.
+const subscriptionBufferSize = 256
+
+// Event is published by the server when a match or account event occurs.
+type Event struct {
+	ID          int64    `json:"id"` // Unique and increasing event ID. IDs are not reused when the server restarts.
+	Type        string   `json:"type"`
+	Time        int64    `json:"time"` // Unix timestamp.
+	Match       *Match   `json:"match,omitempty"`
+	Player      string   `json:"player,omitempty"`
+	Roll        []int8   `json:"roll,omitempty"`        // Dice rolled. Only one die is rolled by each player when starting a game.
+	Moves       [][]int8 `json:"moves,omitempty"`       // Moves played, from the perspective of player 1.
+	Points      int8     `json:"points,omitempty"`      // Value of the doubling cube offered, or the number of points won.
+	Accepted    bool     `json:"accepted,omitempty"`    // Whether a double was accepted.
+	Achievement int      `json:"achievement,omitempty"` // Achievement ID.
+}
+
+// Subscription receives server events. Events are sent to C until the
+// subscription is closed or the server stops.
+type Subscription struct {
+	C <-chan *Event
+
+	c      chan *Event
+	types  map[string]bool // Nil when subscribed to all events.
+	bus    *eventBus
+	closed bool
+}
+
+// Close unsubscribes from server events and closes C.
+func (sub *Subscription) Close() {
+	sub.bus.unsubscribe(sub)
+}
+
+type eventBus struct {
+	subscriptions []*Subscription
+	lastID        int64
+	stopped       bool
+	sync.Mutex
+}
+
+func (b *eventBus) subscribe(types []string) *Subscription {
+	c := make(chan *Event, subscriptionBufferSize)
+	sub := &Subscription{
+		C:   c,
+		c:   c,
+		bus: b,
+	}
+	if len(types) != 0 {
+		sub.types = make(map[string]bool)
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.stopped {
+		sub.closed = true
+		close(sub.c)
+		return sub
+	}
+	b.subscriptions = append(b.subscriptions, sub)
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+	if sub.closed {
+		return
+	}
+	for i, s := range b.subscriptions {
+		if s == sub {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			break
+		}
+	}
+	sub.closed = true
+	close(sub.c)
+}
+
+// seed sets the event ID which the IDs of published events follow. IDs are
+// seeded with the time the server was created in microseconds, so that IDs are
+// not reused when the server restarts while remaining small enough to be
+// represented exactly by JSON decoders which use floating-point numbers.
+func (b *eventBus) seed(t time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.lastID = t.UnixMicro()
+}
+
+// publish sends an event to all subscriptions. It returns the number of
+// subscriptions which were too busy to receive the event.
+func (b *eventBus) publish(ev *Event) int {
+	b.Lock()
+	defer b.Unlock()
+	if b.stopped {
+		return 0
+	}
+	b.lastID++
+	ev.ID = b.lastID
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+	var dropped int
+	for _, sub := range b.subscriptions {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.c <- ev:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// stop closes all subscriptions. Subscriptions created afterward are closed
+// immediately.
+func (b *eventBus) stop() {
+	b.Lock()
+	defer b.Unlock()
+	b.stopped = true
+	for _, sub := range b.subscriptions {
+		sub.closed = true
+		close(sub.c)
+	}
+	b.subscriptions = nil
+}
+
+// Subscribe returns a subscription to server events of the specified types, or
+// all events when no types are specified. Events are shared between
+// subscribers and must not be modified. Subscribers must receive events
+// promptly, as events are dropped when a subscription's buffer is full.
+func (s *Server) Subscribe(types ...string) *Subscription {
+	return s.bus.subscribe(types)
+}
+
+func (s *Server) publish(ev *Event) {
+	if s == nil {
+		return
+	}
+	dropped := s.bus.publish(ev)
+	if dropped != 0 {
+		s.logger.Printf("Dropped %s event for %d busy subscriber(s)", ev.Type, dropped)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// certificateStore holds the certificate used by secure listeners. The
+// certificate may be reloaded while the server is running.
+type certificateStore struct {
+	certFile    string
+	certKey     string
+	certificate *tls.Certificate
+	sync.RWMutex
+}
+
+// load reads the certificate from disk, replacing the current certificate.
+// The current certificate remains in use when loading fails.
+func (cs *certificateStore) load() error {
+	if cs.certFile == "" || cs.certKey == "" {
+		return fmt.Errorf("certificate file and key must be specified")
+	}
+	certificate, err := tls.LoadX509KeyPair(cs.certFile, cs.certKey)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %s", err)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	cs.certificate = &certificate
+	return nil
+}
+
+func (cs *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.RLock()
+	defer cs.RUnlock()
+	if cs.certificate == nil {
+		return nil, fmt.Errorf("certificate not loaded")
+	}
+	return cs.certificate, nil
+}
+
+// tlsConfig returns the configuration used by secure listeners, loading the
+// certificate when it has not been loaded yet.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	s.certificates.RLock()
+	loaded := s.certificates.certificate != nil
+	s.certificates.RUnlock()
+	if !loaded {
+		err := s.certificates.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.certificates.getCertificate,
+	}, nil
+}
+
+// ReloadCertificate reloads the certificate used by secure listeners from
+// Options.CertFile and Options.CertKey. Connections established afterward use
+// the new certificate.
+func (s *Server) ReloadCertificate() error {
+	err := s.certificates.load()
+	if err != nil {
+		return err
+	}
+	s.logger.Printf("Reloaded certificate %s", s.certificates.certFile)
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/tslocum/bgammon"
@@ -69,31 +71,102 @@ func (r *clientRating) setRating(variant int8, multiPoint bool, rating int) {
 }
 
 type serverClient struct {
-	id           int
-	json         bool
-	name         []byte
-	language     string
-	account      *account
-	accountID    int
-	connected    int64
-	active       int64
-	lastPing     int64
-	commands     chan []byte
-	autoplay     bool
-	playerNumber int8
-	terminating  bool
+	id            int
+	json          bool
+	name          []byte
+	language      string
+	account       *account
+	accountID     int
+	connected     int64
+	active        int64
+	lastPing      int64
+	commands      chan []byte
+	events        chan []byte // Events waiting to be written.
+	transport     string
+	autoplay      bool
+	playerNumber  int8
+	terminating   bool
+	addresses     []string // Hashed IP address and network prefixes.
+	muted         int64    // Mute expiry.
+	muteReason    string
+	lastReport    int64
+	session       string          // Token used to resume the session after reconnecting.
+	detached      *detachedClient // Buffers events while disconnected.
+	replaced      bool            // Session was resumed by another connection.
+	otpCodes      chan []byte     // Two-factor authentication codes provided while logging in.
+	staffDisabled bool            // Staff roles are disabled until two-factor authentication is enabled.
+	protocol      int             // Negotiated protocol version.
+	capabilities  []string        // Capabilities announced by the client.
+	loggingIn     atomic.Bool     // Login or registration is in progress.
+	registering   atomic.Bool     // Registration of a guest is in progress.
+	connLock      sync.RWMutex    // Guards Client and detached, which are replaced when the client disconnects.
 	bgammon.Client
 }
 
+// conn returns the connection of the client. The connection is replaced by a
+// detachedClient when the client disconnects.
+func (c *serverClient) conn() bgammon.Client {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.Client
+}
+
+// detachedConn returns the buffer of a disconnected client, or nil when the
+// client is connected.
+func (c *serverClient) detachedConn() *detachedClient {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.detached
+}
+
+func (c *serverClient) Address() string {
+	return c.conn().Address()
+}
+
+func (c *serverClient) Write(message []byte) {
+	c.conn().Write(message)
+}
+
+func (c *serverClient) Terminated() bool {
+	return c.conn().Terminated()
+}
+
+// roles returns the staff roles held by the client. The first registered
+// account is always an administrator, allowing roles to be granted to others.
+// No roles are held while staffDisabled is set.
+func (c *serverClient) roles() int {
+	if c.staffDisabled {
+		return 0
+	}
+	var roles int
+	if c.account != nil {
+		roles = c.account.roles
+	}
+	if c.accountID == 1 {
+		roles |= roleAdmin
+	}
+	return roles
+}
+
 func (c *serverClient) Admin() bool {
-	return c.accountID == 1
+	return c.roles()&roleAdmin != 0
 }
 
 func (c *serverClient) Mod() bool {
-	return false
+	return c.roles()&roleModerator != 0
+}
+
+func (c *serverClient) TournamentDirector() bool {
+	return c.roles()&roleTournamentDirector != 0
 }
 
 func (c *serverClient) sendEvent(e interface{}) {
+	c.sendResponse(e, "")
+}
+
+// sendResponse sends an event in response to a command. Events sent in
+// response to a JSON formatted command include its ID.
+func (c *serverClient) sendResponse(e interface{}, requestID string) {
 	// JSON formatted messages.
 	if c.json {
 		switch ev := e.(type) {
@@ -139,9 +212,18 @@ func (c *serverClient) sendEvent(e interface{}) {
 			ev.Type = bgammon.EventTypeReplay
 		case *bgammon.EventHistory:
 			ev.Type = bgammon.EventTypeHistory
+		case *bgammon.EventOnline:
+			ev.Type = bgammon.EventTypeOnline
+		case *bgammon.EventSession:
+			ev.Type = bgammon.EventTypeSession
+		case *bgammon.EventOTP:
+			ev.Type = bgammon.EventTypeOTP
 		default:
 			log.Panicf("unknown event type %+v", ev)
 		}
+		if ev, ok := e.(interface{ SetRequestID(id string) }); ok && requestID != "" {
+			ev.SetRequestID(requestID)
+		}
 
 		buf, err := json.Marshal(e)
 		if err != nil {
@@ -175,6 +257,20 @@ func (c *serverClient) sendEvent(e interface{}) {
 			c.Write([]byte(fmt.Sprintf("game %d %d %d %d %s", g.ID, password, g.Points, g.Players, name)))
 		}
 		c.Write([]byte("listend End of matches list."))
+	case *bgammon.EventOnline:
+		c.Write([]byte("onlinestart Online players:"))
+		for _, p := range ev.Players {
+			followed := 0
+			if p.Followed {
+				followed = 1
+			}
+			c.Write([]byte(fmt.Sprintf("online %s %d %s %d %d", p.Name, p.Rating, p.Status, p.Match, followed)))
+		}
+		c.Write([]byte("onlineend End of online players list."))
+	case *bgammon.EventSession:
+		c.Write([]byte(fmt.Sprintf("session %s", ev.Token)))
+	case *bgammon.EventOTP:
+		c.Write([]byte("otp Two-factor authentication code required."))
 	case *bgammon.EventFailedCreate:
 		c.Write([]byte(fmt.Sprintf("failedcreate %s", ev.Reason)))
 	case *bgammon.EventJoined:
@@ -217,6 +313,30 @@ func (c *serverClient) sendNotice(message string) {
 	})
 }
 
+// sendSettings sends the account settings of a logged in client.
+func (c *serverClient) sendSettings() {
+	a := c.account
+	if a == nil {
+		return
+	}
+	c.sendEvent(&bgammon.EventSettings{
+		AutoPlay:      a.autoplay,
+		Highlight:     a.highlight,
+		Pips:          a.pips,
+		Moves:         a.moves,
+		Flip:          a.flip,
+		Traditional:   a.traditional,
+		Advanced:      a.advanced,
+		MuteJoinLeave: a.muteJoinLeave,
+		MuteChat:      a.muteChat,
+		MuteRoll:      a.muteRoll,
+		MuteMove:      a.muteMove,
+		MuteBearOff:   a.muteBearOff,
+		Dim:           a.dim,
+		Speed:         a.speed,
+	})
+}
+
 func (c *serverClient) sendBroadcast(message string) {
 	c.sendEvent(&bgammon.EventNotice{
 		Message: gotext.GetD(c.language, "SERVER BROADCAST:") + " " + message,
@@ -237,6 +357,12 @@ func (c *serverClient) sendDefconWarning(defcon int) {
 	})
 }
 
+// confirmed returns whether the client is not logged in to an account with an
+// unconfirmed email address.
+func (c *serverClient) confirmed() bool {
+	return c.account == nil || c.account.confirmed != 0
+}
+
 func (c *serverClient) label() string {
 	if len(c.name) > 0 {
 		return string(c.name)
@@ -258,11 +384,22 @@ func (c *serverClient) Terminate(reason string) {
 
 	go func() {
 		time.Sleep(time.Second)
-		c.Client.Terminate(reason)
+		c.conn().Terminate(reason)
 	}()
 }
 
-func logClientRead(msg []byte) {
+// disconnect ends the connection of a client immediately. The session of the
+// client may not be resumed.
+func (c *serverClient) disconnect(reason string) {
+	c.terminating = true
+	c.conn().Terminate(reason)
+}
+
+func logClientRead(logger *log.Logger, msg []byte) {
+	if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		logger.Printf("<- %s", redactCommandRequest(msg))
+		return
+	}
 	msgLower := bytes.ToLower(msg)
 	loginJSON := bytes.HasPrefix(msgLower, []byte("loginjson ")) || bytes.HasPrefix(msgLower, []byte("lj "))
 	registerJSON := bytes.HasPrefix(msgLower, []byte("registerjson ")) || bytes.HasPrefix(msgLower, []byte("rj "))
@@ -294,7 +431,7 @@ func logClientRead(msg []byte) {
 		if len(clientName) == 0 {
 			clientName = []byte("unspecified")
 		}
-		log.Printf("<- %s %s %s %s", split[0], clientName, username, password)
+		logger.Printf("<- %s %s %s %s", split[0], clientName, username, password)
 	} else if bytes.HasPrefix(msgLower, []byte("register ")) || registerJSON {
 		split := bytes.Split(msg, []byte(" "))
 		var clientName []byte
@@ -331,9 +468,9 @@ func logClientRead(msg []byte) {
 		if len(clientName) == 0 {
 			clientName = []byte("unspecified")
 		}
-		log.Printf("<- %s %s %s %s %s", split[0], clientName, email, username, password)
+		logger.Printf("<- %s %s %s %s %s", split[0], clientName, email, username, password)
 	} else if !bytes.HasPrefix(msgLower, []byte("list")) && !bytes.HasPrefix(msgLower, []byte("ls")) && !bytes.HasPrefix(msgLower, []byte("pong")) {
-		log.Printf("<- %s", msg)
+		logger.Printf("<- %s", msg)
 	}
 }
 
@@ -3,32 +3,42 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/tslocum/bgammon"
 )
 
+// startTLSReady is sent to clients before upgrading their connection to TLS.
+const startTLSReady = "starttls Ready to start TLS negotiation."
+
 var _ bgammon.Client = &socketClient{}
 
 type socketClient struct {
-	conn       net.Conn
+	conn       net.Conn // Connection, which is replaced when upgraded to TLS.
+	raw        net.Conn // Underlying connection.
+	connLock   sync.Mutex
+	startTLS   *tls.Config // Configuration used when the client upgrades its connection. Clients may not upgrade when nil.
 	address    string
 	events     chan []byte
 	commands   chan<- []byte
-	terminated bool
+	terminated atomic.Bool
 	wgEvents   sync.WaitGroup
-	verbose    bool
+	logger     *log.Logger // Logger used to print all messages. Messages are not printed when nil.
 }
 
-func newSocketClient(conn net.Conn, commands chan<- []byte, events chan []byte, verbose bool) *socketClient {
+func newSocketClient(conn net.Conn, startTLS *tls.Config, commands chan<- []byte, events chan []byte, logger *log.Logger) *socketClient {
 	return &socketClient{
 		conn:     conn,
+		raw:      conn,
+		startTLS: startTLS,
 		events:   events,
 		commands: commands,
-		verbose:  verbose,
+		logger:   logger,
 	}
 }
 
@@ -37,7 +47,7 @@ func (c *socketClient) Address() string {
 }
 
 func (c *socketClient) HandleReadWrite() {
-	if c.terminated {
+	if c.terminated.Load() {
 		return
 	}
 
@@ -50,7 +60,7 @@ func (c *socketClient) HandleReadWrite() {
 }
 
 func (c *socketClient) Write(message []byte) {
-	if c.terminated {
+	if c.terminated.Load() {
 		return
 	}
 
@@ -69,8 +79,9 @@ func (c *socketClient) readCommands() {
 
 	setTimeout()
 	var scanner = bufio.NewScanner(c.conn)
+	first := true
 	for scanner.Scan() {
-		if c.terminated {
+		if c.terminated.Load() {
 			return
 		}
 
@@ -79,28 +90,79 @@ func (c *socketClient) readCommands() {
 			return
 		}
 
+		if first && c.startTLS != nil && bytes.EqualFold(bytes.TrimSpace(scanner.Bytes()), []byte(bgammon.CommandStartTLS)) {
+			if c.logger != nil {
+				logClientRead(c.logger, scanner.Bytes())
+			}
+
+			err := c.upgrade()
+			if err != nil {
+				c.Terminate(err.Error())
+				return
+			}
+
+			// Data sent before TLS negotiation started is discarded.
+			scanner = bufio.NewScanner(c.conn)
+			first = false
+			setTimeout()
+			continue
+		}
+		first = false
+
 		buf := make([]byte, len(scanner.Bytes()))
 		copy(buf, scanner.Bytes())
 		c.commands <- buf
 
-		if c.verbose {
-			logClientRead(scanner.Bytes())
+		if c.logger != nil {
+			logClientRead(c.logger, scanner.Bytes())
 		}
 
 		setTimeout()
 	}
 }
 
-func (c *socketClient) writeEvents(closeWrite chan struct{}) {
-	setTimeout := func() {
-		err := c.conn.SetWriteDeadline(time.Now().Add(clientTimeout))
-		if err != nil {
-			c.Terminate(err.Error())
-			return
-		}
+// upgrade upgrades the connection to TLS. Events are not written until TLS
+// negotiation has completed.
+func (c *socketClient) upgrade() error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	err := c.conn.SetWriteDeadline(time.Now().Add(clientTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write([]byte(startTLSReady + "\n"))
+	if err != nil {
+		return err
 	}
 
-	setTimeout()
+	conn := tls.Server(c.conn, c.startTLS)
+	err = conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err != nil {
+		return err
+	}
+	err = conn.Handshake()
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// write writes an event to the connection.
+func (c *socketClient) write(event []byte) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	err := c.conn.SetWriteDeadline(time.Now().Add(clientTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(append(event, '\n'))
+	return err
+}
+
+func (c *socketClient) writeEvents(closeWrite chan struct{}) {
 	var event []byte
 	for {
 		select {
@@ -116,34 +178,32 @@ func (c *socketClient) writeEvents(closeWrite chan struct{}) {
 		case event = <-c.events:
 		}
 
-		if c.terminated {
+		if c.terminated.Load() {
 			c.wgEvents.Done()
 			continue
 		}
 
-		setTimeout()
-		_, err := c.conn.Write(append(event, '\n'))
+		err := c.write(event)
 		if err != nil {
 			c.Terminate(err.Error())
 			c.wgEvents.Done()
 			continue
 		}
 
-		if c.verbose && !bytes.HasPrefix(event, []byte(`{"Type":"ping"`)) && !bytes.HasPrefix(event, []byte(`{"Type":"list"`)) {
-			log.Printf("-> %s", event)
+		if c.logger != nil && !bytes.HasPrefix(event, []byte(`{"Type":"ping"`)) && !bytes.HasPrefix(event, []byte(`{"Type":"list"`)) {
+			c.logger.Printf("-> %s", event)
 		}
 		c.wgEvents.Done()
 	}
 }
 
 func (c *socketClient) Terminate(reason string) {
-	if c.terminated {
+	if !c.terminated.CompareAndSwap(false, true) {
 		return
 	}
-	c.terminated = true
-	c.conn.Close()
+	c.raw.Close()
 }
 
 func (c *socketClient) Terminated() bool {
-	return c.terminated
+	return c.terminated.Load()
 }
@@ -0,0 +1,141 @@
+//go:build full
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+)
+
+// sseKeepAlive is how often a comment is sent to idle Server-Sent Events
+// streams. The stream ends when the match is no longer available.
+const sseKeepAlive = 15 * time.Second
+
+// sseEventTypes are the event types streamed to live match viewers.
+var sseEventTypes = map[string]bool{
+	bgammon.EventTypeBoard:  true,
+	bgammon.EventTypeRolled: true,
+	bgammon.EventTypeMoved:  true,
+	bgammon.EventTypeWin:    true,
+}
+
+var _ bgammon.Client = &sseClient{}
+
+// sseClient streams match events to a viewer using Server-Sent Events. Viewers
+// are added to matches as spectators, but they are not logged in and may not
+// send commands.
+type sseClient struct {
+	w          http.ResponseWriter
+	r          *http.Request
+	flusher    http.Flusher
+	address    string
+	events     chan []byte
+	done       chan struct{}
+	active     func() bool // Returns whether the match is still available.
+	terminated bool
+	sync.Mutex
+}
+
+func newSSEClient(w http.ResponseWriter, r *http.Request, active func() bool) *sseClient {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	const bufferSize = 32
+	return &sseClient{
+		w:       w,
+		r:       r,
+		flusher: flusher,
+		events:  make(chan []byte, bufferSize),
+		done:    make(chan struct{}),
+		active:  active,
+	}
+}
+
+func (c *sseClient) Address() string {
+	return c.address
+}
+
+// HandleReadWrite streams events until the viewer disconnects, the client is
+// terminated or the match is no longer available.
+func (c *sseClient) HandleReadWrite() {
+	c.w.Header().Set("Content-Type", "text/event-stream")
+	c.w.Header().Set("Cache-Control", "no-cache")
+	c.w.Header().Set("X-Accel-Buffering", "no")
+	c.w.WriteHeader(http.StatusOK)
+	c.flusher.Flush()
+
+	t := time.NewTicker(sseKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case event := <-c.events:
+			var ev bgammon.Event
+			err := json.Unmarshal(event, &ev)
+			if err != nil || !sseEventTypes[ev.Type] {
+				continue
+			}
+			_, err = fmt.Fprintf(c.w, "event: %s\ndata: %s\n\n", ev.Type, event)
+			if err != nil {
+				c.Terminate(err.Error())
+				return
+			}
+		case <-t.C:
+			if !c.active() {
+				c.Terminate("Match ended.")
+				return
+			}
+			_, err := c.w.Write([]byte(": keepalive\n\n"))
+			if err != nil {
+				c.Terminate(err.Error())
+				return
+			}
+		case <-c.r.Context().Done():
+			c.Terminate(c.r.Context().Err().Error())
+			return
+		case <-c.done:
+			return
+		}
+		c.flusher.Flush()
+	}
+}
+
+// Write queues an event. Viewers which are unable to receive events quickly
+// enough are disconnected.
+func (c *sseClient) Write(message []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if c.terminated {
+		return
+	}
+	select {
+	case c.events <- message:
+	default:
+		c.terminate()
+	}
+}
+
+func (c *sseClient) Terminate(reason string) {
+	c.Lock()
+	defer c.Unlock()
+	c.terminate()
+}
+
+func (c *sseClient) terminate() {
+	if c.terminated {
+		return
+	}
+	c.terminated = true
+	close(c.done)
+}
+
+func (c *sseClient) Terminated() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.terminated
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"codeberg.org/tslocum/bgammon"
 	"github.com/coder/websocket"
@@ -25,12 +26,12 @@ type webSocketClient struct {
 	address    string
 	events     chan []byte
 	commands   chan<- []byte
-	terminated bool
+	terminated atomic.Bool
 	wgEvents   sync.WaitGroup
-	verbose    bool
+	logger     *log.Logger // Logger used to print all messages. Messages are not printed when nil.
 }
 
-func newWebSocketClient(r *http.Request, w http.ResponseWriter, commands chan<- []byte, events chan []byte, verbose bool) *webSocketClient {
+func newWebSocketClient(r *http.Request, w http.ResponseWriter, commands chan<- []byte, events chan []byte, logger *log.Logger) *webSocketClient {
 	conn, err := websocket.Accept(w, r, acceptOptions)
 	if err != nil {
 		return nil
@@ -40,7 +41,7 @@ func newWebSocketClient(r *http.Request, w http.ResponseWriter, commands chan<-
 		conn:     conn,
 		events:   events,
 		commands: commands,
-		verbose:  verbose,
+		logger:   logger,
 	}
 }
 
@@ -49,7 +50,7 @@ func (c *webSocketClient) Address() string {
 }
 
 func (c *webSocketClient) HandleReadWrite() {
-	if c.terminated {
+	if c.terminated.Load() {
 		return
 	}
 
@@ -62,7 +63,7 @@ func (c *webSocketClient) HandleReadWrite() {
 }
 
 func (c *webSocketClient) Write(message []byte) {
-	if c.terminated {
+	if c.terminated.Load() {
 		return
 	}
 
@@ -73,7 +74,7 @@ func (c *webSocketClient) Write(message []byte) {
 func (c *webSocketClient) readCommands() {
 	var ctx context.Context
 	for {
-		if c.terminated {
+		if c.terminated.Load() {
 			return
 		}
 
@@ -90,8 +91,8 @@ func (c *webSocketClient) readCommands() {
 		copy(buf, msgContent)
 		c.commands <- buf
 
-		if c.verbose {
-			logClientRead(msgContent)
+		if c.logger != nil {
+			logClientRead(c.logger, msgContent)
 		}
 	}
 }
@@ -113,7 +114,7 @@ func (c *webSocketClient) writeEvents(closeWrite chan struct{}) {
 		case event = <-c.events:
 		}
 
-		if c.terminated {
+		if c.terminated.Load() {
 			c.wgEvents.Done()
 			continue
 		}
@@ -126,21 +127,20 @@ func (c *webSocketClient) writeEvents(closeWrite chan struct{}) {
 			continue
 		}
 
-		if c.verbose && !bytes.HasPrefix(event, []byte(`{"Type":"ping"`)) && !bytes.HasPrefix(event, []byte(`{"Type":"list"`)) {
-			log.Printf("-> %s", event)
+		if c.logger != nil && !bytes.HasPrefix(event, []byte(`{"Type":"ping"`)) && !bytes.HasPrefix(event, []byte(`{"Type":"list"`)) {
+			c.logger.Printf("-> %s", event)
 		}
 		c.wgEvents.Done()
 	}
 }
 
 func (c *webSocketClient) Terminate(reason string) {
-	if c.terminated {
+	if !c.terminated.CompareAndSwap(false, true) {
 		return
 	}
-	c.terminated = true
 	c.conn.CloseNow()
 }
 
 func (c *webSocketClient) Terminated() bool {
-	return c.terminated
+	return c.terminated.Load()
 }
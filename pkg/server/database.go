@@ -33,11 +33,23 @@ CREATE TABLE account (
 	created                  bigint NOT NULL,
 	createdip                text NOT NULL,
 	confirmed                bigint NOT NULL DEFAULT 0,
+	confirmsent              bigint NOT NULL DEFAULT 0,
+	loginfailures            integer NOT NULL DEFAULT 0,
+	lockeduntil              bigint NOT NULL DEFAULT 0,
+	totpsecret               text NOT NULL DEFAULT '',
+	totp                     bigint NOT NULL DEFAULT 0,
+	totprecovery             text NOT NULL DEFAULT '',
+	apitoken                 text NOT NULL DEFAULT '',
+	deletion                 bigint NOT NULL DEFAULT 0,
+	newemail                 text NOT NULL DEFAULT '',
+	emailsent                bigint NOT NULL DEFAULT 0,
+	emailconfirmed           smallint NOT NULL DEFAULT 0,
 	active                   bigint NOT NULL,
 	reset                    bigint NOT NULL DEFAULT 0,
 	email                    text NOT NULL,
 	username                 text NOT NULL,
 	password                 text NOT NULL,
+	roles                    integer NOT NULL DEFAULT 0,
 	icon                     integer NOT NULL DEFAULT 0,
 	icons                    text NOT NULL DEFAULT '',
 	achievements             text NOT NULL DEFAULT '',
@@ -100,10 +112,79 @@ CREATE TABLE ban (
 	created integer NOT NULL,
 	staff integer NOT NULL,
 	reason text NOT NULL,
+	expires bigint NOT NULL DEFAULT 0,
 	UNIQUE (ip, account)
 );
+CREATE TABLE mute (
+	ip text NOT NULL,
+	account integer NOT NULL,
+	created integer NOT NULL,
+	staff integer NOT NULL,
+	reason text NOT NULL,
+	expires bigint NOT NULL DEFAULT 0,
+	UNIQUE (ip, account)
+);
+CREATE TABLE audit (
+	id      serial PRIMARY KEY,
+	created bigint NOT NULL,
+	staff   integer NOT NULL,
+	action  text NOT NULL,
+	target  text NOT NULL,
+	reason  text NOT NULL
+);
+CREATE INDEX ON audit USING btree (created);
+CREATE TABLE report (
+	id         serial PRIMARY KEY,
+	created    bigint NOT NULL,
+	reporter   integer NOT NULL,
+	reportname text NOT NULL,
+	target     text NOT NULL,
+	account    integer NOT NULL,
+	game       integer NOT NULL,
+	reason     text NOT NULL,
+	replay     text NOT NULL,
+	chat       text NOT NULL,
+	status     smallint NOT NULL DEFAULT 0,
+	staff      integer NOT NULL DEFAULT 0,
+	resolved   bigint NOT NULL DEFAULT 0,
+	resolution text NOT NULL DEFAULT ''
+);
+CREATE INDEX ON report USING btree (status);
+CREATE TABLE emailchange (
+	id       serial PRIMARY KEY,
+	created  bigint NOT NULL,
+	account  integer NOT NULL,
+	oldemail text NOT NULL,
+	newemail text NOT NULL
+);
+CREATE INDEX ON emailchange USING btree (account);
 `
 
+// databaseUpgrades are applied to existing databases each time the server starts.
+var databaseUpgrades = []string{
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS roles integer NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS audit (id serial PRIMARY KEY, created bigint NOT NULL, staff integer NOT NULL, action text NOT NULL, target text NOT NULL, reason text NOT NULL)",
+	"CREATE INDEX IF NOT EXISTS audit_created_idx ON audit USING btree (created)",
+	"ALTER TABLE ban ADD COLUMN IF NOT EXISTS expires bigint NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS report (id serial PRIMARY KEY, created bigint NOT NULL, reporter integer NOT NULL, reportname text NOT NULL, target text NOT NULL, account integer NOT NULL, game integer NOT NULL, reason text NOT NULL, replay text NOT NULL, chat text NOT NULL, status smallint NOT NULL DEFAULT 0, staff integer NOT NULL DEFAULT 0, resolved bigint NOT NULL DEFAULT 0, resolution text NOT NULL DEFAULT '')",
+	"CREATE INDEX IF NOT EXISTS report_status_idx ON report USING btree (status)",
+	// Accounts registered before email address confirmation was introduced are considered confirmed.
+	"DO $$ BEGIN IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'account' AND column_name = 'confirmsent') THEN ALTER TABLE account ADD COLUMN confirmsent bigint NOT NULL DEFAULT 0; UPDATE account SET confirmed = created WHERE confirmed = 0; END IF; END $$",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS loginfailures integer NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS lockeduntil bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS totpsecret text NOT NULL DEFAULT ''",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS totp bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS totprecovery text NOT NULL DEFAULT ''",
+	"CREATE TABLE IF NOT EXISTS mute (ip text NOT NULL, account integer NOT NULL, created integer NOT NULL, staff integer NOT NULL, reason text NOT NULL, expires bigint NOT NULL DEFAULT 0, UNIQUE (ip, account))",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS deletion bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS newemail text NOT NULL DEFAULT ''",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS emailsent bigint NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS emailconfirmed smallint NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS emailchange (id serial PRIMARY KEY, created bigint NOT NULL, account integer NOT NULL, oldemail text NOT NULL, newemail text NOT NULL)",
+	"CREATE INDEX IF NOT EXISTS emailchange_account_idx ON emailchange USING btree (account)",
+	"ALTER TABLE account ADD COLUMN IF NOT EXISTS apitoken text NOT NULL DEFAULT ''",
+}
+
 var (
 	db     *pgx.Conn
 	dbLock = &sync.Mutex{}
@@ -117,10 +198,107 @@ var argon2idParameters = &argon2id.Params{
 	KeyLength:   64,
 }
 
-func connectDB(dataSource string) error {
-	var err error
-	db, err = pgx.Connect(context.Background(), dataSource)
-	return err
+// Storage is a database connection used to store accounts, matches and
+// statistics. Only one storage may be in use at a time.
+type Storage struct {
+	conn *pgx.Conn
+}
+
+// OpenStorage connects to a PostgreSQL database.
+func OpenStorage(ctx context.Context, dataSource string) (*Storage, error) {
+	config, err := pgx.ParseConfig(dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database data source: %s", err)
+	}
+	config.Tracer = QueryTracer()
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %s", err)
+	}
+	return &Storage{conn: conn}, nil
+}
+
+// NewStorage returns a storage using an existing database connection. Query
+// durations are only recorded when the connection was configured with the
+// tracer returned by QueryTracer.
+func NewStorage(conn *pgx.Conn) *Storage {
+	return &Storage{conn: conn}
+}
+
+// Close closes the database connection.
+func (st *Storage) Close(ctx context.Context) error {
+	return st.conn.Close(ctx)
+}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	operation string
+	time      time.Time
+}
+
+// queryTracer records the duration of database queries.
+type queryTracer struct{}
+
+// QueryTracer returns a tracer which records the duration of database queries.
+func QueryTracer() pgx.QueryTracer {
+	return &queryTracer{}
+}
+
+func (t *queryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	operation, _, _ := strings.Cut(strings.TrimSpace(data.SQL), " ")
+	operation = strings.ToLower(operation)
+	switch operation {
+	case "select", "insert", "update", "delete", "set", "create", "alter":
+	default:
+		operation = "other"
+	}
+	return context.WithValue(ctx, queryStartKey{}, &queryStart{
+		operation: operation,
+		time:      time.Now(),
+	})
+}
+
+func (t *queryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(*queryStart)
+	if !ok {
+		return
+	}
+	queryDurations.observe(start.operation, time.Since(start.time))
+}
+
+// useStorage tests the database connection, initializes or upgrades the
+// database schema and uses the storage for all database queries.
+func useStorage(st *Storage) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db != nil && db != st.conn {
+		return fmt.Errorf("another storage is already in use")
+	}
+	db = st.conn
+
+	err := testDBConnection()
+	if err != nil {
+		db = nil
+		return fmt.Errorf("failed to test database connection: %s", err)
+	}
+	err = initDB()
+	if err != nil {
+		db = nil
+		return err
+	}
+	return nil
+}
+
+// releaseStorage stops using the storage for database queries.
+func releaseStorage(st *Storage) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == st.conn {
+		db = nil
+	}
 }
 
 func begin() (pgx.Tx, error) {
@@ -141,29 +319,37 @@ func testDBConnection() error {
 	return err
 }
 
-func initDB() {
+func initDB() error {
 	tx, err := begin()
 	if err != nil {
-		log.Fatalf("failed to initialize database: %s", err)
+		return fmt.Errorf("failed to initialize database: %s", err)
 	}
 	defer tx.Commit(context.Background())
 
 	var result int
 	err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'bgammon' AND table_name = 'game'").Scan(&result)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to initialize database: %s", err)
 	} else if result > 0 {
-		return // Database has been initialized.
+		// Database has been initialized.
+		for _, upgrade := range databaseUpgrades {
+			_, err = tx.Exec(context.Background(), upgrade)
+			if err != nil {
+				return fmt.Errorf("failed to upgrade database: %s", err)
+			}
+		}
+		return nil
 	}
 
 	_, err = tx.Exec(context.Background(), databaseSchema)
 	if err != nil {
-		log.Fatalf("failed to initialize database: %s", err)
+		return fmt.Errorf("failed to initialize database: %s", err)
 	}
 	log.Println("Initialized database schema")
+	return nil
 }
 
-func registerAccount(passwordSalt string, a *account, ipHash string) error {
+func registerAccount(mailServer string, resetSalt string, passwordSalt string, a *account, ipHash string) error {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 
@@ -192,21 +378,21 @@ func registerAccount(passwordSalt string, a *account, ipHash string) error {
 	var result int
 	err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM account WHERE createdip = $1", ipHash).Scan(&result)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	} else if result > 0 {
 		return fmt.Errorf("an account has already been registered from your IP address")
 	}
 
 	err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM account WHERE email = $1", bytes.ToLower(bytes.TrimSpace(a.email))).Scan(&result)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	} else if result > 0 {
 		return fmt.Errorf("email address already in use")
 	}
 
 	err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM account WHERE username = $1", bytes.ToLower(bytes.TrimSpace(a.username))).Scan(&result)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	} else if result > 0 {
 		return fmt.Errorf("username already in use")
 	}
@@ -218,10 +404,386 @@ func registerAccount(passwordSalt string, a *account, ipHash string) error {
 	}
 
 	timestamp := time.Now().Unix()
-	_, err = tx.Exec(context.Background(), "INSERT INTO account (created, createdip, active, email, username, password) VALUES ($1, $2, $3, $4, $5, $6)", timestamp, ipHash, timestamp, bytes.ToLower(bytes.TrimSpace(a.email)), bytes.ToLower(bytes.TrimSpace(a.username)), passwordHash)
+	var id int
+	err = tx.QueryRow(context.Background(), "INSERT INTO account (created, createdip, active, email, username, password) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", timestamp, ipHash, timestamp, bytes.ToLower(bytes.TrimSpace(a.email)), bytes.ToLower(bytes.TrimSpace(a.username)), passwordHash).Scan(&id)
+	if err != nil {
+		return err
+	}
+	return sendConfirmation(tx, mailServer, resetSalt, id, bytes.ToLower(bytes.TrimSpace(a.email)))
+}
+
+// confirmationKey returns the key included in email address confirmation links.
+func confirmationKey(resetSalt string, id int, sent int64) string {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("confirm/%d/%d", id, sent) + resetSalt))
+	return fmt.Sprintf("%x", h.Sum(nil))[0:16]
+}
+
+// sendConfirmation sends an email address confirmation link to an account.
+func sendConfirmation(tx pgx.Tx, mailServer string, resetSalt string, id int, email []byte) error {
+	timestamp := time.Now().Unix()
+
+	emailConfig := hermes.Hermes{
+		Product: hermes.Product{
+			Name:      "https://bgammon.org",
+			Link:      " ",
+			Copyright: " ",
+		},
+	}
+
+	confirmEmail := hermes.Email{
+		Body: hermes.Body{
+			Greeting: "Hello",
+			Intros: []string{
+				"You are receiving this email because you (or someone else) registered a bgammon.org account using this email address.",
+			},
+			Actions: []hermes.Action{
+				{
+					Instructions: "Click to confirm your email address:",
+					Button: hermes.Button{
+						Color: "#DC4D2F",
+						Text:  "Confirm your email address",
+						Link:  "https://bgammon.org/confirm/" + strconv.Itoa(id) + "/" + confirmationKey(resetSalt, id, timestamp),
+					},
+				},
+			},
+			Outros: []string{
+				"If you did not register a bgammon.org account, no further action is required on your part.",
+			},
+			Signature: "Ciao",
+		},
+	}
+	emailPlain, err := emailConfig.GeneratePlainText(confirmEmail)
+	if err != nil {
+		return nil
+	}
+	emailPlain = strings.ReplaceAll(emailPlain, "https://bgammon.org -", "https://bgammon.org")
+
+	emailHTML, err := emailConfig.GenerateHTML(confirmEmail)
+	if err != nil {
+		return nil
+	}
+
+	if sendEmail(mailServer, string(email), "Confirm your bgammon.org email address", emailPlain, emailHTML) {
+		_, err = tx.Exec(context.Background(), "UPDATE account SET confirmsent = $1 WHERE id = $2", timestamp, id)
+	}
 	return err
 }
 
+// resendConfirmation sends another email address confirmation link to an
+// unconfirmed account when no link has been sent recently.
+func resendConfirmation(mailServer string, resetSalt string, id int) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil || id <= 0 {
+		return nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	var (
+		confirmed   int64
+		confirmSent int64
+		email       []byte
+	)
+	err = tx.QueryRow(context.Background(), "SELECT confirmed, confirmsent, email FROM account WHERE id = $1", id).Scan(&confirmed, &confirmSent, &email)
+	if err == pgx.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	const confirmTimeout = 86400 // 24 hours.
+	if confirmed != 0 || time.Now().Unix()-confirmSent < confirmTimeout {
+		return nil
+	}
+	return sendConfirmation(tx, mailServer, resetSalt, id, email)
+}
+
+// confirmAccount confirms the email address of an account and returns its username.
+func confirmAccount(resetSalt string, id int, key string) (string, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return "", nil
+	} else if id == 0 {
+		return "", fmt.Errorf("no id provided")
+	} else if len(strings.TrimSpace(key)) == 0 {
+		return "", fmt.Errorf("no confirmation key provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Commit(context.Background())
+
+	var (
+		username    string
+		confirmed   int64
+		confirmSent int64
+	)
+	err = tx.QueryRow(context.Background(), "SELECT username, confirmed, confirmsent FROM account WHERE id = $1", id).Scan(&username, &confirmed, &confirmSent)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	} else if confirmSent == 0 || key != confirmationKey(resetSalt, id, confirmSent) {
+		return "", nil
+	} else if confirmed != 0 {
+		return username, nil
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE account SET confirmed = $1 WHERE id = $2", time.Now().Unix(), id)
+	return username, err
+}
+
+// Email address changes must be confirmed via both the current and new email
+// addresses within this time.
+const emailChangeTimeout = 86400 // 24 hours.
+
+// Email address change confirmations.
+const (
+	emailConfirmedOld = 1 << iota
+	emailConfirmedNew
+)
+
+func emailChangeKey(resetSalt string, id int, sent int64, email []byte) string {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("email/%d/%d/%s", id, sent, email) + resetSalt))
+	return fmt.Sprintf("%x", h.Sum(nil))[0:16]
+}
+
+// requestEmailChange sends confirmation links to the current and new email
+// addresses of an account. The email address is changed once both links are
+// followed.
+func requestEmailChange(mailServer string, resetSalt string, id int, email []byte) error {
+	email = bytes.ToLower(bytes.TrimSpace(email))
+	username, currentEmail, sent, err := prepareEmailChange(id, email)
+	if err != nil || username == "" {
+		return err
+	}
+
+	link := "https://bgammon.org/email/" + strconv.Itoa(id) + "/"
+	if !sendEmailChange(mailServer, currentEmail, "You are receiving this email because you (or someone else) requested to change the email address of the bgammon.org account "+username+" to "+string(email)+".", link+emailChangeKey(resetSalt, id, sent, currentEmail)) {
+		return fmt.Errorf("failed to send confirmation email")
+	} else if !sendEmailChange(mailServer, email, "You are receiving this email because you (or someone else) requested to change the email address of the bgammon.org account "+username+" to this email address.", link+emailChangeKey(resetSalt, id, sent, email)) {
+		return fmt.Errorf("failed to send confirmation email")
+	}
+	return nil
+}
+
+// prepareEmailChange stores the new email address of an account until the
+// change is confirmed. The username and current email address of the account
+// and the time the change was requested are returned.
+func prepareEmailChange(id int, email []byte) (string, []byte, int64, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return "", nil, 0, nil
+	} else if id <= 0 {
+		return "", nil, 0, fmt.Errorf("no id provided")
+	} else if len(email) == 0 {
+		return "", nil, 0, fmt.Errorf("please enter an email address")
+	} else if !bytes.ContainsRune(email, '@') || !bytes.ContainsRune(email, '.') {
+		return "", nil, 0, fmt.Errorf("please enter a valid email address")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return "", nil, 0, err
+	}
+	defer tx.Commit(context.Background())
+
+	var result int
+	err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM account WHERE email = $1", email).Scan(&result)
+	if err != nil {
+		return "", nil, 0, err
+	} else if result > 0 {
+		return "", nil, 0, fmt.Errorf("email address already in use")
+	}
+
+	var (
+		username     string
+		currentEmail []byte
+	)
+	err = tx.QueryRow(context.Background(), "SELECT username, email FROM account WHERE id = $1", id).Scan(&username, &currentEmail)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	sent := time.Now().Unix()
+	_, err = tx.Exec(context.Background(), "UPDATE account SET newemail = $1, emailsent = $2, emailconfirmed = 0 WHERE id = $3", email, sent, id)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return username, currentEmail, sent, nil
+}
+
+func sendEmailChange(mailServer string, email []byte, intro string, link string) bool {
+	emailConfig := hermes.Hermes{
+		Product: hermes.Product{
+			Name:      "https://bgammon.org",
+			Link:      " ",
+			Copyright: " ",
+		},
+	}
+
+	changeEmail := hermes.Email{
+		Body: hermes.Body{
+			Greeting: "Hello",
+			Intros: []string{
+				intro,
+				"The email address is changed once the change is confirmed via both the current and new email addresses.",
+			},
+			Actions: []hermes.Action{
+				{
+					Instructions: "Click to confirm the email address change:",
+					Button: hermes.Button{
+						Color: "#DC4D2F",
+						Text:  "Confirm email address change",
+						Link:  link,
+					},
+				},
+			},
+			Outros: []string{
+				"If you did not request to change your email address, no further action is required on your part.",
+			},
+			Signature: "Ciao",
+		},
+	}
+	emailPlain, err := emailConfig.GeneratePlainText(changeEmail)
+	if err != nil {
+		return false
+	}
+	emailPlain = strings.ReplaceAll(emailPlain, "https://bgammon.org -", "https://bgammon.org")
+
+	emailHTML, err := emailConfig.GenerateHTML(changeEmail)
+	if err != nil {
+		return false
+	}
+	return sendEmail(mailServer, string(email), "Confirm your bgammon.org email address change", emailPlain, emailHTML)
+}
+
+// sendEmailChangeNotice notifies the previous email address of an account that
+// the email address has been changed.
+func sendEmailChangeNotice(mailServer string, email []byte, username string, newEmail []byte) {
+	emailConfig := hermes.Hermes{
+		Product: hermes.Product{
+			Name:      "https://bgammon.org",
+			Link:      " ",
+			Copyright: " ",
+		},
+	}
+
+	noticeEmail := hermes.Email{
+		Body: hermes.Body{
+			Greeting: "Hello",
+			Intros: []string{
+				"You are receiving this email because the email address of the bgammon.org account " + username + " has been changed to " + redactEmail(newEmail) + ".",
+			},
+			Outros: []string{
+				"If you did not change your email address, please contact us at bgammon.org/community",
+			},
+			Signature: "Ciao",
+		},
+	}
+	emailPlain, err := emailConfig.GeneratePlainText(noticeEmail)
+	if err != nil {
+		return
+	}
+	emailPlain = strings.ReplaceAll(emailPlain, "https://bgammon.org -", "https://bgammon.org")
+
+	emailHTML, err := emailConfig.GenerateHTML(noticeEmail)
+	if err != nil {
+		return
+	}
+
+	sendEmail(mailServer, string(email), "Your bgammon.org email address has been changed", emailPlain, emailHTML)
+}
+
+// confirmEmailChange confirms an email address change via the current or new
+// email address. The username of the account is returned when the key is valid.
+// The previous and new email addresses are also returned once the change has
+// been confirmed via both email addresses and applied. Applied changes are
+// recorded with the email addresses redacted.
+func confirmEmailChange(resetSalt string, id int, key string) (string, []byte, []byte, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return "", nil, nil, nil
+	} else if id <= 0 {
+		return "", nil, nil, fmt.Errorf("no id provided")
+	} else if len(strings.TrimSpace(key)) == 0 {
+		return "", nil, nil, fmt.Errorf("no confirmation key provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	var (
+		username  string
+		email     []byte
+		newEmail  []byte
+		sent      int64
+		confirmed int
+	)
+	err = tx.QueryRow(context.Background(), "SELECT username, email, newemail, emailsent, emailconfirmed FROM account WHERE id = $1", id).Scan(&username, &email, &newEmail, &sent, &confirmed)
+	if err == pgx.ErrNoRows {
+		return "", nil, nil, nil
+	} else if err != nil {
+		return "", nil, nil, err
+	} else if len(newEmail) == 0 || time.Now().Unix()-sent >= emailChangeTimeout {
+		return "", nil, nil, nil
+	}
+
+	switch key {
+	case emailChangeKey(resetSalt, id, sent, email):
+		confirmed |= emailConfirmedOld
+	case emailChangeKey(resetSalt, id, sent, newEmail):
+		confirmed |= emailConfirmedNew
+	default:
+		return "", nil, nil, nil
+	}
+
+	if confirmed != emailConfirmedOld|emailConfirmedNew {
+		_, err = tx.Exec(context.Background(), "UPDATE account SET emailconfirmed = $1 WHERE id = $2", confirmed, id)
+		return username, nil, nil, err
+	}
+
+	var result int
+	err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM account WHERE email = $1", newEmail).Scan(&result)
+	if err != nil {
+		return "", nil, nil, err
+	} else if result > 0 {
+		return "", nil, nil, fmt.Errorf("email address already in use")
+	}
+
+	now := time.Now().Unix()
+	_, err = tx.Exec(context.Background(), "UPDATE account SET email = newemail, confirmed = $1, newemail = '', emailsent = 0, emailconfirmed = 0 WHERE id = $2", now, id)
+	if err != nil {
+		tx.Rollback(context.Background())
+		return "", nil, nil, err
+	}
+	_, err = tx.Exec(context.Background(), "INSERT INTO emailchange (created, account, oldemail, newemail) VALUES ($1, $2, $3, $4)", now, id, redactEmail(email), redactEmail(newEmail))
+	if err != nil {
+		tx.Rollback(context.Background())
+		return "", nil, nil, err
+	}
+	return username, email, newEmail, nil
+}
+
 func resetAccount(mailServer string, resetSalt string, email []byte) error {
 	dbLock.Lock()
 	defer dbLock.Unlock()
@@ -368,7 +930,7 @@ func confirmResetAccount(resetSalt string, passwordSalt string, id int, key stri
 		return "", "", err
 	}
 
-	_, err = tx.Exec(context.Background(), "UPDATE account SET password = $1, reset = reset - 1 WHERE id = $2", passwordHash, id)
+	_, err = tx.Exec(context.Background(), "UPDATE account SET password = $1, reset = reset - 1, loginfailures = 0, lockeduntil = 0 WHERE id = $2", passwordHash, id)
 	return username, newPassword, err
 }
 
@@ -391,7 +953,7 @@ func accountByID(id int) (*account, error) {
 		competitive: &clientRating{},
 	}
 	d := &accountData{}
-	err = tx.QueryRow(context.Background(), "SELECT id, email, username, password, icon, achievements, autoplay, highlight, pips, moves, flip, traditional, advanced, mutejoinleave, mutechat, muteroll, mutemove, mutebearoff, dim, speed, casual_backgammon_single, casual_backgammon_multi, casual_acey_single, casual_acey_multi, casual_tabula_single, casual_tabula_multi, rated_backgammon_single, rated_backgammon_multi, rated_acey_single, rated_acey_multi, rated_tabula_single, rated_tabula_multi FROM account WHERE id = $1", id).Scan(&a.id, &a.email, &a.username, &a.password, &a.icon, &d.achievements, &d.autoplay, &d.highlight, &d.pips, &d.moves, &d.flip, &d.traditional, &d.advanced, &d.muteJoinLeave, &d.muteChat, &d.muteRoll, &d.muteMove, &d.muteBearOff, &a.dim, &a.speed, &a.casual.backgammonSingle, &a.casual.backgammonMulti, &a.casual.aceySingle, &a.casual.aceyMulti, &a.casual.tabulaSingle, &a.casual.tabulaMulti, &a.competitive.backgammonSingle, &a.competitive.backgammonMulti, &a.competitive.aceySingle, &a.competitive.aceyMulti, &a.competitive.tabulaSingle, &a.competitive.tabulaMulti)
+	err = tx.QueryRow(context.Background(), "SELECT id, email, username, password, roles, confirmed, totpsecret, totp, deletion, icon, achievements, autoplay, highlight, pips, moves, flip, traditional, advanced, mutejoinleave, mutechat, muteroll, mutemove, mutebearoff, dim, speed, casual_backgammon_single, casual_backgammon_multi, casual_acey_single, casual_acey_multi, casual_tabula_single, casual_tabula_multi, rated_backgammon_single, rated_backgammon_multi, rated_acey_single, rated_acey_multi, rated_tabula_single, rated_tabula_multi FROM account WHERE id = $1", id).Scan(&a.id, &a.email, &a.username, &a.password, &a.roles, &a.confirmed, &a.totpSecret, &a.totp, &a.deletion, &a.icon, &d.achievements, &d.autoplay, &d.highlight, &d.pips, &d.moves, &d.flip, &d.traditional, &d.advanced, &d.muteJoinLeave, &d.muteChat, &d.muteRoll, &d.muteMove, &d.muteBearOff, &a.dim, &a.speed, &a.casual.backgammonSingle, &a.casual.backgammonMulti, &a.casual.aceySingle, &a.casual.aceyMulti, &a.casual.tabulaSingle, &a.casual.tabulaMulti, &a.competitive.backgammonSingle, &a.competitive.backgammonMulti, &a.competitive.aceySingle, &a.competitive.aceyMulti, &a.competitive.tabulaSingle, &a.competitive.tabulaMulti)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -420,7 +982,7 @@ func accountByUsername(username string) (*account, error) {
 		competitive: &clientRating{},
 	}
 	d := &accountData{}
-	err = tx.QueryRow(context.Background(), "SELECT id, email, username, password, icon, achievements, autoplay, highlight, pips, moves, flip, advanced, mutejoinleave, mutechat, muteroll, mutemove, mutebearoff, dim, speed, casual_backgammon_single, casual_backgammon_multi, casual_acey_single, casual_acey_multi, casual_tabula_single, casual_tabula_multi, rated_backgammon_single, rated_backgammon_multi, rated_acey_single, rated_acey_multi, rated_tabula_single, rated_tabula_multi FROM account WHERE username = $1", strings.ToLower(username)).Scan(&a.id, &a.email, &a.username, &a.password, &a.icon, &d.achievements, &d.autoplay, &d.highlight, &d.pips, &d.moves, &d.flip, &d.advanced, &d.muteJoinLeave, &d.muteChat, &d.muteRoll, &d.muteMove, &d.muteBearOff, &a.dim, &a.speed, &a.casual.backgammonSingle, &a.casual.backgammonMulti, &a.casual.aceySingle, &a.casual.aceyMulti, &a.casual.tabulaSingle, &a.casual.tabulaMulti, &a.competitive.backgammonSingle, &a.competitive.backgammonMulti, &a.competitive.aceySingle, &a.competitive.aceyMulti, &a.competitive.tabulaSingle, &a.competitive.tabulaMulti)
+	err = tx.QueryRow(context.Background(), "SELECT id, email, username, password, roles, confirmed, totpsecret, totp, deletion, icon, achievements, autoplay, highlight, pips, moves, flip, advanced, mutejoinleave, mutechat, muteroll, mutemove, mutebearoff, dim, speed, casual_backgammon_single, casual_backgammon_multi, casual_acey_single, casual_acey_multi, casual_tabula_single, casual_tabula_multi, rated_backgammon_single, rated_backgammon_multi, rated_acey_single, rated_acey_multi, rated_tabula_single, rated_tabula_multi FROM account WHERE username = $1", strings.ToLower(username)).Scan(&a.id, &a.email, &a.username, &a.password, &a.roles, &a.confirmed, &a.totpSecret, &a.totp, &a.deletion, &a.icon, &d.achievements, &d.autoplay, &d.highlight, &d.pips, &d.moves, &d.flip, &d.advanced, &d.muteJoinLeave, &d.muteChat, &d.muteRoll, &d.muteMove, &d.muteBearOff, &a.dim, &a.speed, &a.casual.backgammonSingle, &a.casual.backgammonMulti, &a.casual.aceySingle, &a.casual.aceyMulti, &a.casual.tabulaSingle, &a.casual.tabulaMulti, &a.competitive.backgammonSingle, &a.competitive.backgammonMulti, &a.competitive.aceySingle, &a.competitive.aceyMulti, &a.competitive.tabulaSingle, &a.competitive.tabulaMulti)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -430,7 +992,7 @@ func accountByUsername(username string) (*account, error) {
 	return a, nil
 }
 
-func loginAccount(passwordSalt string, username []byte, password []byte) (*account, error) {
+func loginAccount(mailServer string, passwordSalt string, username []byte, password []byte) (*account, error) {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 
@@ -453,7 +1015,7 @@ func loginAccount(passwordSalt string, username []byte, password []byte) (*accou
 		competitive: &clientRating{},
 	}
 	d := &accountData{}
-	err = tx.QueryRow(context.Background(), "SELECT id, email, username, password, icon, achievements, autoplay, highlight, pips, moves, flip, advanced, mutejoinleave, mutechat, muteroll, mutemove, mutebearoff, dim, speed, casual_backgammon_single, casual_backgammon_multi, casual_acey_single, casual_acey_multi, casual_tabula_single, casual_tabula_multi, rated_backgammon_single, rated_backgammon_multi, rated_acey_single, rated_acey_multi, rated_tabula_single, rated_tabula_multi FROM account WHERE username = $1 OR email = $2", bytes.ToLower(bytes.TrimSpace(username)), bytes.ToLower(bytes.TrimSpace(username))).Scan(&a.id, &a.email, &a.username, &a.password, &a.icon, &d.achievements, &d.autoplay, &d.highlight, &d.pips, &d.moves, &d.flip, &d.advanced, &d.muteJoinLeave, &d.muteChat, &d.muteRoll, &d.muteMove, &d.muteBearOff, &a.dim, &a.speed, &a.casual.backgammonSingle, &a.casual.backgammonMulti, &a.casual.aceySingle, &a.casual.aceyMulti, &a.casual.tabulaSingle, &a.casual.tabulaMulti, &a.competitive.backgammonSingle, &a.competitive.backgammonMulti, &a.competitive.aceySingle, &a.competitive.aceyMulti, &a.competitive.tabulaSingle, &a.competitive.tabulaMulti)
+	err = tx.QueryRow(context.Background(), "SELECT id, email, username, password, roles, confirmed, totpsecret, totp, deletion, icon, achievements, autoplay, highlight, pips, moves, flip, advanced, mutejoinleave, mutechat, muteroll, mutemove, mutebearoff, dim, speed, casual_backgammon_single, casual_backgammon_multi, casual_acey_single, casual_acey_multi, casual_tabula_single, casual_tabula_multi, rated_backgammon_single, rated_backgammon_multi, rated_acey_single, rated_acey_multi, rated_tabula_single, rated_tabula_multi FROM account WHERE username = $1 OR email = $2", bytes.ToLower(bytes.TrimSpace(username)), bytes.ToLower(bytes.TrimSpace(username))).Scan(&a.id, &a.email, &a.username, &a.password, &a.roles, &a.confirmed, &a.totpSecret, &a.totp, &a.deletion, &a.icon, &d.achievements, &d.autoplay, &d.highlight, &d.pips, &d.moves, &d.flip, &d.advanced, &d.muteJoinLeave, &d.muteChat, &d.muteRoll, &d.muteMove, &d.muteBearOff, &a.dim, &a.speed, &a.casual.backgammonSingle, &a.casual.backgammonMulti, &a.casual.aceySingle, &a.casual.aceyMulti, &a.casual.tabulaSingle, &a.casual.tabulaMulti, &a.competitive.backgammonSingle, &a.competitive.backgammonMulti, &a.competitive.aceySingle, &a.competitive.aceyMulti, &a.competitive.tabulaSingle, &a.competitive.tabulaMulti)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -463,12 +1025,35 @@ func loginAccount(passwordSalt string, username []byte, password []byte) (*accou
 	}
 	a.load(d)
 
+	var (
+		failures    int
+		lockedUntil int64
+	)
+	err = tx.QueryRow(context.Background(), "SELECT loginfailures, lockeduntil FROM account WHERE id = $1", a.id).Scan(&failures, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if lockedUntil > now {
+		return nil, &lockedError{until: lockedUntil}
+	}
+
 	match, err := argon2id.ComparePasswordAndHash(string(password)+passwordSalt, string(a.password))
 	debug.FreeOSMemory() // Hashing is memory intensive. Return memory to the OS.
 	if err != nil {
 		return nil, err
 	} else if !match {
-		return nil, nil
+		_, err = recordLoginFailure(tx, mailServer, a.id, a.email, failures+1)
+		return nil, err
+	}
+
+	// Failed attempts are cleared once a two-factor authentication code is
+	// also provided.
+	if failures != 0 && a.totp == 0 {
+		_, err = tx.Exec(context.Background(), "UPDATE account SET loginfailures = 0, lockeduntil = 0 WHERE id = $1", a.id)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var follows []byte
@@ -491,7 +1076,10 @@ func loginAccount(passwordSalt string, username []byte, password []byte) (*accou
 	return a, nil
 }
 
-func setAccountPassword(passwordSalt string, id int, password string) error {
+// setAccountTOTP updates the two-factor authentication secret and recovery
+// code hashes of an account. Two-factor authentication is enabled when the
+// enabled timestamp is non-zero.
+func setAccountTOTP(id int, secret string, enabled int64, recovery []string) error {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 
@@ -499,7 +1087,224 @@ func setAccountPassword(passwordSalt string, id int, password string) error {
 		return nil
 	} else if id <= 0 {
 		return fmt.Errorf("no id provided")
-	} else if len(strings.TrimSpace(password)) == 0 {
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE account SET totpsecret = $1, totp = $2, totprecovery = $3 WHERE id = $4", secret, enabled, strings.Join(recovery, ","), id)
+	return err
+}
+
+// setAccountAPIToken sets the hash of the API token of an account. The token is
+// revoked when the hash is blank.
+func setAccountAPIToken(id int, hash string) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	} else if id <= 0 {
+		return fmt.Errorf("no id provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE account SET apitoken = $1 WHERE id = $2", hash, id)
+	return err
+}
+
+// accountIDByAPIToken returns the ID of the account with the provided API token
+// hash, or 0 when no account was found.
+func accountIDByAPIToken(hash string) (int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil || hash == "" {
+		return 0, nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Commit(context.Background())
+
+	var id int
+	err = tx.QueryRow(context.Background(), "SELECT id FROM account WHERE apitoken = $1", hash).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// useRecoveryCode consumes a two-factor authentication recovery code. The
+// number of remaining recovery codes is returned.
+func useRecoveryCode(id int, hash string) (bool, int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return false, 0, nil
+	} else if id <= 0 {
+		return false, 0, fmt.Errorf("no id provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Commit(context.Background())
+
+	var recovery string
+	err = tx.QueryRow(context.Background(), "SELECT totprecovery FROM account WHERE id = $1", id).Scan(&recovery)
+	if err == pgx.ErrNoRows {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+
+	var remaining []string
+	var found bool
+	for _, h := range strings.Split(recovery, ",") {
+		if h == "" {
+			continue
+		} else if !found && h == hash {
+			found = true
+			continue
+		}
+		remaining = append(remaining, h)
+	}
+	if !found {
+		return false, len(remaining), nil
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE account SET totprecovery = $1 WHERE id = $2", strings.Join(remaining, ","), id)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, len(remaining), nil
+}
+
+// recordLoginFailure records the number of failed attempts to log in to an
+// account and returns the time until which logins are locked.
+func recordLoginFailure(tx pgx.Tx, mailServer string, id int, email []byte, failures int) (int64, error) {
+	lockedUntil := loginLockout(failures, accountLockFailures)
+	_, err := tx.Exec(context.Background(), "UPDATE account SET loginfailures = $1, lockeduntil = $2 WHERE id = $3", failures, lockedUntil, id)
+	if err != nil {
+		return 0, err
+	}
+	if failures == accountLockFailures {
+		sendLockoutNotice(mailServer, email)
+	}
+	return lockedUntil, nil
+}
+
+// failLogin records a failed attempt to log in to an account, such as an
+// invalid two-factor authentication code. It returns the time until which
+// logins to the account are locked, or 0 when logins are allowed.
+func failLogin(mailServer string, id int) (int64, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return 0, nil
+	} else if id <= 0 {
+		return 0, fmt.Errorf("no id provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Commit(context.Background())
+
+	var failures int
+	var email []byte
+	err = tx.QueryRow(context.Background(), "SELECT loginfailures, email FROM account WHERE id = $1", id).Scan(&failures, &email)
+	if err != nil {
+		return 0, err
+	}
+	return recordLoginFailure(tx, mailServer, id, email, failures+1)
+}
+
+// clearLoginFailures clears the failed attempts to log in to an account.
+func clearLoginFailures(id int) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	} else if id <= 0 {
+		return fmt.Errorf("no id provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE account SET loginfailures = 0, lockeduntil = 0 WHERE id = $1", id)
+	return err
+}
+
+// sendLockoutNotice notifies an account owner that their account has been
+// temporarily locked due to repeated failed login attempts.
+func sendLockoutNotice(mailServer string, email []byte) {
+	emailConfig := hermes.Hermes{
+		Product: hermes.Product{
+			Name:      "https://bgammon.org",
+			Link:      " ",
+			Copyright: " ",
+		},
+	}
+
+	noticeEmail := hermes.Email{
+		Body: hermes.Body{
+			Greeting: "Hello",
+			Intros: []string{
+				"You are receiving this email because there have been several failed attempts to log in to your bgammon.org account.",
+				"Your account has been temporarily locked. Each further failed attempt will lock your account for longer.",
+			},
+			Outros: []string{
+				"If you did not try to log in, someone may be trying to guess your password. Resetting your password will also unlock your account.",
+			},
+			Signature: "Ciao",
+		},
+	}
+	emailPlain, err := emailConfig.GeneratePlainText(noticeEmail)
+	if err != nil {
+		return
+	}
+	emailPlain = strings.ReplaceAll(emailPlain, "https://bgammon.org -", "https://bgammon.org")
+
+	emailHTML, err := emailConfig.GenerateHTML(noticeEmail)
+	if err != nil {
+		return
+	}
+
+	sendEmail(mailServer, string(email), "Failed login attempts on your bgammon.org account", emailPlain, emailHTML)
+}
+
+func setAccountPassword(passwordSalt string, id int, password string) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	} else if id <= 0 {
+		return fmt.Errorf("no id provided")
+	} else if len(strings.TrimSpace(password)) == 0 {
 		return fmt.Errorf("no password provided")
 	}
 
@@ -601,24 +1406,231 @@ func renameAccount(id int, oldUsername string, newUsername string) error {
 		return err
 	}
 
-	_, err = tx.Exec(context.Background(), "UPDATE game SET replay = REPLACE(replay, $1, $2) WHERE account1 = $3 OR account2 = $3", oldUsername, newUsername, id)
-	if err != nil {
-		tx.Rollback(context.Background())
-		return err
+	_, err = tx.Exec(context.Background(), "UPDATE game SET replay = REPLACE(replay, $1, $2) WHERE account1 = $3 OR account2 = $3", oldUsername, newUsername, id)
+	if err != nil {
+		tx.Rollback(context.Background())
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE game SET player1 = $1 WHERE account1 = $2", newUsername, id)
+	if err != nil {
+		tx.Rollback(context.Background())
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE game SET player2 = $1 WHERE account2 = $2", newUsername, id)
+	if err != nil {
+		tx.Rollback(context.Background())
+		return err
+	}
+	return nil
+}
+
+// scheduleAccountDeletion schedules an account to be deleted at the specified
+// time. A time of 0 cancels a scheduled deletion.
+func scheduleAccountDeletion(id int, deletion int64) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	} else if id <= 0 {
+		return fmt.Errorf("no id provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE account SET deletion = $1 WHERE id = $2", deletion, id)
+	return err
+}
+
+// deleteExpiredAccounts deletes accounts which were scheduled to be deleted
+// before now. Matches played by deleted accounts are kept with the name of the
+// deleted player replaced, so that the history of their opponents remains
+// intact. The IDs of the deleted accounts are returned.
+func deleteExpiredAccounts() ([]int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil, nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	var ids []int
+	var usernames []string
+	rows, err := tx.Query(context.Background(), "SELECT id, username FROM account WHERE deletion != 0 AND deletion <= $1", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var username string
+		err = rows.Scan(&id, &username)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		usernames = append(usernames, username)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Replay headers begin with: i <timestamp> <player1> <player2>
+	statements := []string{
+		`UPDATE game SET player1 = $1, account1 = 0, replay = regexp_replace(replay, '^(i \S+ )\S+', '\1' || $1) WHERE account1 = $2`,
+		`UPDATE game SET player2 = $1, account2 = 0, replay = regexp_replace(replay, '^(i \S+ \S+ )\S+', '\1' || $1) WHERE account2 = $2`,
+	}
+	for i, id := range ids {
+		for _, statement := range statements {
+			_, err = tx.Exec(context.Background(), statement, deletedPlayerName, id)
+			if err != nil {
+				tx.Rollback(context.Background())
+				return nil, err
+			}
+		}
+
+		// Reports about the account are deleted. Reports filed by the account
+		// and staff actions targeting it are anonymised. Usernames only contain
+		// letters, numbers and underscores, so they are matched as words.
+		_, err = tx.Exec(context.Background(), "DELETE FROM report WHERE account = $1", id)
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+		_, err = tx.Exec(context.Background(), `UPDATE report SET reporter = 0, reportname = $1, chat = regexp_replace(chat, '\m' || $2::text || '\M', $1, 'gi'), replay = regexp_replace(replay, '\m' || $2::text || '\M', $1, 'gi') WHERE reporter = $3`, deletedPlayerName, usernames[i], id)
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+		_, err = tx.Exec(context.Background(), "UPDATE audit SET target = $1 WHERE lower(target) = lower($2)", deletedPlayerName, usernames[i])
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+		_, err = tx.Exec(context.Background(), "DELETE FROM emailchange WHERE account = $1", id)
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+		_, err = tx.Exec(context.Background(), "DELETE FROM follow WHERE account = $1 OR target = $1", id)
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+		_, err = tx.Exec(context.Background(), "DELETE FROM account WHERE id = $1", id)
+		if err != nil {
+			tx.Rollback(context.Background())
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// exportAccount returns the personal data stored about an account, excluding
+// match history.
+func exportAccount(id int) (*accountExport, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil || id <= 0 {
+		return nil, nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	settings := []string{"autoplay", "highlight", "pips", "moves", "flip", "traditional", "advanced", "mutejoinleave", "mutechat", "muteroll", "mutemove", "mutebearoff", "dim", "speed"}
+	ratings := []string{"casual_backgammon_single", "casual_backgammon_multi", "casual_acey_single", "casual_acey_multi", "casual_tabula_single", "casual_tabula_multi", "rated_backgammon_single", "rated_backgammon_multi", "rated_acey_single", "rated_acey_multi", "rated_tabula_single", "rated_tabula_multi"}
+
+	e := &accountExport{
+		Settings: make(map[string]int),
+		Ratings:  make(map[string]int),
+	}
+	var achievements []byte
+	values := make([]int, len(settings)+len(ratings))
+	dest := []any{&e.Username, &e.Email, &e.Created, &e.Confirmed, &e.Active, &e.Deletion, &e.Icon, &achievements}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	err = tx.QueryRow(context.Background(), "SELECT username, email, created, confirmed, active, deletion, icon, achievements, "+strings.Join(settings, ", ")+", "+strings.Join(ratings, ", ")+" FROM account WHERE id = $1", id).Scan(dest...)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i, name := range settings {
+		e.Settings[name] = values[i]
+	}
+	for i, name := range ratings {
+		e.Ratings[name] = values[len(settings)+i] / 100
+	}
+
+	a := &account{}
+	a.load(&accountData{achievements: achievements})
+	for i := range a.achievementIDs {
+		e.Achievements = append(e.Achievements, &bgammon.HistoryAchievement{
+			ID:        a.achievementIDs[i],
+			Replay:    a.achievementGames[i],
+			Timestamp: a.achievementDates[i],
+		})
+	}
+
+	rows, err := tx.Query(context.Background(), "SELECT account.username FROM follow JOIN account ON account.id = follow.target WHERE follow.account = $1 ORDER BY account.username ASC", id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.Follows = append(e.Follows, username)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return e, nil
+}
+
+func setAccountRole(id int, role int, grant bool) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	} else if id <= 0 || role <= 0 {
+		return fmt.Errorf("invalid id or role: %d/%d", id, role)
 	}
 
-	_, err = tx.Exec(context.Background(), "UPDATE game SET player1 = $1 WHERE account1 = $2", newUsername, id)
+	tx, err := begin()
 	if err != nil {
-		tx.Rollback(context.Background())
 		return err
 	}
+	defer tx.Commit(context.Background())
 
-	_, err = tx.Exec(context.Background(), "UPDATE game SET player2 = $1 WHERE account2 = $2", newUsername, id)
-	if err != nil {
-		tx.Rollback(context.Background())
+	if !grant {
+		_, err = tx.Exec(context.Background(), "UPDATE account SET roles = roles & ~$1::integer WHERE id = $2", role, id)
 		return err
 	}
-	return nil
+	_, err = tx.Exec(context.Background(), "UPDATE account SET roles = roles | $1::integer WHERE id = $2", role, id)
+	return err
 }
 
 func awardAchievement(a *account, award int, game int, date int64) (bool, error) {
@@ -719,6 +1731,16 @@ func recordMatchResult(g *serverGame, matchType int) (int, error) {
 	}
 	defer tx.Commit(context.Background())
 
+	if ids := g.confirmationRequired(); len(ids) != 0 {
+		var unconfirmed int
+		err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM account WHERE id = ANY($1) AND confirmed = 0", ids).Scan(&unconfirmed)
+		if err != nil {
+			return 0, err
+		} else if unconfirmed > 0 {
+			return 0, nil
+		}
+	}
+
 	columnName := ratingColumn(matchType, g.Variant, g.Points != 1)
 
 	var rating1i int
@@ -825,7 +1847,7 @@ func replayByID(id int) ([]byte, error) {
 	return replay, nil
 }
 
-func addBan(ipHash string, account int, staff int, reason string) error {
+func addBan(ipHash string, account int, staff int, reason string, expires int64) error {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 
@@ -842,64 +1864,101 @@ func addBan(ipHash string, account int, staff int, reason string) error {
 	timestamp := time.Now().Unix()
 
 	if ipHash != "" {
-		var result int
-		err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM ban WHERE ip = $1", ipHash).Scan(&result)
+		_, err = tx.Exec(context.Background(), "INSERT INTO ban (ip, account, created, staff, reason, expires) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (ip, account) DO UPDATE SET created = $3, staff = $4, reason = $5, expires = $6", ipHash, 0, timestamp, staff, reason, expires)
 		if err != nil {
-			log.Fatal(err)
-		} else if result == 0 {
-			_, err = tx.Exec(context.Background(), "INSERT INTO ban (ip, account, created, staff, reason) VALUES ($1, $2, $3, $4, $5)", ipHash, 0, timestamp, staff, reason)
-			if err != nil {
-				log.Fatal(err)
-			}
+			return err
 		}
 	}
 
 	if account != 0 {
-		var result int
-		err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM ban WHERE account = $1", account).Scan(&result)
+		_, err = tx.Exec(context.Background(), "INSERT INTO ban (ip, account, created, staff, reason, expires) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (ip, account) DO UPDATE SET created = $3, staff = $4, reason = $5, expires = $6", "", account, timestamp, staff, reason, expires)
 		if err != nil {
-			log.Fatal(err)
-		} else if result == 0 {
-			_, err = tx.Exec(context.Background(), "INSERT INTO ban (ip, account, created, staff, reason) VALUES ($1, $2, $3, $4, $5)", "", account, timestamp, staff, reason)
-			if err != nil {
-				log.Fatal(err)
-			}
+			return err
 		}
 	}
 	return nil
 }
 
-func checkBan(ipHash string, account int) (bool, string) {
+// checkBan returns whether any of the provided IP address hashes or the
+// account is banned, as well as the reason and expiry of the ban. An expiry
+// of zero represents a permanent ban.
+func checkBan(ipHashes []string, account int) (bool, string, int64) {
+	return checkSanction("ban", ipHashes, account)
+}
+
+func deleteBan(ipHash string, account int) error {
+	return deleteSanction("ban", ipHash, account)
+}
+
+func addMute(ipHash string, account int, staff int, reason string, expires int64) error {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 
 	if db == nil || (ipHash == "" && account == 0) {
-		return false, ""
+		return nil
 	}
 
 	tx, err := begin()
 	if err != nil {
-		return false, ""
+		return err
 	}
 	defer tx.Commit(context.Background())
 
-	var row pgx.Row
-	if account == 0 {
-		row = tx.QueryRow(context.Background(), "SELECT reason FROM ban WHERE ip = $1 LIMIT 1", ipHash)
-	} else {
-		row = tx.QueryRow(context.Background(), "SELECT reason FROM ban WHERE ip = $1 OR account = $2 LIMIT 1", ipHash, account)
+	timestamp := time.Now().Unix()
+
+	if ipHash != "" {
+		_, err = tx.Exec(context.Background(), "INSERT INTO mute (ip, account, created, staff, reason, expires) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (ip, account) DO UPDATE SET created = $3, staff = $4, reason = $5, expires = $6", ipHash, 0, timestamp, staff, reason, expires)
+		if err != nil {
+			return err
+		}
+	}
+
+	if account != 0 {
+		_, err = tx.Exec(context.Background(), "INSERT INTO mute (ip, account, created, staff, reason, expires) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (ip, account) DO UPDATE SET created = $3, staff = $4, reason = $5, expires = $6", "", account, timestamp, staff, reason, expires)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMute returns whether any of the provided IP address hashes or the
+// account is muted, as well as the reason and expiry of the mute.
+func checkMute(ipHashes []string, account int) (bool, string, int64) {
+	return checkSanction("mute", ipHashes, account)
+}
+
+func deleteMute(ipHash string, account int) error {
+	return deleteSanction("mute", ipHash, account)
+}
+
+func checkSanction(table string, ipHashes []string, account int) (bool, string, int64) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil || (len(ipHashes) == 0 && account == 0) {
+		return false, "", 0
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return false, "", 0
 	}
+	defer tx.Commit(context.Background())
+
 	var reason string
-	err = row.Scan(&reason)
+	var expires int64
+	err = tx.QueryRow(context.Background(), "SELECT reason, expires FROM "+table+" WHERE (ip = ANY($1) OR ($2 != 0 AND account = $2)) AND (expires = 0 OR expires > $3) ORDER BY expires = 0 DESC, expires DESC LIMIT 1", ipHashes, account, time.Now().Unix()).Scan(&reason, &expires)
 	if err == pgx.ErrNoRows {
-		return false, ""
+		return false, "", 0
 	} else if err != nil {
-		log.Fatalf("failed to check for ban: %s", err)
+		log.Printf("failed to check for %s: %s", table, err)
+		return false, "", 0
 	}
-	return true, reason
+	return true, reason, expires
 }
 
-func deleteBan(ipHash string, account int) error {
+func deleteSanction(table string, ipHash string, account int) error {
 	dbLock.Lock()
 	defer dbLock.Unlock()
 
@@ -914,21 +1973,230 @@ func deleteBan(ipHash string, account int) error {
 	defer tx.Commit(context.Background())
 
 	if ipHash != "" {
-		_, err = tx.Exec(context.Background(), "DELETE FROM ban WHERE ip = $1", ipHash)
+		_, err = tx.Exec(context.Background(), "DELETE FROM "+table+" WHERE ip = $1", ipHash)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
 	if account != 0 {
-		_, err = tx.Exec(context.Background(), "DELETE FROM ban WHERE account = $1", account)
+		_, err = tx.Exec(context.Background(), "DELETE FROM "+table+" WHERE account = $1", account)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteExpiredSanctions lifts bans and mutes which have expired.
+func deleteExpiredSanctions() error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	now := time.Now().Unix()
+	for _, table := range []string{"ban", "mute"} {
+		_, err = tx.Exec(context.Background(), "DELETE FROM "+table+" WHERE expires != 0 AND expires <= $1", now)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 	return nil
 }
 
+func addAudit(staff int, action string, target string, reason string) error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil
+	} else if action == "" {
+		return fmt.Errorf("no action provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Commit(context.Background())
+
+	_, err = tx.Exec(context.Background(), "INSERT INTO audit (created, staff, action, target, reason) VALUES ($1, $2, $3, $4, $5)", time.Now().Unix(), staff, action, target, reason)
+	return err
+}
+
+// auditLog returns staff actions in reverse chronological order. When a
+// filter is provided, only actions performed by or targeting the specified
+// username are returned.
+func auditLog(filter string, offset int, limit int) ([]*auditEntry, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil, nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	filter = strings.ToLower(filter)
+
+	var entries []*auditEntry
+	rows, err := tx.Query(context.Background(), "SELECT audit.id, audit.created, COALESCE(account.username, ''), audit.action, audit.target, audit.reason FROM audit LEFT JOIN account ON account.id = audit.staff WHERE $1 = '' OR account.username = $1 OR LOWER(audit.target) = $1 ORDER BY audit.id DESC OFFSET $2 LIMIT $3", filter, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		if err != nil {
+			continue
+		}
+		entry := &auditEntry{}
+		err = rows.Scan(&entry.ID, &entry.Timestamp, &entry.Staff, &entry.Action, &entry.Target, &entry.Reason)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func addReport(r *playerReport, reporter int, account int) (int, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return 0, nil
+	} else if r.Target == "" || r.Reason == "" {
+		return 0, fmt.Errorf("no target or reason provided")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Commit(context.Background())
+
+	var id int
+	err = tx.QueryRow(context.Background(), "INSERT INTO report (created, reporter, reportname, target, account, game, reason, replay, chat) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id", time.Now().Unix(), reporter, r.Reporter, r.Target, account, r.Game, r.Reason, r.Replay, r.Chat).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+const reportColumns = "report.id, report.created, report.reportname, report.target, report.game, report.reason, report.replay, report.chat, report.status, COALESCE(account.username, ''), report.resolved, report.resolution"
+
+// playerReports returns reports with the specified status in chronological
+// order. A status of -1 returns all reports in reverse chronological order.
+func playerReports(status int, offset int, limit int) ([]*playerReport, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil, nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	order := "ASC"
+	if status == -1 {
+		order = "DESC"
+	}
+
+	var reports []*playerReport
+	rows, err := tx.Query(context.Background(), "SELECT "+reportColumns+" FROM report LEFT JOIN account ON account.id = report.staff WHERE $1 = -1 OR report.status = $1 ORDER BY report.id "+order+" OFFSET $2 LIMIT $3", status, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		if err != nil {
+			continue
+		}
+		r := &playerReport{}
+		err = rows.Scan(&r.ID, &r.Timestamp, &r.Reporter, &r.Target, &r.Game, &r.Reason, &r.Replay, &r.Chat, &r.Status, &r.Staff, &r.Resolved, &r.Resolution)
+		if err != nil {
+			continue
+		}
+		reports = append(reports, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+func playerReportByID(id int) (*playerReport, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil, nil
+	} else if id <= 0 {
+		return nil, fmt.Errorf("please specify an id")
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	r := &playerReport{}
+	err = tx.QueryRow(context.Background(), "SELECT "+reportColumns+" FROM report LEFT JOIN account ON account.id = report.staff WHERE report.id = $1", id).Scan(&r.ID, &r.Timestamp, &r.Reporter, &r.Target, &r.Game, &r.Reason, &r.Replay, &r.Chat, &r.Status, &r.Staff, &r.Resolved, &r.Resolution)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// updatePlayerReport claims or resolves a report. Resolved reports may not be updated.
+func updatePlayerReport(id int, staff int, status int, resolution string) (bool, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return false, nil
+	} else if id <= 0 || staff <= 0 {
+		return false, fmt.Errorf("invalid id or staff: %d/%d", id, staff)
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Commit(context.Background())
+
+	var resolved int64
+	if status == reportResolved {
+		resolved = time.Now().Unix()
+	}
+	result, err := tx.Exec(context.Background(), "UPDATE report SET status = $1, staff = $2, resolved = $3, resolution = $4 WHERE id = $5 AND status != $6", status, staff, resolved, resolution, id, reportResolved)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
 func matchHistory(username string) ([]*bgammon.HistoryMatch, error) {
 	dbLock.Lock()
 	defer dbLock.Unlock()
@@ -970,6 +2238,65 @@ func matchHistory(username string) ([]*bgammon.HistoryMatch, error) {
 	return matches, nil
 }
 
+// searchMatchHistory returns a page of the match history of a player. Matches
+// may be filtered by opponent and variant. A variant of -1 matches all variants.
+func searchMatchHistory(username string, opponent string, variant int8, offset int, limit int) ([]*historyEntry, error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	if db == nil {
+		return nil, nil
+	}
+
+	tx, err := begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Commit(context.Background())
+
+	username, opponent = strings.ToLower(username), strings.ToLower(opponent)
+
+	query := "SELECT id, variant, started, player1, player2, points, winner FROM game WHERE (LOWER(player1) = $1 OR LOWER(player2) = $1) AND replay != ''"
+	args := []any{username}
+	if opponent != "" {
+		args = append(args, opponent)
+		query += fmt.Sprintf(" AND (LOWER(player1) = $%d OR LOWER(player2) = $%d)", len(args), len(args))
+	}
+	if variant != -1 {
+		args = append(args, variant)
+		query += fmt.Sprintf(" AND variant = $%d", len(args))
+	}
+	args = append(args, limit, offset)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := tx.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*historyEntry
+	var player1, player2 string
+	var winner int8
+	for rows.Next() {
+		e := &historyEntry{}
+		err = rows.Scan(&e.ID, &e.Variant, &e.Timestamp, &player1, &player2, &e.Points, &winner)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToLower(player1) == username {
+			e.Winner, e.Opponent = winner, player2
+		} else {
+			e.Winner, e.Opponent = 1+(2-winner), player1
+		}
+		entries = append(entries, e)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return entries, nil
+}
+
 func getLeaderboard(matchType int, variant int8, multiPoint bool) (*leaderboardResult, error) {
 	dbLock.Lock()
 	defer dbLock.Unlock()
@@ -1485,8 +2812,14 @@ func sendEmail(mailServer string, emailAddress string, emailSubject string, emai
 	mixedWriter := multipart.NewWriter(mixedContent)
 	var newBoundary = "RELATED-" + mixedWriter.Boundary()
 	mixedWriter.SetBoundary(first70("MIXED-" + mixedWriter.Boundary()))
-	relatedWriter, newBoundary := nestedMultipart(mixedWriter, "multipart/related", newBoundary)
-	altWriter, newBoundary := nestedMultipart(relatedWriter, "multipart/alternative", "ALTERNATIVE-"+newBoundary)
+	relatedWriter, newBoundary, err := nestedMultipart(mixedWriter, "multipart/related", newBoundary)
+	if err != nil {
+		return false
+	}
+	altWriter, newBoundary, err := nestedMultipart(relatedWriter, "multipart/alternative", "ALTERNATIVE-"+newBoundary)
+	if err != nil {
+		return false
+	}
 
 	var childContent io.Writer
 	childContent, _ = altWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain"}})
@@ -1536,16 +2869,15 @@ Content-Type: multipart/mixed; boundary=`)
 	return true
 }
 
-func nestedMultipart(enclosingWriter *multipart.Writer, contentType, boundary string) (nestedWriter *multipart.Writer, newBoundary string) {
+func nestedMultipart(enclosingWriter *multipart.Writer, contentType, boundary string) (nestedWriter *multipart.Writer, newBoundary string, err error) {
 
 	var contentBuffer io.Writer
-	var err error
 
 	boundary = first70(boundary)
 	contentWithBoundary := contentType + "; boundary=\"" + boundary + "\""
 	contentBuffer, err = enclosingWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {contentWithBoundary}})
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
 	}
 
 	nestedWriter = multipart.NewWriter(contentBuffer)
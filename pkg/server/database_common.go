@@ -1,17 +1,71 @@
 package server
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+)
 
 const (
 	matchTypeCasual = iota
 	matchTypeRated
 )
 
+const (
+	reportOpen = iota
+	reportClaimed
+	reportResolved
+)
+
+// reportStatusNames maps report statuses to names.
+var reportStatusNames = []string{"open", "claimed", "resolved"}
+
+// Accounts are deleted after a grace period, during which deletion may be cancelled.
+const accountDeletionGrace = 7 * 24 * time.Hour
+
+// deletedPlayerName replaces the name of deleted accounts in match history and
+// replays. It contains characters which are not allowed in usernames.
+const deletedPlayerName = "[deleted]"
+
+// redactEmail returns an email address with all but the first character of
+// the local part hidden, for use in logs and records of email address changes.
+func redactEmail(email []byte) string {
+	local, domain, ok := bytes.Cut(email, []byte("@"))
+	if !ok || len(local) == 0 {
+		return "***"
+	}
+	return string(local[:1]) + "***@" + string(domain)
+}
+
+const (
+	roleAdmin = 1 << iota
+	roleModerator
+	roleTournamentDirector
+)
+
+// roleNames maps role names to roles. Multiple names may refer to the same role.
+var roleNames = map[string]int{
+	"admin":     roleAdmin,
+	"mod":       roleModerator,
+	"moderator": roleModerator,
+	"td":        roleTournamentDirector,
+	"director":  roleTournamentDirector,
+}
+
 type account struct {
-	id       int
-	email    []byte
-	username []byte
-	password []byte
+	id        int
+	email     []byte
+	username  []byte
+	password  []byte
+	roles     int
+	confirmed int64 // Time the email address was confirmed.
+
+	totpSecret string
+	totp       int64 // Time two-factor authentication was enabled.
+
+	deletion int64 // Time the account is scheduled to be deleted.
 
 	follows []int
 
@@ -129,3 +183,64 @@ type achievementStatsResult struct {
 	Players      int
 	Achievements []*achievementStatsEntry
 }
+
+// historyEntry is a match in the history of a player. Winner is 1 when the
+// player won the match and 2 when the opponent won.
+type historyEntry struct {
+	ID        int
+	Variant   int8
+	Timestamp int64
+	Points    int8
+	Opponent  string
+	Winner    int8
+}
+
+type auditEntry struct {
+	ID        int
+	Timestamp int64
+	Staff     string
+	Action    string
+	Target    string
+	Reason    string
+}
+
+type playerReport struct {
+	ID         int
+	Timestamp  int64
+	Reporter   string
+	Target     string
+	Game       int
+	Reason     string
+	Replay     []byte
+	Chat       []byte
+	Status     int
+	Staff      string
+	Resolved   int64
+	Resolution string
+}
+
+// accountExport is the personal data stored about an account.
+type accountExport struct {
+	Username     string
+	Email        string
+	Created      int64
+	Confirmed    int64
+	Active       int64
+	Deletion     int64
+	Icon         int
+	Settings     map[string]int
+	Ratings      map[string]int
+	Follows      []string
+	Achievements []*bgammon.HistoryAchievement
+	Matches      []*bgammon.HistoryMatch
+}
+
+// lockedError is returned when logging in to an account which is temporarily
+// locked due to repeated failed login attempts.
+type lockedError struct {
+	until int64
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, please try again in %d minutes or reset your password", (e.until-time.Now().Unix())/60+1)
+}
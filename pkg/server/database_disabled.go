@@ -3,26 +3,70 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"codeberg.org/tslocum/bgammon"
 )
 
-func connectDB(dataSource string) error {
+// Storage is a database connection used to store accounts, matches and
+// statistics. Storage is only available when built with the 'full' tag.
+type Storage struct{}
+
+// OpenStorage connects to a PostgreSQL database.
+func OpenStorage(ctx context.Context, dataSource string) (*Storage, error) {
+	return nil, fmt.Errorf("bgammon-server was built without the 'full' tag. Database storage is not available.")
+}
+
+// Close closes the database connection.
+func (st *Storage) Close(ctx context.Context) error {
+	return nil
+}
+
+func useStorage(st *Storage) error {
 	return nil
 }
 
-func testDBConnection() error {
+func releaseStorage(st *Storage) {
+}
+
+func registerAccount(mailServer string, resetSalt string, passwordSalt string, a *account, ipHash string) error {
 	return nil
 }
 
-func initDB() {
+func setAccountTOTP(id int, secret string, enabled int64, recovery []string) error {
+	return nil
 }
 
-func registerAccount(passwordSalt string, a *account, ipHash string) error {
+func setAccountAPIToken(id int, hash string) error {
 	return nil
 }
 
+func accountIDByAPIToken(hash string) (int, error) {
+	return 0, nil
+}
+
+func useRecoveryCode(id int, hash string) (bool, int, error) {
+	return false, 0, nil
+}
+
+func resendConfirmation(mailServer string, resetSalt string, id int) error {
+	return nil
+}
+
+func confirmAccount(resetSalt string, id int, key string) (string, error) {
+	return "", nil
+}
+
+func requestEmailChange(mailServer string, resetSalt string, id int, email []byte) error {
+	return nil
+}
+
+func confirmEmailChange(resetSalt string, id int, key string) (string, []byte, []byte, error) {
+	return "", nil, nil, nil
+}
+
 func resetAccount(mailServer string, resetSalt string, email []byte) error {
 	return nil
 }
@@ -39,10 +83,18 @@ func accountByUsername(username string) (*account, error) {
 	return nil, nil
 }
 
-func loginAccount(passwordSalt string, username []byte, password []byte) (*account, error) {
+func loginAccount(mailServer string, passwordSalt string, username []byte, password []byte) (*account, error) {
 	return nil, nil
 }
 
+func failLogin(mailServer string, id int) (int64, error) {
+	return 0, nil
+}
+
+func clearLoginFailures(id int) error {
+	return nil
+}
+
 func setAccountPassword(passwordSalt string, id int, password string) error {
 	return nil
 }
@@ -59,6 +111,10 @@ func renameAccount(id int, oldUsername string, newUsername string) error {
 	return nil
 }
 
+func setAccountRole(id int, role int, grant bool) error {
+	return nil
+}
+
 func awardAchievement(a *account, award int, game int, date int64) (bool, error) {
 	return false, nil
 }
@@ -71,18 +127,70 @@ func replayByID(id int) ([]byte, error) {
 	return nil, nil
 }
 
-func addBan(ipHash string, account int, staff int, reason string) error {
+func addBan(ipHash string, account int, staff int, reason string, expires int64) error {
 	return nil
 }
 
-func checkBan(ipHash string, account int) (bool, string) {
-	return false, ""
+func checkBan(ipHashes []string, account int) (bool, string, int64) {
+	return false, "", 0
 }
 
 func deleteBan(ipHash string, account int) error {
 	return nil
 }
 
+func addMute(ipHash string, account int, staff int, reason string, expires int64) error {
+	return nil
+}
+
+func checkMute(ipHashes []string, account int) (bool, string, int64) {
+	return false, "", 0
+}
+
+func deleteMute(ipHash string, account int) error {
+	return nil
+}
+
+func scheduleAccountDeletion(id int, deletion int64) error {
+	return nil
+}
+
+func deleteExpiredAccounts() ([]int, error) {
+	return nil, nil
+}
+
+func exportAccount(id int) (*accountExport, error) {
+	return nil, nil
+}
+
+func deleteExpiredSanctions() error {
+	return nil
+}
+
+func addAudit(staff int, action string, target string, reason string) error {
+	return nil
+}
+
+func auditLog(filter string, offset int, limit int) ([]*auditEntry, error) {
+	return nil, nil
+}
+
+func addReport(r *playerReport, reporter int, account int) (int, error) {
+	return 0, nil
+}
+
+func playerReports(status int, offset int, limit int) ([]*playerReport, error) {
+	return nil, nil
+}
+
+func playerReportByID(id int) (*playerReport, error) {
+	return nil, nil
+}
+
+func updatePlayerReport(id int, staff int, status int, resolution string) (bool, error) {
+	return false, nil
+}
+
 func recordGameResult(g *serverGame, winType int8, replay [][]byte) (int, error) {
 	return 0, nil
 }
@@ -95,6 +203,10 @@ func matchHistory(username string) ([]*bgammon.HistoryMatch, error) {
 	return nil, nil
 }
 
+func searchMatchHistory(username string, opponent string, variant int8, offset int, limit int) ([]*historyEntry, error) {
+	return nil, nil
+}
+
 func getLeaderboard(matchType int, variant int8, multiPoint bool) (*leaderboardResult, error) {
 	return nil, nil
 }
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Abuse signal thresholds (per minute) which trigger automatic DEFCON escalation.
+const (
+	defconGuestWarning = 30 // Guest logins.
+	defconGuestLimit   = 60
+	defconChatWarning  = 60 // Chat messages.
+	defconChatLimit    = 120
+	defconBanHits      = 10 // Login attempts by banned users.
+	defconRegistration = 5  // Registrations from a single IP address.
+)
+
+// defconCooldown is the number of seconds without abuse signals after which
+// an automatically raised DEFCON level is lowered by one level.
+const defconCooldown = 900 // 15 minutes.
+
+// defconController raises the DEFCON level automatically in response to abuse
+// signals, and lowers it again after a cool-down period.
+type defconController struct {
+	guests  atomic.Int64
+	chat    atomic.Int64
+	banHits atomic.Int64
+
+	registrations     map[string]int
+	registrationsLock sync.Mutex
+
+	escalated   atomic.Bool // DEFCON level was raised automatically.
+	lastTrigger int64
+}
+
+func newDefconController() *defconController {
+	return &defconController{
+		registrations: make(map[string]int),
+	}
+}
+
+func (d *defconController) addGuest() {
+	if d == nil {
+		return
+	}
+	d.guests.Add(1)
+}
+
+func (d *defconController) addChat() {
+	if d == nil {
+		return
+	}
+	d.chat.Add(1)
+}
+
+func (d *defconController) addBanHit() {
+	if d == nil {
+		return
+	}
+	d.banHits.Add(1)
+}
+
+func (d *defconController) addRegistration(ipHash string) {
+	if d == nil {
+		return
+	}
+	d.registrationsLock.Lock()
+	d.registrations[ipHash]++
+	d.registrationsLock.Unlock()
+}
+
+// manual is called when staff set the DEFCON level. The level is no longer
+// lowered automatically.
+func (d *defconController) manual() {
+	if d == nil {
+		return
+	}
+	d.escalated.Store(false)
+}
+
+// level returns the DEFCON level warranted by the abuse signals received since
+// the last call, and the reason for the level.
+func (d *defconController) level() (int, string) {
+	guests, chat, banHits := d.guests.Swap(0), d.chat.Swap(0), d.banHits.Swap(0)
+
+	var registrations int
+	d.registrationsLock.Lock()
+	for _, count := range d.registrations {
+		registrations = max(registrations, count)
+	}
+	clear(d.registrations)
+	d.registrationsLock.Unlock()
+
+	switch {
+	case registrations >= defconRegistration:
+		return 1, fmt.Sprintf("%d registrations from a single IP address", registrations)
+	case guests >= defconGuestLimit:
+		return 2, fmt.Sprintf("%d guest logins", guests)
+	case banHits >= defconBanHits:
+		return 2, fmt.Sprintf("%d login attempts by banned users", banHits)
+	case guests >= defconGuestWarning:
+		return 3, fmt.Sprintf("%d guest logins", guests)
+	case chat >= defconChatLimit:
+		return 3, fmt.Sprintf("%d chat messages", chat)
+	case chat >= defconChatWarning:
+		return 4, fmt.Sprintf("%d chat messages", chat)
+	default:
+		return 5, ""
+	}
+}
+
+func (s *Server) handleDefcon() {
+	d := s.autoDefcon
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		now := time.Now().Unix()
+		level, reason := d.level()
+		current := s.defconLevel()
+		if level < current {
+			d.escalated.Store(true)
+			d.lastTrigger = now
+			s.setDefcon(level, "automatic escalation: "+reason+" in the last minute")
+			continue
+		} else if level < 5 && level <= current+1 {
+			// Abuse is ongoing. Delay the cool-down.
+			d.lastTrigger = now
+			continue
+		}
+
+		if !d.escalated.Load() || now-d.lastTrigger < defconCooldown {
+			continue
+		}
+		d.lastTrigger = now
+		s.setDefcon(current+1, "automatic cool-down")
+		if current+1 == 5 {
+			d.escalated.Store(false)
+		}
+	}
+}
+
+// defconLevel returns the current DEFCON level.
+func (s *Server) defconLevel() int {
+	return int(s.defcon.Load())
+}
+
+// setDefcon sets the DEFCON level without a staff member and warns all users.
+func (s *Server) setDefcon(level int, reason string) {
+	s.defcon.Store(int32(level))
+	s.logger.Printf("DEFCON level set to %d: %s", level, reason)
+	err := addAudit(0, "defcon", strconv.Itoa(level), reason)
+	if err != nil {
+		s.logger.Printf("failed to record audit entry: %s", err)
+	}
+
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		sc.sendDefconWarning(level)
+	}
+	s.clientsLock.Unlock()
+}
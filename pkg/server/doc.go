@@ -0,0 +1,50 @@
+/*
+Package server provides the bgammon.org server. It may be embedded in other
+applications:
+
+	s, err := server.New(&server.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = s.Start(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = s.Listen("tcp", "localhost:1337")
+	if err != nil {
+		log.Fatal(err)
+	}
+	...
+	err = s.Stop(ctx)
+
+Remote connections are only accepted when built with the 'full' tag. Local
+connections are available via ListenLocal.
+
+When running behind a reverse proxy, the addresses of the proxy should be
+listed in Options.TrustedProxies. Client addresses, which are used when
+enforcing bans and connection limits, are then read from the Forwarded or
+X-Forwarded-For headers of requests received from the proxy. Connections to TCP
+listeners from trusted proxies begin with a PROXY protocol header when
+Options.ProxyProtocol is set.
+
+Match and account events are published to subscribers:
+
+	sub := s.Subscribe(server.EventMatchCreated, server.EventMatchEnded)
+	for ev := range sub.C {
+		...
+	}
+
+Events may also be delivered to webhooks. Each event is sent as a JSON encoded
+POST request, which is signed when Options.WebhookSecret is set. The
+X-Bgammon-Signature header contains the hex encoded HMAC-SHA256 of the Unix
+timestamp sent in the X-Bgammon-Timestamp header, a period and the request body,
+in the form sha256=SIGNATURE. See SignWebhook. Receivers should reject requests
+with old timestamps to prevent signed requests from being replayed. Requests
+which fail are retried several times. Receivers may use the event ID to ignore
+duplicate deliveries. Event IDs are not reused when the server restarts.
+
+Metrics are served in the Prometheus text exposition format by MetricsHandler.
+Database query durations are only recorded for connections configured with
+QueryTracer.
+*/
+package server
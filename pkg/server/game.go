@@ -58,11 +58,36 @@ type serverGame struct {
 	rejoin1    bool
 	rejoin2    bool
 	replay     [][]byte
+	chat       [][]byte
 	pending1   []int
 	pending2   []int
+
+	requireConfirmed bool // Only rate the match when both accounts have confirmed their email address.
+	converted1       bool // Player 1 registered an account after the match started as a guest.
+	converted2       bool // Player 2 registered an account after the match started as a guest.
+
+	server *Server // Server hosting the match, used to call hooks and publish events.
+
 	*bgammon.Game
 }
 
+// confirmationRequired returns the IDs of the accounts which must have confirmed
+// their email address for the match to be rated. Accounts registered by guests
+// during the match are exempt, as the match started before they existed.
+func (g *serverGame) confirmationRequired() []int {
+	if !g.requireConfirmed {
+		return nil
+	}
+	var ids []int
+	if g.account1 != 0 && !g.converted1 {
+		ids = append(ids, g.account1)
+	}
+	if g.account2 != 0 && !g.converted2 {
+		ids = append(ids, g.account2)
+	}
+	return ids
+}
+
 func newServerGame(id int, variant int8) *serverGame {
 	now := time.Now().Unix()
 	return &serverGame{
@@ -156,6 +181,7 @@ func (g *serverGame) playForcedMoves() bool {
 			ev.Player = playerName
 			client.sendEvent(ev)
 		})
+		g.server.notifyMove(g, playerName, [][]int8{{move[0], move[1]}})
 		if g.handleWin() {
 			return true
 		}
@@ -175,11 +201,13 @@ func (g *serverGame) roll(player int8) bool {
 				return false
 			}
 			g.Roll1 = int8(RandInt(6) + 1)
+			g.server.notifyRoll(g, g.Player1.Name, []int8{g.Roll1})
 		} else {
 			if g.Roll2 != 0 {
 				return false
 			}
 			g.Roll2 = int8(RandInt(6) + 1)
+			g.server.notifyRoll(g, g.Player2.Name, []int8{g.Roll2})
 		}
 
 		// Only allow the same players to rejoin the game.
@@ -204,10 +232,17 @@ func (g *serverGame) roll(player int8) bool {
 
 	g.Roll1 = int8(RandInt(6) + 1)
 	g.Roll2 = int8(RandInt(6) + 1)
+	roll := []int8{g.Roll1, g.Roll2}
 	if g.Variant == bgammon.VariantTabula {
 		g.Roll3 = int8(RandInt(6) + 1)
+		roll = append(roll, g.Roll3)
 	}
 
+	playerName := g.Player1.Name
+	if player == 2 {
+		playerName = g.Player2.Name
+	}
+	g.server.notifyRoll(g, playerName, roll)
 	return true
 }
 
@@ -386,6 +421,8 @@ func (g *serverGame) addClient(client *serverClient) (spectator bool) {
 		if g.forefeit == playerNumber {
 			g.forefeit = 0
 		}
+
+		g.server.notifyPlayerJoined(g, client.name)
 	}()
 	var rating int
 	var icon int
@@ -472,6 +509,8 @@ func (g *serverGame) removeClient(client *serverClient) {
 		}
 
 		client.playerNumber = 0
+
+		g.server.notifyPlayerLeft(g, client.name)
 	}()
 	switch {
 	case g.client1 == client:
@@ -663,8 +702,27 @@ func (g *serverGame) nextTurn(reroll bool) {
 	})
 }
 
+func (g *serverGame) replayHeader() []byte {
+	return []byte(fmt.Sprintf("i %d %s %s %d %d %d %d %d %d", g.Started, g.allowed1, g.allowed2, g.Points, g.Player1.Points, g.Player2.Points, g.Winner, g.DoubleValue, g.Variant))
+}
+
 func (g *serverGame) addReplayHeader() {
-	g.replay = append([][]byte{[]byte(fmt.Sprintf("i %d %s %s %d %d %d %d %d %d", g.Started, g.allowed1, g.allowed2, g.Points, g.Player1.Points, g.Player2.Points, g.Winner, g.DoubleValue, g.Variant))}, g.replay...)
+	g.replay = append([][]byte{g.replayHeader()}, g.replay...)
+}
+
+// replaySnapshot returns the replay of the game in progress.
+func (g *serverGame) replaySnapshot() []byte {
+	lines := append([][]byte{g.replayHeader()}, g.replay...)
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// addChat records a chat message. Only the most recent messages are kept.
+func (g *serverGame) addChat(name []byte, message []byte) {
+	line := append(append(append([]byte{}, name...), ':', ' '), message...)
+	if len(g.chat) == maxChatHistory {
+		g.chat = append(g.chat[:0], g.chat[1:]...)
+	}
+	g.chat = append(g.chat, line)
 }
 
 // winPoints returns the number of points a game is worth when a player has won
@@ -778,8 +836,9 @@ func (g *serverGame) handleWin() bool {
 	}
 	gameID, err := recordGameResult(g, winType, g.replay)
 	if err != nil {
-		log.Fatalf("failed to record game result: %s", err)
+		log.Printf("failed to record game result: %s", err)
 	}
+	g.server.notifyGameWon(g, winEvent.Player, mul8(winPoints, g.DoubleValue))
 
 	// Award achievements.
 	if g.Variant == bgammon.VariantBackgammon {
@@ -797,13 +856,15 @@ func (g *serverGame) handleWin() bool {
 			for _, award := range pending {
 				awarded, err := awardAchievement(c.account, award, gameID, g.Ended)
 				if err != nil {
-					log.Fatal(err)
+					log.Printf("failed to award achievement: %s", err)
+					continue
 				} else if !awarded {
 					continue
 				}
 				info := Achievements[award]
 				message := fmt.Sprintf("%s (%s)", gotext.GetD(c.language, info[0]), gotext.GetD(c.language, info[1]))
 				c.sendNotice(gotext.GetD(c.language, "Achievement unlocked: %s", message))
+				g.server.notifyAchievementUnlocked(g, c.name, award)
 			}
 
 			var achievements []int
@@ -819,11 +880,12 @@ func (g *serverGame) handleWin() bool {
 				award := achievements[winPoints-1]
 				awarded, err := awardAchievement(c.account, award, gameID, g.Ended)
 				if err != nil {
-					log.Fatal(err)
+					log.Printf("failed to award achievement: %s", err)
 				} else if awarded {
 					info := Achievements[award]
 					message := fmt.Sprintf("%s (%s)", gotext.GetD(c.language, info[0]), gotext.GetD(c.language, info[1]))
 					c.sendNotice(gotext.GetD(c.language, "Achievement unlocked: %s", message))
+					g.server.notifyAchievementUnlocked(g, c.name, award)
 				}
 			}
 		}
@@ -837,8 +899,9 @@ func (g *serverGame) handleWin() bool {
 		// Record match.
 		winEvent.Rating, err = recordMatchResult(g, matchTypeCasual)
 		if err != nil {
-			log.Fatalf("failed to record match result: %s", err)
+			log.Printf("failed to record match result: %s", err)
 		}
+		g.server.notifyMatchEnded(g)
 	}
 
 	// Refresh cached ratings.
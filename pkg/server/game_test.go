@@ -42,3 +42,24 @@ func TestServerGameWinPoints(t *testing.T) {
 		}
 	}
 }
+
+func TestServerGameConfirmationRequired(t *testing.T) {
+	t.Parallel()
+
+	g := newServerGame(1, bgammon.VariantBackgammon)
+	g.account1, g.account2 = 1, 2
+	if ids := g.confirmationRequired(); len(ids) != 0 {
+		t.Errorf("unexpected accounts when confirmation is not required: %v", ids)
+	}
+
+	g.requireConfirmed = true
+	if ids := g.confirmationRequired(); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("unexpected accounts: expected [1 2], got %v", ids)
+	}
+
+	// Player 2 registered an account after the match started as a guest.
+	g.converted2 = true
+	if ids := g.confirmationRequired(); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("unexpected accounts after conversion: expected [1], got %v", ids)
+	}
+}
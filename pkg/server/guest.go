@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+
+	"codeberg.org/tslocum/bgammon"
+	"codeberg.org/tslocum/gotext"
+)
+
+// handleRegisterGuest registers an account for a client which is logged in as
+// a guest. This method runs in a separate goroutine to allow gameplay to
+// continue while hashing the password. The client is upgraded to the account
+// by the command handler once registration succeeds. It returns whether the
+// account was registered.
+func (s *Server) handleRegisterGuest(cmd serverCommand, params [][]byte) bool {
+	if s.defconLevel() == 1 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Due to ongoing abuse, registration is disabled. Please try again later."))
+		return false
+	} else if len(params) < 3 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Please enter an email, username and password."))
+		return false
+	}
+
+	email := bytes.ToLower(params[0])
+	username := bytes.ToLower(params[1])
+	password := accountPassword(params[2:])
+	if onlyNumbers.Match(username) {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to register: Invalid username: must contain at least one non-numeric character."))
+		return false
+	} else if len(string(username)) > maxUsernameLength {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Failed to register: %s", gotext.GetD(cmd.client.language, "Invalid username: must be %d characters or less.")), maxUsernameLength))
+		return false
+	}
+
+	s.clientsLock.Lock()
+	existing := s.clientByUsername(username)
+	s.clientsLock.Unlock()
+	if existing != nil {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Failed to register: %s"), "username already in use"))
+		return false
+	}
+
+	a := &account{
+		email:    email,
+		username: username,
+		password: password,
+	}
+	err := registerAccount(s.mailServer, s.resetSalt, s.passwordSalt, a, cmd.client.Address())
+	if err != nil {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Failed to register: %s"), err))
+		return false
+	}
+	s.autoDefcon.addRegistration(cmd.client.Address())
+	s.notifyAccountRegistered(username)
+
+	a, err = loginAccount(s.mailServer, s.passwordSalt, username, password)
+	if err != nil || a == nil {
+		s.logger.Printf("failed to log in to registered account %s: %s", username, err)
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Your account was registered, but logging in failed. Please reconnect and log in."))
+		return true
+	}
+
+	s.queueCommand(serverCommand{
+		client:    cmd.client,
+		requestID: cmd.requestID,
+		account:   a,
+	})
+	return true
+}
+
+// upgradeGuest logs a guest in to the account they registered. The match in
+// progress continues and is recorded as played by the account.
+func (s *Server) upgradeGuest(cmd serverCommand) {
+	c, a := cmd.client, cmd.account
+	if c.accountID != 0 {
+		return
+	}
+
+	s.clientsLock.Lock()
+	oldName := c.name
+	c.account = a
+	c.accountID = a.id
+	c.name = a.username
+	c.autoplay = a.autoplay
+	s.clientsLock.Unlock()
+	c.registering.Store(false)
+
+	s.logger.Printf("Client %d registered %s as %s", c.id, oldName, c.name)
+
+	cmd.sendEvent(&bgammon.EventWelcome{
+		PlayerName:   string(c.name),
+		Clients:      len(s.clients),
+		Games:        len(s.games),
+		Protocol:     c.protocol,
+		Capabilities: c.capabilities,
+	})
+	c.sendSettings()
+
+	msg := gotext.GetD(c.language, "Please confirm your email address by clicking the link which was sent to you via email.")
+	if !s.allowUnconfirmedRated {
+		msg += " " + gotext.GetD(c.language, "Your matches will not be rated until your email address is confirmed.")
+	}
+	cmd.sendNotice(msg)
+
+	g := s.gameByClient(c)
+	if g == nil {
+		return
+	}
+	rating := a.casual.getRating(g.Variant, g.Points > 1) / 100
+	switch c {
+	case g.client1:
+		g.Player1.Name, g.Player1.Rating, g.Player1.Icon = string(c.name), rating, a.icon
+		if bytes.Equal(g.allowed1, oldName) {
+			g.allowed1 = c.name
+		}
+		if g.Started != 0 {
+			g.account1, g.converted1 = a.id, true
+		}
+	case g.client2:
+		g.Player2.Name, g.Player2.Rating, g.Player2.Icon = string(c.name), rating, a.icon
+		if bytes.Equal(g.allowed2, oldName) {
+			g.allowed2 = c.name
+		}
+		if g.Started != 0 {
+			g.account2, g.converted2 = a.id, true
+		}
+	}
+	g.eachClient(func(client *serverClient) {
+		if client != c {
+			client.sendNotice(fmt.Sprintf(gotext.GetD(client.language, "%s registered an account as %s."), oldName, c.name))
+		}
+		g.sendBoard(client, false)
+	})
+}
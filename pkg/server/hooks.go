@@ -0,0 +1,132 @@
+package server
+
+// Match describes a match when calling hooks and publishing events.
+type Match struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Variant int8   `json:"variant"`
+	Points  int8   `json:"points"` // Points required to win the match.
+	Private bool   `json:"private"`
+	Player1 string `json:"player1"`
+	Player2 string `json:"player2"`
+	Score1  int8   `json:"score1"` // Points scored by player 1.
+	Score2  int8   `json:"score2"` // Points scored by player 2.
+	Winner  int8   `json:"winner"` // Player number of the winner, or 0 while the game is in progress.
+}
+
+// Hooks are functions called when match events occur. Hooks may be called from
+// multiple goroutines and must not block. Any hook may be nil.
+type Hooks struct {
+	MatchCreated func(m *Match)
+	PlayerJoined func(m *Match, player string)
+	PlayerLeft   func(m *Match, player string)
+	MatchEnded   func(m *Match)
+}
+
+func (g *serverGame) match() *Match {
+	return &Match{
+		ID:      g.id,
+		Name:    string(g.name),
+		Variant: g.Variant,
+		Points:  g.Points,
+		Private: len(g.password) != 0,
+		Player1: g.Player1.Name,
+		Player2: g.Player2.Name,
+		Score1:  g.Player1.Points,
+		Score2:  g.Player2.Points,
+		Winner:  g.Winner,
+	}
+}
+
+// The following methods call hooks and publish events. They may be called on
+// a nil server, as matches created in tests are not associated with a server.
+
+func (s *Server) notifyMatchCreated(g *serverGame) {
+	if s == nil {
+		return
+	}
+	m := g.match()
+	if s.hooks.MatchCreated != nil {
+		s.hooks.MatchCreated(m)
+	}
+	s.publish(&Event{Type: EventMatchCreated, Match: m})
+}
+
+func (s *Server) notifyPlayerJoined(g *serverGame, player []byte) {
+	if s == nil {
+		return
+	}
+	m := g.match()
+	if s.hooks.PlayerJoined != nil {
+		s.hooks.PlayerJoined(m, string(player))
+	}
+	s.publish(&Event{Type: EventPlayerJoined, Match: m, Player: string(player)})
+}
+
+func (s *Server) notifyPlayerLeft(g *serverGame, player []byte) {
+	if s == nil {
+		return
+	}
+	m := g.match()
+	if s.hooks.PlayerLeft != nil {
+		s.hooks.PlayerLeft(m, string(player))
+	}
+	s.publish(&Event{Type: EventPlayerLeft, Match: m, Player: string(player)})
+}
+
+func (s *Server) notifyRoll(g *serverGame, player string, roll []int8) {
+	if s == nil {
+		return
+	}
+	s.publish(&Event{Type: EventRoll, Match: g.match(), Player: player, Roll: roll})
+}
+
+func (s *Server) notifyMove(g *serverGame, player string, moves [][]int8) {
+	if s == nil {
+		return
+	}
+	copied := make([][]int8, len(moves))
+	for i, move := range moves {
+		copied[i] = []int8{move[0], move[1]}
+	}
+	s.publish(&Event{Type: EventMove, Match: g.match(), Player: player, Moves: copied})
+}
+
+func (s *Server) notifyDouble(g *serverGame, player []byte, value int8, accepted bool) {
+	if s == nil {
+		return
+	}
+	s.publish(&Event{Type: EventDouble, Match: g.match(), Player: string(player), Points: value, Accepted: accepted})
+}
+
+func (s *Server) notifyGameWon(g *serverGame, player string, points int8) {
+	if s == nil {
+		return
+	}
+	s.publish(&Event{Type: EventGameWon, Match: g.match(), Player: player, Points: points})
+}
+
+func (s *Server) notifyMatchEnded(g *serverGame) {
+	if s == nil {
+		return
+	}
+	m := g.match()
+	if s.hooks.MatchEnded != nil {
+		s.hooks.MatchEnded(m)
+	}
+	s.publish(&Event{Type: EventMatchEnded, Match: m})
+}
+
+func (s *Server) notifyAchievementUnlocked(g *serverGame, player []byte, achievement int) {
+	if s == nil {
+		return
+	}
+	s.publish(&Event{Type: EventAchievementUnlocked, Match: g.match(), Player: string(player), Achievement: achievement})
+}
+
+func (s *Server) notifyAccountRegistered(username []byte) {
+	if s == nil {
+		return
+	}
+	s.publish(&Event{Type: EventAccountRegistered, Player: string(username)})
+}
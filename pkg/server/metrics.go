@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+)
+
+// Client transports.
+const (
+	transportTCP       = "tcp"
+	transportTLS       = "tls"
+	transportWebSocket = "websocket"
+	transportLocal     = "local"
+)
+
+// metricBuckets are the upper bounds (in seconds) of the histogram buckets
+// used to record durations.
+var metricBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// queryDurations records the duration of database queries by operation. The
+// database connection is shared by all servers, so query durations are too.
+var queryDurations = newHistogramVec()
+
+type histogram struct {
+	buckets []uint64 // Number of observations less than or equal to each bucket.
+	count   uint64
+	sum     float64
+}
+
+// histogramVec is a set of histograms which are identified by a label value.
+type histogramVec struct {
+	values map[string]*histogram
+	sync.Mutex
+}
+
+func newHistogramVec() *histogramVec {
+	return &histogramVec{
+		values: make(map[string]*histogram),
+	}
+}
+
+func (v *histogramVec) observe(label string, d time.Duration) {
+	v.Lock()
+	defer v.Unlock()
+
+	h := v.values[label]
+	if h == nil {
+		h = &histogram{
+			buckets: make([]uint64, len(metricBuckets)),
+		}
+		v.values[label] = h
+	}
+	seconds := d.Seconds()
+	for i, bucket := range metricBuckets {
+		if seconds <= bucket {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (v *histogramVec) write(w io.Writer, name string, help string, labelName string) {
+	v.Lock()
+	defer v.Unlock()
+
+	writeMetricHeader(w, name, help, "histogram")
+	for _, label := range sortedKeys(v.values) {
+		h := v.values[label]
+		for i, bucket := range metricBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, labelName, label, strconv.FormatFloat(bucket, 'f', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, labelName, label, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", name, labelName, label, strconv.FormatFloat(h.sum, 'f', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, labelName, label, h.count)
+	}
+}
+
+// counterVec is a set of counters which are identified by a label value.
+type counterVec struct {
+	values map[string]uint64
+	sync.Mutex
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{
+		values: make(map[string]uint64),
+	}
+}
+
+func (v *counterVec) inc(label string) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.values[label]++
+}
+
+func (v *counterVec) write(w io.Writer, name string, help string, labelName string) {
+	v.Lock()
+	defer v.Unlock()
+
+	writeMetricHeader(w, name, help, "counter")
+	for _, label := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, labelName, label, v.values[label])
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeGauge(w io.Writer, name string, help string, labelName string, values map[string]int) {
+	writeMetricHeader(w, name, help, "gauge")
+	for _, label := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, labelName, label, values[label])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serverMetrics holds the metrics recorded by a server. Metrics which may be
+// calculated from the state of the server are calculated when requested.
+type serverMetrics struct {
+	commands     *histogramVec // Duration of commands by name.
+	staffActions *counterVec   // Staff actions by name.
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		commands:     newHistogramVec(),
+		staffActions: newCounterVec(),
+	}
+}
+
+// MetricsHandler returns a handler which serves server metrics in the
+// Prometheus text exposition format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := &bytes.Buffer{}
+		s.writeMetrics(buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	clients := map[string]int{
+		transportTCP:       0,
+		transportTLS:       0,
+		transportWebSocket: 0,
+		transportLocal:     0,
+	}
+	var queued, maxQueued int
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		clients[sc.transport]++
+		depth := len(sc.events)
+		queued += depth
+		if depth > maxQueued {
+			maxQueued = depth
+		}
+	}
+	s.clientsLock.Unlock()
+
+	matches := map[string]int{
+		"backgammon": 0,
+		"acey":       0,
+		"tabula":     0,
+	}
+	s.gamesLock.RLock()
+	for _, g := range s.games {
+		if g.terminated() {
+			continue
+		}
+		switch g.Variant {
+		case bgammon.VariantBackgammon:
+			matches["backgammon"]++
+		case bgammon.VariantAceyDeucey:
+			matches["acey"]++
+		case bgammon.VariantTabula:
+			matches["tabula"]++
+		}
+	}
+	s.gamesLock.RUnlock()
+
+	writeGauge(w, "bgammon_clients", "Connected clients by transport.", "transport", clients)
+	writeGauge(w, "bgammon_matches", "Active matches by variant.", "variant", matches)
+	writeMetricHeader(w, "bgammon_event_queue_depth", "Events waiting to be written to clients.", "gauge")
+	fmt.Fprintf(w, "bgammon_event_queue_depth %d\n", queued)
+	writeMetricHeader(w, "bgammon_event_queue_max_depth", "Most events waiting to be written to a single client.", "gauge")
+	fmt.Fprintf(w, "bgammon_event_queue_max_depth %d\n", maxQueued)
+	s.metrics.commands.write(w, "bgammon_command_duration_seconds", "Duration of commands handled by the server.", "command")
+	queryDurations.write(w, "bgammon_db_query_duration_seconds", "Duration of database queries by operation.", "operation")
+	writeMetricHeader(w, "bgammon_login_failures_total", "Failed login attempts.", "counter")
+	fmt.Fprintf(w, "bgammon_login_failures_total %d\n", s.logins.total())
+	s.metrics.staffActions.write(w, "bgammon_staff_actions_total", "Staff actions, such as bans and kicks, by action.", "action")
+	writeMetricHeader(w, "bgammon_defcon", "Current DEFCON level.", "gauge")
+	fmt.Fprintf(w, "bgammon_defcon %d\n", s.defconLevel())
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+
+	"codeberg.org/tslocum/bgammon"
+)
+
+// variantCapabilities maps variants to the capability required to play them.
+var variantCapabilities = map[int8]string{
+	bgammon.VariantAceyDeucey: bgammon.CapabilityAcey,
+	bgammon.VariantTabula:     bgammon.CapabilityTabula,
+}
+
+// parseClientInfo parses the client field of the loginjson and registerjson
+// commands, which may also be provided as the first argument of the login and
+// register commands. It is specified as follows: name/language/protocol/capabilities
+//
+// The protocol version and comma-separated capabilities are optional. A
+// protocol version of 0 is returned when none is announced.
+func parseClientInfo(info []byte) (name []byte, language []byte, protocol int, capabilities []string) {
+	split := bytes.SplitN(info, []byte("/"), 4)
+	name = split[0]
+	if len(split) > 1 {
+		language = split[1]
+	}
+	if len(split) > 2 {
+		v, err := strconv.Atoi(string(split[2]))
+		if err == nil && v > 0 {
+			protocol = v
+		}
+	}
+	if len(split) > 3 {
+		for _, capability := range bytes.Split(bytes.ToLower(split[3]), []byte(",")) {
+			capability = bytes.TrimSpace(capability)
+			if len(capability) != 0 && !slices.Contains(capabilities, string(capability)) {
+				capabilities = append(capabilities, string(capability))
+			}
+		}
+	}
+	return name, language, protocol, capabilities
+}
+
+// textClientInfo returns whether the first argument of the login and register
+// commands (not JSON variants) is the client field described by
+// parseClientInfo. The client field contains a slash, which usernames may not
+// contain, and does not contain an at sign, which email addresses contain.
+func textClientInfo(arg []byte) bool {
+	return bytes.ContainsRune(arg, '/') && !bytes.ContainsRune(arg, '@')
+}
+
+// negotiateProtocol sets the protocol version and capabilities of a client. It
+// returns false when the client is too old to connect.
+func (s *Server) negotiateProtocol(c *serverClient, info []byte) bool {
+	var protocol int
+	var capabilities []string
+	if len(info) != 0 {
+		_, _, protocol, capabilities = parseClientInfo(info)
+	}
+	if protocol == 0 {
+		protocol, capabilities = 1, bgammon.LegacyCapabilities
+	}
+	c.protocol = min(protocol, bgammon.ProtocolVersion)
+	c.capabilities = capabilities
+	return c.protocol >= s.minProtocolVersion
+}
+
+// supports returns whether the client announced the specified capability.
+func (c *serverClient) supports(capability string) bool {
+	return slices.Contains(c.capabilities, capability)
+}
+
+// supportsVariant returns whether the client is able to play the specified variant.
+func (c *serverClient) supportsVariant(variant int8) bool {
+	capability := variantCapabilities[variant]
+	return capability == "" || c.supports(capability)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature begins each PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Length is the maximum length of a PROXY protocol version 1 header.
+const maxProxyV1Length = 107
+
+// parseTrustedProxies parses a list of IP addresses and networks in CIDR
+// notation.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		} else if strings.IndexByte(proxy, '/') != -1 {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse trusted proxy %s: %s", proxy, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted proxy %s: %s", proxy, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trustedProxy returns whether an address belongs to a trusted proxy.
+func (s *Server) trustedProxy(address string) bool {
+	addr, err := netip.ParseAddr(stripPort(address))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAddress returns the address of the client which sent a request. When
+// the request was received from a trusted proxy, the address is determined
+// using the Forwarded header, or the X-Forwarded-For header when the Forwarded
+// header is not present.
+func (s *Server) requestAddress(r *http.Request) string {
+	if !s.trustedProxy(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	var addresses []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) != 0 {
+		addresses = parseForwarded(forwarded)
+	} else {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, address := range strings.Split(header, ",") {
+				addresses = append(addresses, strings.TrimSpace(address))
+			}
+		}
+	}
+
+	// Each proxy appends the address it received the request from, so the
+	// client is the last address which does not belong to a trusted proxy.
+	address := r.RemoteAddr
+	for i := len(addresses) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(stripPort(addresses[i])); err != nil {
+			break
+		}
+		address = addresses[i]
+		if !s.trustedProxy(address) {
+			break
+		}
+	}
+	return address
+}
+
+// parseForwarded returns the client addresses listed in Forwarded headers.
+// Obfuscated and unknown addresses are included as they appear.
+func parseForwarded(headers []string) []string {
+	var addresses []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				addresses = append(addresses, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return addresses
+}
+
+// proxyConn is a connection received from a proxy which sent a PROXY protocol
+// header. The remote address is the address of the client.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol (version 1 or 2) header and returns
+// a connection which reports the address of the client as its remote address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(clientTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %s", err)
+	}
+	var remoteAddr net.Addr
+	if bytes.Equal(signature, proxyV2Signature) {
+		remoteAddr, err = readProxyV2Header(r)
+	} else {
+		remoteAddr, err = readProxyV1Header(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %s", err)
+	} else if remoteAddr == nil {
+		remoteAddr = conn.RemoteAddr()
+	}
+	return &proxyConn{
+		Conn:       conn,
+		r:          r,
+		remoteAddr: remoteAddr,
+	}, nil
+}
+
+// readProxyV1Header reads a PROXY protocol version 1 header. A nil address is
+// returned when the proxy did not provide the address of the client.
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		} else if len(line) == maxProxyV1Length {
+			return nil, fmt.Errorf("header too long")
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid header")
+	} else if fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid header")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address: %s", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port: %s", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2Header reads a PROXY protocol version 2 header. A nil address is
+// returned when the proxy did not provide the address of the client.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xF {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0xF)
+	}
+
+	var addrLen int
+	switch family >> 4 {
+	case 1: // AF_INET
+		addrLen = 4
+	case 2: // AF_INET6
+		addrLen = 16
+	default:
+		return nil, nil
+	}
+	if len(payload) < addrLen*2+4 {
+		return nil, fmt.Errorf("invalid address length")
+	}
+	addr, _ := netip.AddrFromSlice(payload[:addrLen])
+	port := binary.BigEndian.Uint16(payload[addrLen*2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), port)), nil
+}
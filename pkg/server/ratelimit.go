@@ -0,0 +1,241 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Command classes which are rate limited independently.
+const (
+	limitDefault = iota
+	limitChat
+	limitMatch
+	limitMove
+	limitClasses
+)
+
+// commandLimits lists the rate (commands per second) and burst of each command class.
+var commandLimits = [limitClasses][2]float64{
+	limitDefault: {5, 20},
+	limitChat:    {1, 5},
+	limitMatch:   {0.5, 5},
+	limitMove:    {5, 20},
+}
+
+// Connections per second and burst allowed from a single IP address.
+const (
+	connectionRate  = 0.2
+	connectionBurst = 10
+)
+
+// Clients which exceed a rate limit are warned. Clients are disconnected after
+// exceeding a rate limit too many times without a cool-down period.
+const (
+	maxLimitWarnings = 5
+	limitCooldown    = 60 // 1 minute.
+)
+
+// Failed login attempts after which an account or IP address is temporarily
+// locked. Each further failed attempt doubles the lockout duration.
+const (
+	accountLockFailures = 5
+	ipLockFailures      = 10
+	maxLockout          = 24 * time.Hour
+)
+
+// loginLockout returns the time until which logins are locked after the
+// specified number of failed attempts, or 0 when logins are not locked.
+func loginLockout(failures int, threshold int) int64 {
+	if failures < threshold {
+		return 0
+	}
+	lockout := maxLockout
+	if failures-threshold < 11 {
+		lockout = min(maxLockout, time.Minute<<(failures-threshold))
+	}
+	return time.Now().Add(lockout).Unix()
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	tokens float64
+	rate   float64 // Tokens added per second.
+	burst  float64 // Maximum number of tokens.
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{
+		tokens: burst,
+		rate:   rate,
+		burst:  burst,
+		last:   time.Now(),
+	}
+}
+
+// allow returns whether a token is available, consuming it if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// full returns whether the bucket has refilled completely.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// clientLimiter rate limits the commands sent by a client.
+type clientLimiter struct {
+	buckets       [limitClasses]*tokenBucket
+	warnings      int
+	lastViolation int64
+}
+
+func newClientLimiter() *clientLimiter {
+	l := &clientLimiter{}
+	for i, limit := range commandLimits {
+		l.buckets[i] = newTokenBucket(limit[0], limit[1])
+	}
+	return l
+}
+
+// allow returns whether the command may be processed, and the number of
+// warnings the client has received when it may not.
+func (l *clientLimiter) allow(class int) (bool, int) {
+	now := time.Now()
+	if l.buckets[class].allow(now) {
+		return true, 0
+	}
+	if now.Unix()-l.lastViolation >= limitCooldown {
+		l.warnings = 0
+	}
+	l.lastViolation = now.Unix()
+	l.warnings++
+	return false, l.warnings
+}
+
+// connectionLimiter rate limits new connections by hashed IP address.
+type connectionLimiter struct {
+	buckets map[string]*tokenBucket
+	sync.Mutex
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *connectionLimiter) allow(address string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.buckets[address]
+	if b == nil {
+		b = newTokenBucket(connectionRate, connectionBurst)
+		l.buckets[address] = b
+	}
+	return b.allow(time.Now())
+}
+
+// prune removes the buckets of addresses which have not connected recently.
+func (l *connectionLimiter) prune() {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for address, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, address)
+		}
+	}
+}
+
+type loginFailures struct {
+	count       int
+	lockedUntil int64
+	last        int64
+}
+
+// loginLimiter tracks failed login attempts by hashed IP address.
+type loginLimiter struct {
+	failures map[string]*loginFailures
+	failed   uint64 // Total failed login attempts.
+	sync.Mutex
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+// locked returns the time until which logins from the address are locked, or
+// 0 when logins are allowed.
+func (l *loginLimiter) locked(address string) int64 {
+	l.Lock()
+	defer l.Unlock()
+
+	f := l.failures[address]
+	if f == nil || f.lockedUntil <= time.Now().Unix() {
+		return 0
+	}
+	return f.lockedUntil
+}
+
+func (l *loginLimiter) fail(address string) {
+	l.Lock()
+	defer l.Unlock()
+
+	f := l.failures[address]
+	if f == nil {
+		f = &loginFailures{}
+		l.failures[address] = f
+	}
+	f.count++
+	f.lockedUntil = loginLockout(f.count, ipLockFailures)
+	f.last = time.Now().Unix()
+	l.failed++
+}
+
+// total returns the total number of failed login attempts.
+func (l *loginLimiter) total() uint64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.failed
+}
+
+// clear resets the failed login attempts of an address.
+func (l *loginLimiter) clear(address string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.failures, address)
+}
+
+// prune removes addresses without recent failed login attempts.
+func (l *loginLimiter) prune() {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now().Unix()
+	for address, f := range l.failures {
+		if now-f.last >= int64(maxLockout.Seconds()) && f.lockedUntil <= now {
+			delete(l.failures, address)
+		}
+	}
+}
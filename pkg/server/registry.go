@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"codeberg.org/tslocum/bgammon"
+	"codeberg.org/tslocum/gotext"
+)
+
+// commandHandler handles a command sent by a client. clientGame is the match
+// the client is playing or spectating, if any.
+type commandHandler func(s *Server, cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame)
+
+// commandDefinition describes a command which clients may send to the server.
+type commandDefinition struct {
+	name      string
+	aliases   []string
+	arguments []string // Argument names of JSON formatted commands. JSON formatted commands are not accepted when nil.
+	help      string
+	roles     int  // Staff roles allowed to use the command. All users are allowed when zero.
+	viewable  bool // Users without a permitted role may use the command without arguments.
+	match     bool // The client must be in a match.
+	spectator bool // Spectators may use the command.
+	debug     bool // The command is only available when debug commands are allowed.
+	limit     int  // Rate limit class.
+
+	handler commandHandler // Handler used after the client logs in.
+	first   commandHandler // Handler used before the client logs in.
+
+	// notInMatch is called instead of the handler when the command requires
+	// a match and the client is not in a match. A notice is sent when nil.
+	notInMatch func(c *serverClient)
+}
+
+// builtinCommands returns the definitions of the commands provided by the
+// server. The help text and arguments of each command are specified in
+// bgammon.HelpText and bgammon.CommandArguments.
+func builtinCommands() []*commandDefinition {
+	const staff = roleAdmin | roleModerator
+	return []*commandDefinition{
+		{name: bgammon.CommandLogin, first: (*Server).handleLoginCommand},
+		{name: bgammon.CommandLoginJSON, aliases: []string{"lj"}, first: (*Server).handleLoginCommand},
+		{name: bgammon.CommandRegister, first: (*Server).handleLoginCommand, handler: (*Server).handleRegisterCommand, spectator: true},
+		{name: bgammon.CommandRegisterJSON, aliases: []string{"rj"}, first: (*Server).handleLoginCommand},
+		{name: bgammon.CommandResetPassword, first: (*Server).handleResetPasswordCommand},
+		{name: bgammon.CommandResume, first: (*Server).handleResumeCommand},
+		{name: bgammon.CommandOTP, first: (*Server).handleOTPCommand},
+		{name: bgammon.CommandStartTLS, first: (*Server).handleStartTLSCommand, handler: (*Server).handleStartTLSCommand, spectator: true},
+		{name: bgammon.CommandPassword, handler: (*Server).handlePasswordCommand, spectator: true},
+		{name: bgammon.CommandTwoFactor, handler: (*Server).handleTwoFactorCommand, spectator: true},
+		{name: bgammon.CommandAPIToken, handler: (*Server).handleAPITokenCommand, spectator: true},
+		{name: bgammon.CommandDeleteAccount, handler: (*Server).handleDeleteAccountCommand, spectator: true},
+		{name: bgammon.CommandSet, handler: (*Server).handleSetCommand, spectator: true},
+		{name: bgammon.CommandAchievements, handler: (*Server).handleAchievementsCommand, spectator: true},
+		{name: bgammon.CommandReplay, handler: (*Server).handleReplayCommand, spectator: true},
+		{name: bgammon.CommandHistory, handler: (*Server).handleHistoryCommand, spectator: true},
+		{name: bgammon.CommandHelp, aliases: []string{"h"}, handler: (*Server).handleHelpCommand, spectator: true},
+		{name: bgammon.CommandJSON, handler: (*Server).handleJSONCommand, spectator: true},
+		{name: bgammon.CommandSay, aliases: []string{"s"}, handler: (*Server).handleSayCommand, match: true, limit: limitChat, notInMatch: notInMatchSay},
+		{name: bgammon.CommandList, aliases: []string{"ls"}, handler: (*Server).handleListCommand, spectator: true},
+		{name: bgammon.CommandCreate, aliases: []string{"c"}, handler: (*Server).handleCreateCommand, limit: limitMatch},
+		{name: bgammon.CommandJoin, aliases: []string{"j"}, handler: (*Server).handleJoinCommand, limit: limitMatch},
+		{name: bgammon.CommandLeave, aliases: []string{"l"}, handler: (*Server).handleLeaveCommand, match: true, spectator: true, limit: limitMatch, notInMatch: notInMatchLeave},
+		{name: bgammon.CommandDouble, aliases: []string{"d"}, handler: (*Server).handleDoubleCommand, match: true, limit: limitMove},
+		{name: bgammon.CommandResign, handler: (*Server).handleResignCommand, match: true, limit: limitMove},
+		{name: bgammon.CommandRoll, aliases: []string{"r"}, handler: (*Server).handleRollCommand, match: true, limit: limitMove, notInMatch: notInMatchRoll},
+		{name: bgammon.CommandMove, aliases: []string{"m", "mv"}, handler: (*Server).handleMoveCommand, match: true, limit: limitMove, notInMatch: notInMatchMove},
+		{name: bgammon.CommandReset, handler: (*Server).handleResetCommand, match: true, limit: limitMove},
+		{name: bgammon.CommandOk, aliases: []string{"k"}, handler: (*Server).handleOkCommand, match: true, limit: limitMove},
+		{name: bgammon.CommandRematch, aliases: []string{"rm"}, handler: (*Server).handleRematchCommand, match: true, limit: limitMatch},
+		{name: bgammon.CommandFollow, handler: (*Server).handleFollowCommand, spectator: true},
+		{name: bgammon.CommandUnfollow, handler: (*Server).handleUnfollowCommand, spectator: true},
+		{name: bgammon.CommandWho, handler: (*Server).handleWhoCommand, spectator: true},
+		{name: bgammon.CommandReport, handler: (*Server).handleReportCommand, spectator: true, limit: limitChat},
+		{name: bgammon.CommandBoard, aliases: []string{"b"}, handler: (*Server).handleBoardCommand, match: true, spectator: true},
+		{name: bgammon.CommandPong, handler: (*Server).handlePongCommand, spectator: true},
+		{name: bgammon.CommandDisconnect, handler: (*Server).handleDisconnectCommand, spectator: true},
+		{name: bgammon.CommandMOTD, handler: (*Server).handleMOTDCommand, roles: staff, viewable: true, spectator: true},
+		{name: bgammon.CommandBroadcast, handler: (*Server).handleBroadcastCommand, roles: staff | roleTournamentDirector, spectator: true, limit: limitChat},
+		{name: bgammon.CommandDefcon, handler: (*Server).handleDefconCommand, roles: staff, viewable: true, spectator: true},
+		{name: bgammon.CommandRename, handler: (*Server).handleRenameCommand, roles: roleAdmin, spectator: true},
+		{name: bgammon.CommandKick, handler: (*Server).handleKickCommand, roles: staff, spectator: true},
+		{name: bgammon.CommandBan, handler: (*Server).handleBanCommand, roles: staff, spectator: true},
+		{name: bgammon.CommandUnban, handler: (*Server).handleUnbanCommand, roles: staff, spectator: true},
+		{name: bgammon.CommandMute, handler: (*Server).handleMuteCommand, roles: staff, spectator: true},
+		{name: bgammon.CommandUnmute, handler: (*Server).handleUnmuteCommand, roles: staff, spectator: true},
+		{name: bgammon.CommandShutdown, handler: (*Server).handleShutdownCommand, roles: roleAdmin, spectator: true},
+		{name: bgammon.CommandGrant, handler: (*Server).handleRoleCommand, roles: roleAdmin, spectator: true},
+		{name: bgammon.CommandRevoke, handler: (*Server).handleRoleCommand, roles: roleAdmin, spectator: true},
+		{name: bgammon.CommandAudit, handler: (*Server).handleAuditCommand, roles: staff, spectator: true},
+		{name: bgammon.CommandReports, handler: (*Server).handleReportsCommand, roles: staff, spectator: true},
+		{name: "endgame", handler: (*Server).handleEndgameCommand, match: true, debug: true},
+	}
+}
+
+func notInMatchSay(c *serverClient) {
+	c.sendNotice(gotext.GetD(c.language, "Message not sent: You are not currently in a match."))
+}
+
+func notInMatchLeave(c *serverClient) {
+	c.sendEvent(&bgammon.EventFailedLeave{
+		Reason: gotext.GetD(c.language, "You are not currently in a match."),
+	})
+}
+
+func notInMatchRoll(c *serverClient) {
+	c.sendEvent(&bgammon.EventFailedRoll{
+		Reason: gotext.GetD(c.language, "You are not currently in a match."),
+	})
+}
+
+func notInMatchMove(c *serverClient) {
+	c.sendEvent(&bgammon.EventFailedMove{
+		Reason: gotext.GetD(c.language, "You are not currently in a match."),
+	})
+}
+
+// registerBuiltinCommands adds the commands provided by the server to the
+// command registry.
+func (s *Server) registerBuiltinCommands() {
+	for _, def := range builtinCommands() {
+		if def.help == "" {
+			def.help = bgammon.HelpText[def.name]
+		}
+		if def.arguments == nil {
+			def.arguments = bgammon.CommandArguments[def.name]
+		}
+		err := s.addCommand(def)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// addCommand adds a command to the registry. An error is returned when the
+// name or an alias of the command is already registered.
+func (s *Server) addCommand(def *commandDefinition) error {
+	s.registryLock.Lock()
+	defer s.registryLock.Unlock()
+
+	if s.registry == nil {
+		s.registry = make(map[string]*commandDefinition)
+	}
+	keywords := append([]string{def.name}, def.aliases...)
+	for _, keyword := range keywords {
+		if keyword == "" || strings.ContainsAny(keyword, " \t\r\n") || strings.ToLower(keyword) != keyword {
+			return fmt.Errorf("invalid command name or alias: %q", keyword)
+		} else if s.registry[keyword] != nil {
+			return fmt.Errorf("command %s is already registered", keyword)
+		}
+	}
+	for _, keyword := range keywords {
+		s.registry[keyword] = def
+	}
+	return nil
+}
+
+// command returns the definition of the command with the specified name or
+// alias, or nil if no command is registered.
+func (s *Server) command(keyword string) *commandDefinition {
+	s.registryLock.RLock()
+	defer s.registryLock.RUnlock()
+	return s.registry[keyword]
+}
+
+// commandList returns the registered commands sorted by name.
+func (s *Server) commandList() []*commandDefinition {
+	s.registryLock.RLock()
+	var list []*commandDefinition
+	for keyword, def := range s.registry {
+		if keyword == def.name {
+			list = append(list, def)
+		}
+	}
+	s.registryLock.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// commandLimit returns the rate limit class of the specified command keyword.
+func (s *Server) commandLimit(keyword string) int {
+	def := s.command(strings.ToLower(keyword))
+	if def == nil {
+		return limitDefault
+	}
+	return def.limit
+}
+
+// allowed returns whether the client is allowed to use the specified command.
+func (s *Server) allowed(c *serverClient, command string) bool {
+	def := s.command(command)
+	if def == nil || def.roles == 0 {
+		return true
+	}
+	return c.roles()&def.roles != 0
+}
+
+// dispatchCommand checks whether the client may use the command in its
+// current state and calls the command's handler.
+func (s *Server) dispatchCommand(def *commandDefinition, cmd serverCommand, params [][]byte, clientGame *serverGame) {
+	if clientGame != nil && !def.spectator && clientGame.client1 != cmd.client && clientGame.client2 != cmd.client {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Command ignored: You are spectating this match."))
+		return
+	} else if def.debug && !s.debug {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You are not allowed to use that command."))
+		return
+	} else if def.roles != 0 && (len(params) > 0 || !def.viewable) && !s.allowed(cmd.client, def.name) {
+		cmd.sendNotice("Access denied.")
+		return
+	} else if def.match && clientGame == nil {
+		if def.notInMatch != nil {
+			def.notInMatch(cmd.client)
+		} else {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
+		}
+		return
+	}
+	def.handler(s, cmd, def.name, params, clientGame)
+}
+
+// CommandContext provides the handler of a command registered via
+// RegisterCommand with the command's parameters and the client which sent it.
+type CommandContext struct {
+	Command string   // Command name.
+	Params  [][]byte // Command parameters.
+
+	client *serverClient
+	game   *serverGame
+}
+
+// Username returns the username of the client.
+func (c *CommandContext) Username() string {
+	return string(c.client.name)
+}
+
+// AccountID returns the account ID of the client, or 0 when the client is a guest.
+func (c *CommandContext) AccountID() int {
+	return c.client.accountID
+}
+
+// MatchID returns the ID of the match the client is playing or spectating,
+// or 0 when the client is not in a match.
+func (c *CommandContext) MatchID() int {
+	if c.game == nil {
+		return 0
+	}
+	return c.game.id
+}
+
+// Notice sends a notice to the client.
+func (c *CommandContext) Notice(message string) {
+	c.client.sendNotice(message)
+}
+
+// Send sends an event to the client.
+func (c *CommandContext) Send(event interface{}) {
+	c.client.sendEvent(event)
+}
+
+// Command describes a command registered by an application embedding the server.
+type Command struct {
+	Name      string
+	Aliases   []string
+	Arguments []string // Argument names of the JSON formatted command, in the order they are specified in the text command.
+	Help      string   // Arguments and description, such as: <username> - Wave at a player.
+	Roles     []string // Staff roles allowed to use the command (admin, mod or td). All users are allowed when empty.
+	Match     bool     // The client must be in a match.
+	Spectator bool     // Spectators may use the command.
+	Handler   func(c *CommandContext)
+}
+
+// RegisterCommand registers a command. Commands are handled in the same
+// goroutine as the commands provided by the server, so handlers should not block.
+func (s *Server) RegisterCommand(c *Command) error {
+	if c.Handler == nil {
+		return fmt.Errorf("command %s has no handler", c.Name)
+	}
+	var roles int
+	for _, name := range c.Roles {
+		role := roleNames[strings.ToLower(name)]
+		if role == 0 {
+			return fmt.Errorf("command %s has invalid role: %s", c.Name, name)
+		}
+		roles |= role
+	}
+	arguments := c.Arguments
+	if arguments == nil {
+		arguments = []string{}
+	}
+	handler := c.Handler
+	return s.addCommand(&commandDefinition{
+		name:      c.Name,
+		aliases:   c.Aliases,
+		arguments: arguments,
+		help:      c.Help,
+		roles:     roles,
+		match:     c.Match,
+		spectator: c.Spectator,
+		handler: func(s *Server, cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+			handler(&CommandContext{
+				Command: keyword,
+				Params:  params,
+				client:  cmd.client,
+				game:    clientGame,
+			})
+		},
+	})
+}
+
+// CommandReference returns a Markdown formatted table of the commands provided
+// by the server. It is included in PROTOCOL.md.
+func CommandReference() []byte {
+	s := &Server{}
+	s.registerBuiltinCommands()
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("| Command | Aliases | JSON arguments | Available to | Requires match | Spectators |\n")
+	buf.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for _, def := range s.commandList() {
+		if def.debug {
+			continue
+		}
+		roles := roleList(def.roles)
+		if def.viewable {
+			roles += " (to modify)"
+		}
+		login := def.handler == nil
+		spectator := def.spectator
+		if login {
+			roles = "Before logging in"
+			spectator = false
+		}
+		fmt.Fprintf(buf, "| `%s` | %s | %s | %s | %s | %s |\n", def.name, codeList(def.aliases), codeList(def.arguments), roles, yesNo(def.match), yesNo(spectator))
+	}
+	return buf.Bytes()
+}
+
+// roleList returns the names of the specified roles.
+func roleList(roles int) string {
+	if roles == 0 {
+		return "All users"
+	}
+	var names []string
+	for _, role := range []struct {
+		role int
+		name string
+	}{{roleAdmin, "admin"}, {roleModerator, "mod"}, {roleTournamentDirector, "td"}} {
+		if roles&role.role != 0 {
+			names = append(names, role.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func codeList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return "`" + strings.Join(values, "`, `") + "`"
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "Yes"
+	}
+	return "No"
+}
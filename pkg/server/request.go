@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"codeberg.org/tslocum/bgammon"
+)
+
+// sensitiveArguments are not logged when verbose logging is enabled.
+var sensitiveArguments = []string{"password", "old", "new", "code", "email", "token"}
+
+// accountPasswordArguments are the arguments of each command which contain
+// account passwords.
+var accountPasswordArguments = map[string][]string{
+	bgammon.CommandLogin:         {"password"},
+	bgammon.CommandRegister:      {"password"},
+	bgammon.CommandPassword:      {"old", "new"},
+	bgammon.CommandDeleteAccount: {"password"},
+	bgammon.CommandSet:           {"password"},
+}
+
+// parseCommandRequest parses a JSON formatted command. Named arguments are
+// converted into the parameters of the equivalent text command. The returned
+// command includes the request ID when parsing fails after the ID is decoded.
+func (s *Server) parseCommandRequest(c *serverClient, message []byte) (serverCommand, error) {
+	request := &bgammon.CommandRequest{}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	err := decoder.Decode(request)
+	if err != nil {
+		return serverCommand{client: c, request: true}, err
+	}
+	failed := serverCommand{
+		client:    c,
+		request:   true,
+		requestID: request.ID,
+	}
+
+	keyword := strings.ToLower(strings.TrimSpace(request.Type))
+	if keyword == "" || strings.ContainsAny(keyword, " \t") {
+		return failed, fmt.Errorf("invalid command type")
+	}
+	def := s.command(keyword)
+	if def == nil || def.arguments == nil {
+		return failed, fmt.Errorf("unknown command type: %s", keyword)
+	}
+	keyword = def.name
+
+	// Clients logging in use the JSON variant of the login and register
+	// commands, which accept a client field. Guests registering after logging
+	// in do not specify a client field.
+	loggingIn := c.accountID == -1 && (keyword == bgammon.CommandLogin || keyword == bgammon.CommandRegister)
+
+	// Arguments are converted into positional parameters, so an argument may
+	// only be omitted when no later argument is specified.
+	var params [][]byte
+	var missing string
+	for _, name := range def.arguments {
+		if name == "client" && !loggingIn {
+			continue
+		} else if keyword == bgammon.CommandCreate && name == "password" {
+			// Only private matches have a password.
+			if visibility, _ := request.Args["visibility"].(string); !strings.EqualFold(visibility, "private") {
+				continue
+			}
+		}
+		var value interface{}
+		for _, alternative := range strings.Split(name, "/") {
+			v, ok := request.Args[alternative]
+			if ok {
+				value = v
+				break
+			}
+		}
+		if name == "client" {
+			if v, ok := value.(string); !ok || strings.TrimSpace(v) == "" {
+				value = "unspecified"
+			}
+		}
+		specified := len(params)
+		params, err = appendArgument(params, value)
+		if err != nil {
+			return failed, fmt.Errorf("invalid %s argument: %s", name, err)
+		}
+		if slices.Contains(accountPasswordArguments[keyword], name) {
+			// Spaces in account passwords are treated as underscores.
+			for i := specified; i < len(params); i++ {
+				params[i] = accountPassword(params[i : i+1])
+			}
+		}
+		if len(params) == specified {
+			if missing == "" {
+				missing = name
+			}
+		} else if missing != "" {
+			return failed, fmt.Errorf("missing %s argument", missing)
+		}
+	}
+	if loggingIn {
+		keyword += "json"
+	}
+
+	return serverCommand{
+		client:    c,
+		command:   []byte(keyword),
+		params:    params,
+		request:   true,
+		requestID: request.ID,
+	}, nil
+}
+
+func appendArgument(params [][]byte, value interface{}) ([][]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return params, nil
+	case string:
+		if len(strings.TrimSpace(v)) == 0 {
+			return params, nil
+		}
+		return append(params, []byte(v)), nil
+	case json.Number:
+		return append(params, []byte(v.String())), nil
+	case bool:
+		return append(params, []byte(strconv.FormatBool(v))), nil
+	case []interface{}:
+		var err error
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return nil, fmt.Errorf("nested arrays are not allowed")
+			}
+			params, err = appendArgument(params, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return params, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type")
+	}
+}
+
+// redactCommandRequest returns a JSON formatted command with sensitive arguments removed.
+func redactCommandRequest(message []byte) []byte {
+	request := &bgammon.CommandRequest{}
+	err := json.Unmarshal(message, request)
+	if err != nil {
+		return []byte("invalid JSON formatted command")
+	}
+	for _, name := range sensitiveArguments {
+		if request.Args[name] != nil {
+			request.Args[name] = "*******"
+		}
+	}
+	buf, err := json.Marshal(request)
+	if err != nil {
+		return []byte("invalid JSON formatted command")
+	}
+	return buf
+}
@@ -4,16 +4,23 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"embed"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
+	"net/http"
+	"net/netip"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/tslocum/bgammon"
@@ -29,6 +36,16 @@ const maxUsernameLength = 18
 
 const inactiveLimit = 600 // 10 minutes.
 
+const maxChatHistory = 50
+
+const reportInterval = 60 // 1 minute.
+
+// Minimum network prefix lengths which may be banned.
+const (
+	minPrefixIPv4 = 8
+	minPrefixIPv6 = 16
+)
+
 var (
 	anyNumbers             = regexp.MustCompile(`[0-9]+`)
 	onlyNumbers            = regexp.MustCompile(`^[0-9]+$`)
@@ -46,14 +63,42 @@ func init() {
 }
 
 type serverCommand struct {
-	client  *serverClient
-	command []byte
+	client    *serverClient
+	command   []byte
+	params    [][]byte                    // Parameters of JSON formatted commands.
+	request   bool                        // Command is JSON formatted.
+	requestID string                      // Client-supplied ID of JSON formatted commands.
+	err       error                       // Error which occurred while parsing a JSON formatted command.
+	account   *account                    // Account registered by a guest. Applied by the command handler.
+	challenge *challenge                  // Match requested via the HTTP API. Created by the command handler.
+	removed   chan struct{}               // Client disconnected. Closed once the command handler has removed the client.
+	spectate  *spectateRequest            // Live match feed viewer joining a match. Added by the command handler.
+	viewing   chan bool                   // Receives whether a live match feed viewer is still in a match.
+	online    chan []bgammon.OnlinePlayer // Receives the list of online players. No client is specified.
+	unmute    bool                        // Unmute clients whose mutes have expired. No client is specified.
+	confirmed int                         // ID of an account whose email address was confirmed. No client is specified.
+	email     []byte                      // New email address of the confirmed account, when the email address was changed.
+}
+
+// sendEvent sends an event to the client in response to the command.
+func (cmd serverCommand) sendEvent(e interface{}) {
+	cmd.client.sendResponse(e, cmd.requestID)
+}
+
+// sendNotice sends a notice to the client in response to the command.
+func (cmd serverCommand) sendNotice(message string) {
+	cmd.client.sendResponse(&bgammon.EventNotice{
+		Message: message,
+	}, cmd.requestID)
 }
 
-type server struct {
+// Server is a bgammon server. Servers are created with New, started with Start
+// and stopped with Stop.
+type Server struct {
 	clients      []*serverClient
 	games        []*serverGame
 	listeners    []net.Listener
+	httpServers  []*http.Server
 	newGameIDs   chan int
 	newClientIDs chan int
 	commands     chan serverCommand
@@ -66,6 +111,10 @@ type server struct {
 	gamesCacheTime time.Time
 	gamesCacheLock sync.Mutex
 
+	onlineCache     []bgammon.OnlinePlayer
+	onlineCacheTime time.Time
+	onlineCacheLock sync.Mutex
+
 	statsCache     [8][]byte
 	statsCacheTime [8]time.Time
 	statsCacheLock sync.Mutex
@@ -78,11 +127,17 @@ type server struct {
 	diceStatsCacheTime time.Time
 	diceStatsCacheLock sync.Mutex
 
-	defcon int
+	defcon     atomic.Int32      // DEFCON level. Use defconLevel to read the level.
+	autoDefcon *defconController // Only set when automatic DEFCON escalation is enabled.
+
+	connections *connectionLimiter
+	logins      *loginLimiter
+	metrics     *serverMetrics
 
 	motd string
 
-	sortedCommands []string
+	registry     map[string]*commandDefinition // Commands by name and alias.
+	registryLock sync.RWMutex
 
 	mailServer    string
 	resetSalt     string
@@ -93,8 +148,16 @@ type server struct {
 	languageTags  []language.Tag
 	languageNames [][]byte
 
-	certFile string
-	certKey  string
+	certificates *certificateStore
+	startTLS     bool // Allow clients connected via TCP to upgrade their connection using the starttls command.
+
+	trustedProxies []netip.Prefix // Proxies which provide the addresses of the clients they connect on behalf of.
+	proxyProtocol  bool           // Connections to TCP listeners from trusted proxies begin with a PROXY protocol header.
+
+	allowUnconfirmedRated bool // Allow accounts with unconfirmed email addresses to play rated matches.
+	unconfirmedChatDefcon int  // Disallow chat by accounts with unconfirmed email addresses at this DEFCON level or lower.
+	requireStaffTwoFactor bool // Require staff to enable two-factor authentication before using staff commands.
+	minProtocolVersion    int  // Clients implementing an older protocol version are disconnected.
 
 	relayChat bool // Chats are not relayed normally. This option is only used by local servers.
 	verbose   bool
@@ -102,6 +165,23 @@ type server struct {
 
 	shutdownTime   time.Time
 	shutdownReason string
+
+	logger     *log.Logger
+	hooks      Hooks
+	bus        eventBus
+	dataSource string
+	storage    *Storage
+	ownStorage bool // The storage was opened by the server and is closed when the server stops.
+
+	webhooks      []string
+	webhookSecret string
+
+	started       bool
+	stopOnce      sync.Once
+	done          chan struct{}  // Closed when the server stops.
+	doneLock      sync.Mutex     // Held while closing done and while adding to wg.
+	wg            sync.WaitGroup // Background goroutines and connected clients.
+	listenersLock sync.Mutex
 }
 
 type Options struct {
@@ -109,83 +189,263 @@ type Options struct {
 	DataSource string
 	MailServer string
 
-	RelayChat bool
-	Verbose   bool
-	Debug     bool
+	AllowUnconfirmedRated bool // Allow accounts with unconfirmed email addresses to play rated matches.
+	UnconfirmedChatDefcon int  // Disallow chat by accounts with unconfirmed email addresses at this DEFCON level or lower.
+	RequireStaffTwoFactor bool // Require staff to enable two-factor authentication before using staff commands.
+	MinProtocolVersion    int  // Disconnect clients implementing an older protocol version.
+
+	RelayChat  bool
+	AutoDefcon bool
+	Verbose    bool
+	Debug      bool
 
 	CertFile string
 	CertKey  string
+	StartTLS bool // Allow clients connected via TCP to upgrade their connection using the starttls command.
+
+	TrustedProxies []string // IP addresses and networks (in CIDR notation) of proxies which provide the addresses of the clients they connect on behalf of.
+	ProxyProtocol  bool     // Connections to TCP listeners from trusted proxies begin with a PROXY protocol header.
 
 	ResetSalt     string
 	PasswordSalt  string
 	IPAddressSalt string
+
+	Logger  *log.Logger // Logger used for server messages. The standard logger is used when nil.
+	Storage *Storage    // Storage used instead of connecting to DataSource.
+	Hooks   Hooks       // Functions called when match events occur.
+
+	Webhooks      []string // URLs which receive server events as JSON encoded POST requests.
+	WebhookSecret string   // Secret used to sign webhook requests. Requests are not signed when blank.
 }
 
-func NewServer(op *Options) *server {
+// New returns a new server. The server does not accept connections until it
+// is started.
+func New(op *Options) (*Server, error) {
 	if op == nil {
 		op = &Options{}
 	}
 	const bufferSize = 10
-	s := &server{
+	s := &Server{
 		newGameIDs:    make(chan int),
 		newClientIDs:  make(chan int),
 		commands:      make(chan serverCommand, bufferSize),
 		welcome:       []byte("hello Welcome to bgammon.org! Please log in by sending the 'login' command. You may specify a username, otherwise you will be assigned a random username. If you specify a username, you may also specify a password. Have fun!"),
-		defcon:        5,
+		connections:   newConnectionLimiter(),
+		logins:        newLoginLimiter(),
+		metrics:       newServerMetrics(),
 		mailServer:    op.MailServer,
 		resetSalt:     op.ResetSalt,
 		passwordSalt:  op.PasswordSalt,
 		ipAddressSalt: op.IPAddressSalt,
-		certFile:      op.CertFile,
-		certKey:       op.CertKey,
+		certificates:  &certificateStore{certFile: op.CertFile, certKey: op.CertKey},
+		startTLS:      op.StartTLS,
+		proxyProtocol: op.ProxyProtocol,
 		relayChat:     op.RelayChat,
 		verbose:       op.Verbose,
 		debug:         op.Debug,
+
+		allowUnconfirmedRated: op.AllowUnconfirmedRated,
+		unconfirmedChatDefcon: op.UnconfirmedChatDefcon,
+		requireStaffTwoFactor: op.RequireStaffTwoFactor,
+		minProtocolVersion:    op.MinProtocolVersion,
+
+		logger:     op.Logger,
+		hooks:      op.Hooks,
+		dataSource: op.DataSource,
+		storage:    op.Storage,
+		done:       make(chan struct{}),
+
+		webhooks:      op.Webhooks,
+		webhookSecret: op.WebhookSecret,
+	}
+	s.defcon.Store(5)
+	s.bus.seed(time.Now())
+	if s.logger == nil {
+		s.logger = log.Default()
 	}
-	s.loadLocales()
 
-	for command := range bgammon.HelpText {
-		s.sortedCommands = append(s.sortedCommands, command)
+	err := s.loadLocales()
+	if err != nil {
+		return nil, err
+	}
+
+	s.registerBuiltinCommands()
+
+	s.trustedProxies, err = parseTrustedProxies(op.TrustedProxies)
+	if err != nil {
+		return nil, err
 	}
-	sort.Slice(s.sortedCommands, func(i, j int) bool { return s.sortedCommands[i] < s.sortedCommands[j] })
 
 	if op.TZ != "" {
-		var err error
 		s.tz, err = time.LoadLocation(op.TZ)
 		if err != nil {
-			log.Fatalf("failed to parse timezone %s: %s", op.TZ, err)
+			return nil, fmt.Errorf("failed to parse timezone %s: %s", op.TZ, err)
 		}
 	} else {
 		s.tz = time.UTC
 	}
 
-	if op.DataSource != "" {
-		err := connectDB(op.DataSource)
+	if op.AutoDefcon {
+		s.autoDefcon = newDefconController()
+	}
+	return s, nil
+}
+
+// Start connects to the database and starts processing commands. The server
+// is stopped when the context is canceled.
+func (s *Server) Start(ctx context.Context) error {
+	if s.started {
+		return fmt.Errorf("server already started")
+	}
+
+	if s.storage == nil && s.dataSource != "" {
+		storage, err := OpenStorage(ctx, s.dataSource)
 		if err != nil {
-			log.Fatalf("failed to connect to database: %s", err)
+			return err
 		}
-
-		err = testDBConnection()
+		s.storage, s.ownStorage = storage, true
+	}
+	if s.storage != nil {
+		err := useStorage(s.storage)
 		if err != nil {
-			log.Fatalf("failed to test database connection: %s", err)
+			if s.ownStorage {
+				s.storage.Close(ctx)
+			}
+			return err
 		}
+		s.logger.Println("Connected to database successfully")
+	}
+	s.started = true
+
+	s.goBackground(s.handleNewGameIDs)
+	s.goBackground(s.handleNewClientIDs)
+	s.goBackground(s.handleCommands)
+	s.goBackground(s.handleGames)
+	s.goBackground(s.handleExpiredSanctions)
+	s.goBackground(s.handleExpiredAccounts)
+	s.goBackground(s.handlePruneConnections)
+	if s.autoDefcon != nil {
+		s.goBackground(s.handleDefcon)
+	}
+	for _, address := range s.webhooks {
+		sub := s.Subscribe()
+		s.goBackground(func() {
+			s.handleWebhook(address, sub)
+		})
+	}
 
-		initDB()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stop()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// track adds a task which the server waits for when stopping. It returns
+// false, without adding the task, when the server is stopping.
+func (s *Server) track() bool {
+	s.doneLock.Lock()
+	defer s.doneLock.Unlock()
+	if s.stopping() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// goBackground runs a function in a goroutine which the server waits for
+// when stopping. The function is not run when the server is stopping.
+func (s *Server) goBackground(f func()) {
+	if !s.track() {
+		return
+	}
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
 
-		log.Println("Connected to database successfully")
+// Stop stops accepting connections, disconnects all clients and waits for
+// background tasks to finish. If the context expires first, its error is
+// returned. Matches in progress are not recorded.
+func (s *Server) Stop(ctx context.Context) error {
+	if !s.started {
+		return fmt.Errorf("server not started")
+	}
+	s.stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	go s.handleNewGameIDs()
-	go s.handleNewClientIDs()
-	go s.handleCommands()
-	go s.handleGames()
-	return s
+	if s.storage != nil {
+		releaseStorage(s.storage)
+		if s.ownStorage {
+			return s.storage.Close(ctx)
+		}
+	}
+	return nil
 }
 
-func (s *server) loadLocales() {
+// stop closes the listeners and disconnects all clients.
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		s.doneLock.Lock()
+		close(s.done)
+		s.doneLock.Unlock()
+
+		s.listenersLock.Lock()
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		for _, server := range s.httpServers {
+			server.Close()
+		}
+		s.listenersLock.Unlock()
+
+		s.clientsLock.Lock()
+		for _, sc := range s.clients {
+			sc.Terminate(gotext.GetD(sc.language, "The server is shutting down."))
+		}
+		s.clientsLock.Unlock()
+
+		s.bus.stop()
+	})
+}
+
+// verboseLogger returns the logger used to print all client messages, or nil
+// when verbose logging is disabled.
+func (s *Server) verboseLogger() *log.Logger {
+	if !s.verbose {
+		return nil
+	}
+	return s.logger
+}
+
+// stopping returns whether the server is stopping or has stopped.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) loadLocales() error {
 	entries, err := assetFS.ReadDir("locales")
 	if err != nil {
-		log.Fatalf("failed to list files in locales directory: %s", err)
+		return fmt.Errorf("failed to list files in locales directory: %s", err)
 	}
 
 	var availableTags = []language.Tag{
@@ -207,7 +467,7 @@ func (s *server) loadLocales() {
 
 		b, err := assetFS.ReadFile(fmt.Sprintf("locales/%s/%s.po", entry.Name(), entry.Name()))
 		if err != nil {
-			log.Fatalf("failed to read locale %s: %s", entry.Name(), err)
+			return fmt.Errorf("failed to read locale %s: %s", entry.Name(), err)
 		}
 
 		po := gotext.NewPo()
@@ -216,9 +476,10 @@ func (s *server) loadLocales() {
 	}
 	s.languageTags = availableTags
 	s.languageNames = availableNames
+	return nil
 }
 
-func (s *server) matchLanguage(identifier []byte) []byte {
+func (s *Server) matchLanguage(identifier []byte) []byte {
 	if len(identifier) == 0 {
 		return englishIdentifier
 	}
@@ -243,26 +504,32 @@ func (s *server) matchLanguage(identifier []byte) []byte {
 	return s.languageNames[index]
 }
 
-func (s *server) ListenLocal() chan net.Conn {
+func (s *Server) ListenLocal() chan net.Conn {
 	conns := make(chan net.Conn)
 	go s.handleLocal(conns)
 	return conns
 }
 
-func (s *server) handleLocal(conns chan net.Conn) {
+func (s *Server) handleLocal(conns chan net.Conn) {
 	for {
 		local, remote := net.Pipe()
 
-		conns <- local
-		go s.handleConnection(remote)
+		select {
+		case conns <- local:
+		case <-s.done:
+			local.Close()
+			remote.Close()
+			return
+		}
+		go s.handleConnection(remote, transportLocal, nil)
 	}
 }
 
-func (s *server) nameAllowed(username []byte) bool {
+func (s *Server) nameAllowed(username []byte) bool {
 	return !guestName.Match(username)
 }
 
-func (s *server) clientByUsername(username []byte) *serverClient {
+func (s *Server) clientByUsername(username []byte) *serverClient {
 	lower := bytes.ToLower(username)
 	for _, c := range s.clients {
 		if bytes.Equal(bytes.ToLower(c.name), lower) {
@@ -272,22 +539,35 @@ func (s *server) clientByUsername(username []byte) *serverClient {
 	return nil
 }
 
-func (s *server) addClient(c *serverClient) {
+func (s *Server) addClient(c *serverClient) {
 	s.clientsLock.Lock()
 	defer s.clientsLock.Unlock()
 
 	s.clients = append(s.clients, c)
 }
 
-func (s *server) removeClient(c *serverClient) {
+// forgetClient removes a client from the list of connected clients.
+func (s *Server) forgetClient(c *serverClient) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	for i, sc := range s.clients {
+		if sc == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeClient removes a disconnected client from its match and the list of
+// connected clients. It is called by the command handler.
+func (s *Server) removeClient(c *serverClient) {
 	g := s.gameByClient(c)
 	if g != nil {
 		g.removeClient(c)
 	}
 	c.Terminate("")
 
-	close(c.commands)
-
 	s.clientsLock.Lock()
 	defer s.clientsLock.Unlock()
 
@@ -313,9 +593,16 @@ func (s *server) removeClient(c *serverClient) {
 	}
 }
 
-func (s *server) handleGames() {
+func (s *Server) handleGames() {
 	t := time.NewTicker(time.Minute)
-	for range t.C {
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
 		s.gamesLock.Lock()
 
 		i := 0
@@ -396,12 +683,13 @@ func (s *server) handleGames() {
 
 				_, err := recordGameResult(g, 4, g.replay)
 				if err != nil {
-					log.Fatalf("failed to record game result: %s", err)
+					s.logger.Printf("failed to record game result: %s", err)
 				}
 				_, err = recordMatchResult(g, matchTypeCasual)
 				if err != nil {
-					log.Fatalf("failed to record match result: %s", err)
+					s.logger.Printf("failed to record match result: %s", err)
 				}
+				s.notifyMatchEnded(g)
 			}
 		}
 		for j := i; j < len(s.games); j++ {
@@ -413,31 +701,61 @@ func (s *server) handleGames() {
 	}
 }
 
-func (s *server) handleClient(c *serverClient) {
+func (s *Server) handleClient(c *serverClient) {
+	if !s.track() {
+		c.conn().Terminate("")
+		return
+	}
+	defer s.wg.Done()
+
 	s.addClient(c)
 
-	log.Printf("Client %s connected", c.label())
+	s.logger.Printf("Client %s connected", c.label())
 
 	go s.handlePingClient(c)
 	go s.handleClientCommands(c)
 
 	c.HandleReadWrite()
 
-	// Remove client.
-	s.removeClient(c)
+	// Allow the session to be resumed by another connection.
+	if s.detachClient(c) {
+		s.logger.Printf("Client %s detached", c.label())
+		if s.waitDetached(c) {
+			close(c.commands)
+			return
+		}
+	} else if c.replaced {
+		close(c.commands)
+		return
+	}
+
+	// Remove client. Matches are only modified by the command handler, so
+	// clients are not removed from matches after the server stops.
+	removed := make(chan struct{})
+	s.queueCommand(serverCommand{client: c, removed: removed})
+	select {
+	case <-removed:
+	case <-s.done:
+		s.forgetClient(c)
+	}
+	close(c.commands)
 
-	log.Printf("Client %s disconnected", c.label())
+	s.logger.Printf("Client %s disconnected", c.label())
 }
 
-func (s *server) handleConnection(conn net.Conn) {
+// handleConnection handles a client connected via a socket. startTLS is the
+// configuration used when the client upgrades its connection using the
+// starttls command. Clients may not upgrade their connection when nil.
+func (s *Server) handleConnection(conn net.Conn, transport string, startTLS *tls.Config) {
 	const bufferSize = 8
 	commands := make(chan []byte, bufferSize)
 	events := make(chan []byte, bufferSize)
 
 	now := time.Now().Unix()
 
-	sc := newSocketClient(conn, commands, events, s.verbose)
-	sc.address = s.hashIP(conn.RemoteAddr().String())
+	sc := newSocketClient(conn, startTLS, commands, events, s.verboseLogger())
+	addresses := s.hashIPPrefixes(conn.RemoteAddr().String())
+	sc.address = addresses[0]
 
 	c := &serverClient{
 		id:        <-s.newClientIDs,
@@ -446,13 +764,16 @@ func (s *server) handleConnection(conn net.Conn) {
 		connected: now,
 		active:    now,
 		commands:  commands,
+		events:    events,
+		transport: transport,
+		addresses: addresses,
 		Client:    sc,
 	}
 	s.sendWelcome(c)
 	s.handleClient(c)
 }
 
-func (s *server) handlePingClient(c *serverClient) {
+func (s *Server) handlePingClient(c *serverClient) {
 	// TODO only ping when there is no recent activity
 	t := time.NewTicker(30 * time.Second)
 	for {
@@ -463,10 +784,12 @@ func (s *server) handlePingClient(c *serverClient) {
 			return
 		}
 
-		if len(c.name) == 0 {
+		if len(c.name) == 0 && !c.loggingIn.Load() {
 			c.Terminate("User did not send login command within 30 seconds.")
 			t.Stop()
 			return
+		} else if c.detachedConn() != nil {
+			continue
 		}
 
 		c.lastPing = time.Now().Unix()
@@ -476,34 +799,100 @@ func (s *server) handlePingClient(c *serverClient) {
 	}
 }
 
-func (s *server) handleClientCommands(c *serverClient) {
+func (s *Server) handleClientCommands(c *serverClient) {
+	limiter := newClientLimiter()
 	var command []byte
 	for command = range c.commands {
-		s.commands <- serverCommand{
+		if c.Terminated() {
+			continue
+		}
+		cmd := serverCommand{
 			client:  c,
 			command: command,
 		}
+		if bytes.HasPrefix(bytes.TrimSpace(command), []byte("{")) {
+			var err error
+			cmd, err = s.parseCommandRequest(c, command)
+			cmd.err = err
+		}
+
+		allowed, warnings := limiter.allow(s.commandLimit(commandKeyword(cmd.command)))
+		if !allowed {
+			if warnings >= maxLimitWarnings {
+				s.logger.Printf("terminating client %d (%s) for exceeding rate limits", c.id, c.name)
+				c.Terminate(gotext.GetD(c.language, "You have been disconnected for sending too many commands."))
+			} else {
+				c.sendNotice(gotext.GetD(c.language, "Command ignored: You are sending commands too quickly. Please slow down."))
+			}
+			continue
+		}
+		s.queueCommand(cmd)
+	}
+}
+
+// queueCommand queues a command to be handled. Commands are discarded after
+// the server stops. It returns whether the command was queued.
+func (s *Server) queueCommand(cmd serverCommand) bool {
+	select {
+	case s.commands <- cmd:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// handlePruneConnections periodically removes stale connection and login rate limit entries.
+func (s *Server) handlePruneConnections() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		s.connections.prune()
+		s.logins.prune()
+	}
+}
+
+// commandKeyword returns the lowercase keyword of a command.
+func commandKeyword(command []byte) string {
+	command = bytes.TrimSpace(command)
+	firstSpace := bytes.IndexByte(command, ' ')
+	if firstSpace != -1 {
+		command = command[:firstSpace]
 	}
+	return strings.ToLower(string(command))
 }
 
-func (s *server) handleNewGameIDs() {
+func (s *Server) handleNewGameIDs() {
 	gameID := 1
 	for {
-		s.newGameIDs <- gameID
-		gameID++
+		select {
+		case s.newGameIDs <- gameID:
+			gameID++
+		case <-s.done:
+			return
+		}
 	}
 }
 
-func (s *server) handleNewClientIDs() {
+func (s *Server) handleNewClientIDs() {
 	clientID := 1
 	for {
-		s.newClientIDs <- clientID
-		clientID++
+		select {
+		case s.newClientIDs <- clientID:
+			clientID++
+		case <-s.done:
+			return
+		}
 	}
 }
 
 // randomUsername returns a random guest username, and assumes clients are already locked.
-func (s *server) randomUsername() []byte {
+func (s *Server) randomUsername() []byte {
 	for {
 		name := []byte(fmt.Sprintf("Guest_%d", 100+RandInt(900)))
 
@@ -513,14 +902,14 @@ func (s *server) randomUsername() []byte {
 	}
 }
 
-func (s *server) sendWelcome(c *serverClient) {
+func (s *Server) sendWelcome(c *serverClient) {
 	if c.json {
 		return
 	}
 	c.Write(s.welcome)
 }
 
-func (s *server) sendMOTD(c *serverClient) {
+func (s *Server) sendMOTD(c *serverClient) {
 	motd := s.motd
 	if motd == "" {
 		motd = fmt.Sprintf(gotext.GetD(c.language, "Connect with other players and stay up to date on the latest changes. Visit %s"), "bgammon.org/community")
@@ -528,11 +917,14 @@ func (s *server) sendMOTD(c *serverClient) {
 	c.sendNotice(motd)
 }
 
-func (s *server) sendMatchList(c *serverClient) {
+func (s *Server) sendMatchList(c *serverClient) {
 	ev := &bgammon.EventList{}
 
 	s.gamesLock.RLock()
 	for _, g := range s.games {
+		if !c.supportsVariant(g.Variant) {
+			continue
+		}
 		listing := g.listing(c.name)
 		if listing == nil {
 			continue
@@ -544,7 +936,7 @@ func (s *server) sendMatchList(c *serverClient) {
 	c.sendEvent(ev)
 }
 
-func (s *server) gameByClient(c *serverClient) *serverGame {
+func (s *Server) gameByClient(c *serverClient) *serverGame {
 	s.gamesLock.RLock()
 	defer s.gamesLock.RUnlock()
 
@@ -561,7 +953,179 @@ func (s *server) gameByClient(c *serverClient) *serverGame {
 	return nil
 }
 
-func (s *server) hashIP(address string) string {
+// clientStatus returns the status of a client and the match they are in, if any.
+func (s *Server) clientStatus(c *serverClient) (string, *serverGame) {
+	g := s.gameByClient(c)
+	switch {
+	case g == nil:
+		return bgammon.StatusIdle, nil
+	case g.client1 != c && g.client2 != c:
+		return bgammon.StatusSpectating, g
+	case g.allowed1 == nil && (g.client1 == nil || g.client2 == nil):
+		return bgammon.StatusSeeking, g
+	default:
+		return bgammon.StatusPlaying, g
+	}
+}
+
+// onlinePlayers returns a list of logged in players matching all of the
+// provided filters, and assumes clients are already locked. Followed players
+// are highlighted and listed first when a client is provided.
+func (s *Server) onlinePlayers(c *serverClient, filters [][]byte) []bgammon.OnlinePlayer {
+	var players []bgammon.OnlinePlayer
+	for _, sc := range s.clients {
+		if sc.accountID == -1 || len(sc.name) == 0 || sc.terminating || sc.Terminated() {
+			continue
+		}
+
+		var followed bool
+		if c != nil && c.account != nil && sc.accountID > 0 {
+			for _, target := range c.account.follows {
+				if sc.accountID == target {
+					followed = true
+					break
+				}
+			}
+		}
+
+		status, g := s.clientStatus(sc)
+		var gameID int
+		var rating int
+		if g != nil {
+			gameID = g.id
+		}
+		if sc.account != nil {
+			if g != nil {
+				rating = sc.account.casual.getRating(g.Variant, g.Points > 1) / 100
+			} else {
+				rating = sc.account.casual.backgammonSingle / 100
+			}
+		}
+
+		if !onlinePlayerMatches(sc.name, status, followed, filters) {
+			continue
+		}
+
+		players = append(players, bgammon.OnlinePlayer{
+			Name:     string(sc.name),
+			Rating:   rating,
+			Status:   status,
+			Match:    gameID,
+			Followed: followed,
+		})
+	}
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].Followed != players[j].Followed {
+			return players[i].Followed
+		}
+		return strings.ToLower(players[i].Name) < strings.ToLower(players[j].Name)
+	})
+	return players
+}
+
+// onlinePlayerMatches returns whether a player matches all of the provided filters.
+func onlinePlayerMatches(name []byte, status string, followed bool, filters [][]byte) bool {
+	nameLower := bytes.ToLower(name)
+	for _, filter := range filters {
+		filterLower := string(bytes.ToLower(filter))
+		var match bool
+		switch filterLower {
+		case bgammon.StatusIdle, bgammon.StatusPlaying, bgammon.StatusSpectating, bgammon.StatusSeeking:
+			match = status == filterLower
+		case "following":
+			match = followed
+		default:
+			match = bytes.Contains(nameLower, []byte(filterLower))
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) sendOnlineList(c *serverClient, filters [][]byte) {
+	s.clientsLock.Lock()
+	players := s.onlinePlayers(c, filters)
+	s.clientsLock.Unlock()
+
+	c.sendEvent(&bgammon.EventOnline{
+		Players: players,
+	})
+}
+
+// recordAudit records an action performed by a staff member.
+func (s *Server) recordAudit(c *serverClient, action string, target string, reason string) {
+	s.logger.Printf("Staff action by %s: %s %s %s", c.name, action, target, reason)
+	s.metrics.staffActions.inc(action)
+
+	err := addAudit(c.accountID, action, target, reason)
+	if err != nil {
+		s.logger.Printf("failed to record staff action: %s", err)
+	}
+}
+
+// formatReport returns a one line summary of a player report.
+func (s *Server) formatReport(r *playerReport) string {
+	line := fmt.Sprintf("#%d %s %s reported %s", r.ID, time.Unix(r.Timestamp, 0).In(s.tz).Format("2006-01-02 15:04"), r.Reporter, r.Target)
+	if r.Game != 0 {
+		line += fmt.Sprintf(" in match %d", r.Game)
+	}
+	line += " [" + reportStatusNames[r.Status]
+	if r.Staff != "" {
+		line += " by " + r.Staff
+	}
+	return line + "]"
+}
+
+func (s *Server) hashIP(address string) string {
+	return s.hashAddress(stripPort(address))
+}
+
+func (s *Server) hashAddress(address string) string {
+	buf := []byte(address + s.ipAddressSalt)
+	h := make([]byte, 64)
+	sha3.ShakeSum256(h, buf)
+	return fmt.Sprintf("%x\n", h)
+}
+
+// hashIPPrefixes returns the hashed IP address followed by the hashes of each
+// network prefix which contains the address. This allows ranges of addresses
+// to be banned without storing any addresses.
+func (s *Server) hashIPPrefixes(address string) []string {
+	hashes := []string{s.hashIP(address)}
+	ip := net.ParseIP(stripPort(address))
+	if ip == nil {
+		return hashes
+	}
+	bits, minBits := 128, minPrefixIPv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, minBits = ip4, 32, minPrefixIPv4
+	}
+	for ones := bits - 1; ones >= minBits; ones-- {
+		mask := net.CIDRMask(ones, bits)
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		hashes = append(hashes, s.hashAddress(network.String()))
+	}
+	return hashes
+}
+
+// hashNetwork returns the hash of a network specified in CIDR notation.
+func (s *Server) hashNetwork(cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+	if (bits == 32 && ones < minPrefixIPv4) || (bits == 128 && ones < minPrefixIPv6) {
+		return "", fmt.Errorf("network is too large")
+	} else if ones == bits {
+		return s.hashAddress(network.IP.String()), nil
+	}
+	return s.hashAddress(network.String()), nil
+}
+
+func stripPort(address string) string {
 	leftBracket, rightBracket := strings.IndexByte(address, '['), strings.IndexByte(address, ']')
 	if leftBracket != -1 && rightBracket != -1 && rightBracket > leftBracket {
 		address = address[1:rightBracket]
@@ -571,14 +1135,119 @@ func (s *server) hashIP(address string) string {
 			address = address[:colon]
 		}
 	}
+	return address
+}
 
-	buf := []byte(address + s.ipAddressSalt)
-	h := make([]byte, 64)
-	sha3.ShakeSum256(h, buf)
-	return fmt.Sprintf("%x\n", h)
+// parseDuration parses a duration such as 30m, 12h, 7d or 2w.
+func parseDuration(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	amount, err := strconv.Atoi(v[:len(v)-1])
+	if err != nil || amount <= 0 {
+		return 0, false
+	}
+	var unit time.Duration
+	switch v[len(v)-1] {
+	case 'm', 'M':
+		unit = time.Minute
+	case 'h', 'H':
+		unit = time.Hour
+	case 'd', 'D':
+		unit = 24 * time.Hour
+	case 'w', 'W':
+		unit = 7 * 24 * time.Hour
+	default:
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// formatRemaining returns the time remaining until the provided timestamp in human-readable form.
+func formatRemaining(language string, expires int64) string {
+	remaining := time.Until(time.Unix(expires, 0))
+	switch {
+	case remaining >= 48*time.Hour:
+		days := int(remaining / (24 * time.Hour))
+		return gotext.GetND(language, "%d day", "%d days", days, days)
+	case remaining >= 2*time.Hour:
+		hours := int(remaining / time.Hour)
+		return gotext.GetND(language, "%d hour", "%d hours", hours, hours)
+	default:
+		minutes := int(remaining/time.Minute) + 1
+		return gotext.GetND(language, "%d minute", "%d minutes", minutes, minutes)
+	}
+}
+
+// handleExpiredAccounts periodically deletes accounts whose deletion grace period has passed.
+func (s *Server) handleExpiredAccounts() {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		ids, err := deleteExpiredAccounts()
+		if err != nil {
+			s.logger.Printf("failed to delete expired accounts: %s", err)
+			continue
+		} else if len(ids) == 0 {
+			continue
+		}
+		s.logger.Printf("Deleted %d accounts", len(ids))
+
+		s.clientsLock.Lock()
+		for _, sc := range s.clients {
+			if sc.accountID == 0 || !slices.Contains(ids, sc.accountID) {
+				continue
+			}
+			sc.Terminate(gotext.GetD(sc.language, "Your account has been deleted."))
+		}
+		s.clientsLock.Unlock()
+	}
+}
+
+// handleExpiredSanctions periodically lifts bans and mutes which have expired.
+func (s *Server) handleExpiredSanctions() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		err := deleteExpiredSanctions()
+		if err != nil {
+			s.logger.Printf("failed to delete expired sanctions: %s", err)
+		}
+
+		// Clients are unmuted by the command handler.
+		s.queueCommand(serverCommand{unmute: true})
+	}
 }
 
-func (s *server) handleShutdown() {
+// unmuteExpired unmutes clients whose mutes have expired.
+func (s *Server) unmuteExpired() {
+	now := time.Now().Unix()
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	for _, sc := range s.clients {
+		if sc.muted == 0 || sc.muted > now {
+			continue
+		}
+		sc.muted = 0
+		sc.muteReason = ""
+		sc.sendNotice(gotext.GetD(sc.language, "You are no longer muted."))
+	}
+}
+
+func (s *Server) handleShutdown() {
 	var mins time.Duration
 	var minutes int
 	t := time.NewTicker(time.Minute)
@@ -600,11 +1269,16 @@ func (s *server) handleShutdown() {
 		}
 		s.clientsLock.Unlock()
 
-		<-t.C
+		select {
+		case <-t.C:
+		case <-s.done:
+			t.Stop()
+			return
+		}
 	}
 }
 
-func (s *server) shutdown(delay time.Duration, reason string) {
+func (s *Server) shutdown(delay time.Duration, reason string) {
 	if !s.shutdownTime.IsZero() {
 		return
 	}
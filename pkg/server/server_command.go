@@ -2,8 +2,12 @@ package server
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,11 +29,30 @@ var translatedLanguages = []string{
 
 // handleFirstCommand handles the login and register commands. This method runs
 // in a separate goroutine to allow gameplay to continue while checking passwords.
-func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params [][]byte, reigster bool) {
+func (s *Server) handleFirstCommand(cmd serverCommand, keyword string, params [][]byte, reigster bool) {
+	defer cmd.client.loggingIn.Store(false)
+
 	if keyword == bgammon.CommandLoginJSON || keyword == bgammon.CommandRegisterJSON || keyword == "lj" || keyword == "rj" {
 		cmd.client.json = true
 	}
 
+	var clientInfo []byte
+	if cmd.client.json && len(params) > 0 {
+		clientInfo = params[0]
+	} else if len(params) > 0 && textClientInfo(params[0]) {
+		clientInfo, params = params[0], params[1:]
+	}
+	if len(clientInfo) != 0 {
+		_, clientLanguage, _, _ := parseClientInfo(clientInfo)
+		if clientLanguage != nil {
+			cmd.client.language = "bgammon-" + string(s.matchLanguage(clientLanguage))
+		}
+	}
+	if !s.negotiateProtocol(cmd.client, clientInfo) {
+		cmd.client.Terminate(fmt.Sprintf(gotext.GetD(cmd.client.language, "Your client is too old to connect to this server (protocol version %d, version %d or newer is required). Please download the latest version at bgammon.org/download"), cmd.client.protocol, s.minProtocolVersion))
+		return
+	}
+
 	var username []byte
 	var password []byte
 	var randomUsername bool
@@ -38,7 +61,7 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 			cmd.client.Terminate(gotext.GetD(cmd.client.language, "Please enter an email, username and password."))
 		}
 
-		if s.defcon == 1 {
+		if s.defconLevel() == 1 {
 			cmd.client.Terminate(gotext.GetD(cmd.client.language, "Due to ongoing abuse, registration is disabled. Please try again later."))
 			return
 		}
@@ -49,13 +72,9 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 				sendUsage()
 				return
 			}
-			slashIndex := bytes.IndexRune(params[0], '/')
-			if slashIndex != -1 {
-				cmd.client.language = "bgammon-" + string(s.matchLanguage(params[0][slashIndex+1:]))
-			}
 			email = params[1]
 			username = params[2]
-			password = bytes.Join(params[3:], []byte("_"))
+			password = accountPassword(params[3:])
 		} else {
 			if len(params) < 3 {
 				sendUsage()
@@ -63,7 +82,7 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 			}
 			email = params[0]
 			username = params[1]
-			password = bytes.Join(params[2:], []byte("_"))
+			password = accountPassword(params[2:])
 		}
 		email = bytes.ToLower(email)
 		username = bytes.ToLower(username)
@@ -74,30 +93,25 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 			cmd.client.Terminate(fmt.Sprintf(gotext.GetD(cmd.client.language, "Failed to register: %s", gotext.GetD(cmd.client.language, "Invalid username: must be %d characters or less.")), maxUsernameLength))
 			return
 		}
-		password = bytes.ReplaceAll(password, []byte(" "), []byte("_"))
 		a := &account{
 			email:    email,
 			username: username,
 			password: password,
 		}
-		err := registerAccount(s.passwordSalt, a, cmd.client.Address())
+		err := registerAccount(s.mailServer, s.resetSalt, s.passwordSalt, a, cmd.client.Address())
 		if err != nil {
 			cmd.client.Terminate(fmt.Sprintf("Failed to register: %s", err))
 			return
 		}
+		s.autoDefcon.addRegistration(cmd.client.Address())
+		s.notifyAccountRegistered(username)
 	} else {
 		s.clientsLock.Lock()
 
 		readUsername := func() bool {
 			if cmd.client.json {
-				if len(params) > 0 {
-					slashIndex := bytes.IndexRune(params[0], '/')
-					if slashIndex != -1 {
-						cmd.client.language = "bgammon-" + string(s.matchLanguage(params[0][slashIndex+1:]))
-					}
-					if len(params) > 1 {
-						username = params[1]
-					}
+				if len(params) > 1 {
+					username = params[1]
 				}
 			} else {
 				if len(params) > 0 {
@@ -129,21 +143,34 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 			return
 		}
 		if len(params) > 2 {
-			password = bytes.ReplaceAll(bytes.Join(params[2:], []byte(" ")), []byte(" "), []byte("_"))
+			password = accountPassword(params[2:])
 		}
 
 		s.clientsLock.Unlock()
 	}
 
 	if len(password) > 0 {
-		a, err := loginAccount(s.passwordSalt, username, password)
-		if err != nil {
+		if until := s.logins.locked(cmd.client.Address()); until != 0 {
+			cmd.client.Terminate(fmt.Sprintf(gotext.GetD(cmd.client.language, "Too many failed login attempts. Please try again in %s or reset your password."), formatRemaining(cmd.client.language, until)))
+			return
+		}
+		a, err := loginAccount(s.mailServer, s.passwordSalt, username, password)
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			s.logins.fail(cmd.client.Address())
+			cmd.client.Terminate(fmt.Sprintf(gotext.GetD(cmd.client.language, "Too many failed login attempts. Please try again in %s or reset your password."), formatRemaining(cmd.client.language, locked.until)))
+			return
+		} else if err != nil {
 			cmd.client.Terminate(fmt.Sprintf(gotext.GetD(cmd.client.language, "Failed to log in: %s"), err))
 			return
 		} else if a == nil {
+			s.logins.fail(cmd.client.Address())
 			cmd.client.Terminate(gotext.GetD(cmd.client.language, "No account was found with the provided username and password. To log in as a guest, do not enter a password."))
 			return
+		} else if a.totp != 0 && !s.challengeTOTP(cmd.client, a) {
+			return
 		}
+		s.logins.clear(cmd.client.Address())
 
 		var name []byte
 		if bytes.HasPrefix(a.username, []byte("bot_")) {
@@ -153,8 +180,17 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 		}
 		s.clientsLock.Lock()
 		existing := s.clientByUsername(name)
+		if existing != nil && existing.detached != nil {
+			// End the session of the disconnected client.
+			s.replaceClient(existing)
+		}
 		s.clientsLock.Unlock()
-		if existing != nil {
+		if existing != nil && existing.replaced {
+			g := s.gameByClient(existing)
+			if g != nil {
+				g.removeClient(existing)
+			}
+		} else if existing != nil {
 			cmd.client.Terminate(gotext.GetD(cmd.client.language, "That username is already in use."))
 			return
 		}
@@ -163,6 +199,7 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 		cmd.client.accountID = a.id
 		cmd.client.name = name
 		cmd.client.autoplay = a.autoplay
+		cmd.client.staffDisabled = s.requireStaffTwoFactor && a.totp == 0 && cmd.client.roles() != 0
 	} else {
 		cmd.client.accountID = 0
 		if bytes.HasPrefix(username, []byte("bot_")) {
@@ -173,50 +210,58 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 			username = append([]byte("Guest_"), username...)
 		}
 		cmd.client.name = username
+		s.autoDefcon.addGuest()
 	}
 
-	if s.defcon <= 2 {
+	defcon := s.defconLevel()
+	if defcon <= 2 && cmd.client.accountID == 0 {
 		cmd.client.Terminate(gotext.GetD(cmd.client.language, "Due to ongoing abuse, only registered users may connect. Please register an account or try again later."))
 		return
 	}
 
-	banned, banReason := checkBan(cmd.client.Address(), cmd.client.accountID)
-	if banned {
-		msg := "You are banned"
-		if banReason != "" {
-			msg += ": " + banReason
-		}
+	if msg := s.checkBan(cmd.client.language, cmd.client.addresses, cmd.client.accountID); msg != "" {
 		cmd.client.Terminate(msg)
 		return
 	}
 
-	cmd.client.sendEvent(&bgammon.EventWelcome{
-		PlayerName: string(cmd.client.name),
-		Clients:    len(s.clients),
-		Games:      len(s.games),
+	muted, muteReason, muteExpires := checkMute(cmd.client.addresses, cmd.client.accountID)
+	if muted {
+		cmd.client.muted, cmd.client.muteReason = muteExpires, muteReason
+	}
+
+	cmd.sendEvent(&bgammon.EventWelcome{
+		PlayerName:   string(cmd.client.name),
+		Clients:      len(s.clients),
+		Games:        len(s.games),
+		Protocol:     cmd.client.protocol,
+		Capabilities: cmd.client.capabilities,
 	})
 
-	log.Printf("Client %d logged in as %s", cmd.client.id, cmd.client.name)
+	s.logger.Printf("Client %d logged in as %s", cmd.client.id, cmd.client.name)
+
+	s.startSession(cmd.client)
 
 	// Send user settings.
-	if cmd.client.account != nil {
-		a := cmd.client.account
-		cmd.client.sendEvent(&bgammon.EventSettings{
-			AutoPlay:      a.autoplay,
-			Highlight:     a.highlight,
-			Pips:          a.pips,
-			Moves:         a.moves,
-			Flip:          a.flip,
-			Traditional:   a.traditional,
-			Advanced:      a.advanced,
-			MuteJoinLeave: a.muteJoinLeave,
-			MuteChat:      a.muteChat,
-			MuteRoll:      a.muteRoll,
-			MuteMove:      a.muteMove,
-			MuteBearOff:   a.muteBearOff,
-			Dim:           a.dim,
-			Speed:         a.speed,
-		})
+	cmd.client.sendSettings()
+
+	if cmd.client.account != nil && cmd.client.account.deletion != 0 {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Your account will be deleted in %s. To cancel, send: deleteaccount cancel"), formatRemaining(cmd.client.language, cmd.client.account.deletion)))
+	}
+
+	if !cmd.client.confirmed() {
+		err := resendConfirmation(s.mailServer, s.resetSalt, cmd.client.accountID)
+		if err != nil {
+			s.logger.Printf("failed to resend confirmation email: %s", err)
+		}
+		msg := gotext.GetD(cmd.client.language, "Please confirm your email address by clicking the link which was sent to you via email.")
+		if !s.allowUnconfirmedRated {
+			msg += " " + gotext.GetD(cmd.client.language, "Your matches will not be rated until your email address is confirmed.")
+		}
+		cmd.sendNotice(msg)
+	}
+
+	if cmd.client.staffDisabled {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Your staff permissions are disabled until you enable two-factor authentication using the twofactor command."))
 	}
 
 	// Send match list.
@@ -237,19 +282,19 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 				}
 			}
 			if !found {
-				cmd.client.sendNotice("Help translate this application into your preferred language at bgammon.org/translate")
+				cmd.sendNotice("Help translate this application into your preferred language at bgammon.org/translate")
 			}
 		}
 	}
 
 	// Send outdated Boxcars client warning.
-	if outdatedBoxcarsClient(params[0]) {
-		cmd.client.sendNotice("Warning: You are using an outdated client. Please download the latest version at bgammon.org/download")
+	if cmd.client.protocol < 2 && len(params) > 0 && outdatedBoxcarsClient(params[0]) {
+		cmd.sendNotice("Warning: You are using an outdated client. Please download the latest version at bgammon.org/download")
 	}
 
 	// Send DEFCON warning message.
-	if s.defcon < 5 {
-		cmd.client.sendDefconWarning(s.defcon)
+	if defcon < 5 {
+		cmd.client.sendDefconWarning(defcon)
 	}
 
 	// Send followed player notifications.
@@ -293,1487 +338,2374 @@ func (s *server) handleFirstCommand(cmd serverCommand, keyword string, params []
 			if g.Points > 1 {
 				matchName = gotext.GetND(cmd.client.language, "%[1]s (%[2]d point)", "%[1]s (%[2]d points)", int(g.Points), g.name, g.Points)
 			}
-			cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Rejoined match: %s", matchName))
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Rejoined match: %s", matchName))
 		}
 	}
 	s.gamesLock.RUnlock()
 }
 
-func (s *server) handleCommands() {
+func (s *Server) handleCommands() {
 	var cmd serverCommand
-COMMANDS:
-	for cmd = range s.commands {
-		if cmd.client == nil {
+	for {
+		select {
+		case cmd = <-s.commands:
+		case <-s.done:
+			return
+		}
+
+		if cmd.confirmed != 0 {
+			s.setConfirmed(cmd.confirmed, cmd.email)
+			continue
+		} else if cmd.unmute {
+			s.unmuteExpired()
+			continue
+		} else if cmd.online != nil {
+			s.clientsLock.Lock()
+			cmd.online <- s.onlinePlayers(nil, nil)
+			s.clientsLock.Unlock()
+			continue
+		} else if cmd.challenge != nil {
+			s.handleChallenge(cmd.challenge)
+			continue
+		} else if cmd.client == nil {
 			log.Panicf("nil client with command %s", cmd.command)
+		} else if cmd.removed != nil {
+			s.removeClient(cmd.client)
+			close(cmd.removed)
+			continue
+		} else if cmd.spectate != nil {
+			s.handleSpectate(cmd)
+			continue
+		} else if cmd.viewing != nil {
+			cmd.viewing <- s.gameByClient(cmd.client) != nil
+			continue
 		} else if cmd.client.terminating || cmd.client.Terminated() {
 			continue
 		}
 
+		if cmd.request {
+			cmd.client.json = true
+		}
+
+		if cmd.err != nil {
+			cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Invalid JSON formatted command: %s"), cmd.err))
+			continue
+		} else if cmd.account != nil {
+			s.upgradeGuest(cmd)
+			continue
+		}
+
 		cmd.command = bytes.TrimSpace(cmd.command)
 
-		firstSpace := bytes.IndexByte(cmd.command, ' ')
 		var keyword string
-		var startParameters int
-		if firstSpace == -1 {
-			keyword = string(cmd.command)
-			startParameters = len(cmd.command)
+		var params [][]byte
+		if cmd.request {
+			keyword, params = string(cmd.command), cmd.params
 		} else {
-			keyword = string(cmd.command[:firstSpace])
-			startParameters = firstSpace + 1
+			firstSpace := bytes.IndexByte(cmd.command, ' ')
+			var startParameters int
+			if firstSpace == -1 {
+				keyword = string(cmd.command)
+				startParameters = len(cmd.command)
+			} else {
+				keyword = string(cmd.command[:firstSpace])
+				startParameters = firstSpace + 1
+			}
+			params = bytes.Fields(cmd.command[startParameters:])
 		}
 		if keyword == "" {
 			continue
 		}
 		keyword = strings.ToLower(keyword)
-		params := bytes.Fields(cmd.command[startParameters:])
-
-		// Require users to login or register before using other commands.
-		if cmd.client.accountID == -1 {
-			resetCommand := keyword == bgammon.CommandResetPassword
-			if resetCommand {
-				if len(params) > 0 {
-					email := bytes.ToLower(bytes.TrimSpace(params[0]))
-					if len(email) > 0 {
-						err := resetAccount(s.mailServer, s.resetSalt, email)
-						if err != nil {
-							log.Fatalf("failed to reset password: %s", err)
-						}
-					}
-				}
-				cmd.client.Terminate("resetpasswordok")
-				continue
-			}
 
-			loginCommand := keyword == bgammon.CommandLogin || keyword == bgammon.CommandLoginJSON || keyword == "lj"
-			registerCommand := keyword == bgammon.CommandRegister || keyword == bgammon.CommandRegisterJSON || keyword == "rj"
-			if loginCommand || registerCommand {
-				go s.handleFirstCommand(cmd, keyword, params, registerCommand)
-				continue
-			}
+		def := s.command(keyword)
 
-			cmd := cmd
-			go func() {
-				time.Sleep(500 * time.Millisecond)
-				s.commands <- cmd
-			}()
+		// Require users to login or register before using other commands.
+		// Commands other than otp received while logging in are handled
+		// afterward.
+		if loggingIn := cmd.client.loggingIn.Load(); loggingIn || cmd.client.accountID == -1 {
+			if def == nil || def.first == nil || (loggingIn && def.name != bgammon.CommandOTP) {
+				cmd := cmd
+				go func() {
+					time.Sleep(500 * time.Millisecond)
+					s.queueCommand(cmd)
+				}()
+				continue
+			}
+			def.first(s, cmd, def.name, params, nil)
 			continue
 		}
 
-		clientGame := s.gameByClient(cmd.client)
-		if clientGame != nil && clientGame.client1 != cmd.client && clientGame.client2 != cmd.client {
-			switch keyword {
-			case bgammon.CommandHelp, "h", bgammon.CommandJSON, bgammon.CommandList, "ls", bgammon.CommandBoard, "b", bgammon.CommandLeave, "l", bgammon.CommandAchievements, bgammon.CommandHistory, bgammon.CommandReplay, bgammon.CommandSet, bgammon.CommandPassword, bgammon.CommandFollow, bgammon.CommandUnfollow, bgammon.CommandPong, bgammon.CommandDisconnect, bgammon.CommandMOTD, bgammon.CommandBroadcast, bgammon.CommandDefcon, bgammon.CommandRename, bgammon.CommandKick, bgammon.CommandBan, bgammon.CommandUnban, bgammon.CommandShutdown:
-				// These commands are allowed to be used by spectators.
-			default:
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Command ignored: You are spectating this match."))
-				continue
-			}
+		if def == nil || def.handler == nil {
+			s.logger.Printf("Received unknown command from client %s: %s", cmd.client.label(), cmd.command)
+			cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Unknown command: %s"), cmd.command))
+			continue
 		}
+		start := time.Now()
+		s.dispatchCommand(def, cmd, params, s.gameByClient(cmd.client))
+		s.metrics.commands.observe(def.name, time.Since(start))
+	}
+}
 
-		switch keyword {
-		case bgammon.CommandHelp, "h":
-			if len(params) > 0 {
-				command := string(bytes.ToLower(bytes.Join(params, []byte(" "))))
-				commandHelp := bgammon.HelpText[command]
-				if commandHelp != "" {
-					cmd.client.sendNotice("/" + command + " " + commandHelp)
-				} else {
-					cmd.client.sendNotice(fmt.Sprintf("Unknown command: %s", command))
-				}
-				continue
-			}
+// accountPassword returns the account password specified by the provided
+// parameters. Spaces in account passwords are treated as underscores.
+func accountPassword(params [][]byte) []byte {
+	return bytes.ReplaceAll(bytes.Join(params, []byte(" ")), []byte(" "), []byte("_"))
+}
 
-			cmd.client.sendNotice("Available commands:")
-			for _, command := range s.sortedCommands {
-				cmd.client.sendNotice("/" + command + " " + bgammon.HelpText[command])
-			}
-		case bgammon.CommandJSON:
-			sendUsage := func() {
-				cmd.client.sendNotice("To enable JSON formatted messages, send 'json on'. To disable JSON formatted messages, send 'json off'.")
-			}
-			if len(params) != 1 {
-				sendUsage()
-				continue
-			}
-			paramLower := strings.ToLower(string(params[0]))
-			switch paramLower {
-			case "on":
-				cmd.client.json = true
-				cmd.client.sendNotice("JSON formatted messages enabled.")
-			case "off":
-				cmd.client.json = false
-				cmd.client.sendNotice("JSON formatted messages disabled.")
-			default:
-				sendUsage()
-			}
-		case bgammon.CommandSay, "s":
-			if len(params) == 0 {
-				continue
-			}
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Message not sent: You are not currently in a match."))
-				continue
-			}
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Message not sent: There is no one else in the match."))
-				continue
-			}
-			if s.defcon <= 3 && cmd.client.accountID == 0 {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Due to ongoing abuse, some actions are restricted to registered users only. Please log in or register to avoid interruptions."))
-				continue
-			}
-			ev := &bgammon.EventSay{
-				Message: string(bytes.Join(params, []byte(" "))),
-			}
-			ev.Player = string(cmd.client.name)
-			opponent.sendEvent(ev)
-			if s.relayChat {
-				for _, spectator := range clientGame.spectators {
-					spectator.sendEvent(ev)
-				}
-			}
-		case bgammon.CommandList, "ls":
-			s.sendMatchList(cmd.client)
-		case bgammon.CommandCreate, "c":
-			failCreate := func(message string) {
-				cmd.client.sendEvent(&bgammon.EventFailedCreate{
-					Reason: message,
-				})
-				// TODO Remove when most users are running Boxcars v1.4.7+
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Failed to create match: %s", message))
-			}
-			sendUsage := func() {
-				failCreate("To create a public match please specify whether it is public or private, and also specify how many points are needed to win the match. When creating a private match, a password must also be provided.")
-			}
+// checkBan returns the message sent to clients connecting from a banned
+// address or logging in to a banned account, or an empty string when the
+// client is not banned.
+func (s *Server) checkBan(language string, addresses []string, accountID int) string {
+	banned, banReason, banExpires := checkBan(addresses, accountID)
+	if !banned {
+		return ""
+	}
+	s.autoDefcon.addBanHit()
+	msg := gotext.GetD(language, "You are banned")
+	if banExpires != 0 {
+		msg = fmt.Sprintf(gotext.GetD(language, "You are banned for another %s"), formatRemaining(language, banExpires))
+	}
+	if banReason != "" {
+		msg += ": " + banReason
+	}
+	return msg
+}
 
-			if clientGame != nil {
-				failCreate(gotext.GetD(cmd.client.language, "Please leave the match you are in before creating another."))
-				continue
-			} else if !s.shutdownTime.IsZero() {
-				failCreate(gotext.GetD(cmd.client.language, "The server is shutting down. Reason: %s", s.shutdownReason))
-				continue
-			} else if len(params) < 3 {
-				sendUsage()
-				continue
-			}
+func (s *Server) handleLoginCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	// Two-factor authentication codes are delivered to the login goroutine.
+	cmd.client.otpCodes = make(chan []byte, 1)
+	cmd.client.loggingIn.Store(true)
+	go s.handleFirstCommand(cmd, keyword, params, keyword == bgammon.CommandRegister || keyword == bgammon.CommandRegisterJSON)
+}
 
-			// Parse match type and name. Store parameter references.
-			gameType := bytes.ToLower(params[0])
-			var gamePassword []byte
-			var gamePoints []byte
-			var gameVariant []byte
-			var gameName []byte
-			switch {
-			case bytes.Equal(gameType, []byte("public")):
-				gamePoints = params[1]
-				gameVariant = params[2]
-				if len(params) > 3 {
-					gameName = bytes.Join(params[3:], []byte(" "))
-				}
-			case bytes.Equal(gameType, []byte("private")):
-				if len(params) < 3 {
-					sendUsage()
-					continue
-				}
-				gamePassword = bytes.ReplaceAll(params[1], []byte("_"), []byte(" "))
-				gamePoints = params[2]
-				gameVariant = params[3]
-				if len(params) > 4 {
-					gameName = bytes.Join(params[4:], []byte(" "))
-				}
-			default:
-				sendUsage()
-				continue
+func (s *Server) handleResetPasswordCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) > 0 {
+		email := bytes.ToLower(bytes.TrimSpace(params[0]))
+		if len(email) > 0 {
+			err := resetAccount(s.mailServer, s.resetSalt, email)
+			if err != nil {
+				s.logger.Printf("failed to reset password: %s", err)
 			}
+		}
+	}
+	cmd.client.Terminate("resetpasswordok")
+}
 
-			// Parse match variant.
-			var variant int8
-			switch {
-			case bytes.Equal(gameVariant, []byte("0")):
-				variant = bgammon.VariantBackgammon
-			case bytes.Equal(gameVariant, []byte("1")):
-				variant = bgammon.VariantAceyDeucey
-			case bytes.Equal(gameVariant, []byte("2")):
-				variant = bgammon.VariantTabula
-			default:
-				sendUsage()
-				continue
-			}
+func (s *Server) handleResumeCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 || !s.resumeSession(cmd.client, params[0]) {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to resume session: the session has expired. Please log in again."))
+	}
+}
 
-			// Parse match points.
-			points, err := strconv.Atoi(string(gamePoints))
-			if err != nil || points < 1 {
-				sendUsage()
-				continue
-			} else if points > 127 {
-				points = 127
-			}
+// handleStartTLSCommand handles starttls commands which were not handled by
+// the client's connection, such as when the command is not the first command
+// sent or the connection may not be upgraded.
+func (s *Server) handleStartTLSCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to start TLS: TLS may only be started by sending the starttls command immediately after connecting via TCP to a server which allows it."))
+}
 
-			if s.defcon <= 3 && cmd.client.accountID == 0 {
-				gameName = nil
-			}
+func (s *Server) handleOTPCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if cmd.client.loggingIn.Load() && len(params) > 0 {
+		select {
+		case cmd.client.otpCodes <- params[0]:
+		default:
+		}
+	}
+}
 
-			// Set default match name.
-			if len(bytes.TrimSpace(gameName)) == 0 {
-				abbr := "'s"
-				lastLetter := cmd.client.name[len(cmd.client.name)-1]
-				if lastLetter == 's' || lastLetter == 'S' {
-					abbr = "'"
-				}
-				gameName = []byte(fmt.Sprintf("%s%s match", cmd.client.name, abbr))
-			}
+func (s *Server) handleHelpCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) > 0 {
+		command := string(bytes.ToLower(bytes.Join(params, []byte(" "))))
+		def := s.command(command)
+		if def != nil && def.help != "" {
+			cmd.sendNotice("/" + def.name + " " + def.help)
+		} else {
+			cmd.sendNotice(fmt.Sprintf("Unknown command: %s", command))
+		}
+		return
+	}
 
-			g := newServerGame(<-s.newGameIDs, variant)
-			g.name = gameName
-			g.Points = int8(points)
-			g.password = gamePassword
-			g.addClient(cmd.client)
+	cmd.sendNotice("Available commands:")
+	for _, def := range s.commandList() {
+		if def.help != "" {
+			cmd.sendNotice("/" + def.name + " " + def.help)
+		}
+	}
+}
 
-			s.gamesLock.Lock()
-			s.games = append(s.games, g)
-			s.gamesLock.Unlock()
+func (s *Server) handleJSONCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	sendUsage := func() {
+		cmd.sendNotice("To enable JSON formatted messages, send 'json on'. To disable JSON formatted messages, send 'json off'.")
+	}
+	if len(params) != 1 {
+		sendUsage()
+		return
+	}
+	paramLower := strings.ToLower(string(params[0]))
+	switch paramLower {
+	case "on":
+		cmd.client.json = true
+		cmd.sendNotice("JSON formatted messages enabled.")
+	case "off":
+		cmd.client.json = false
+		cmd.sendNotice("JSON formatted messages disabled.")
+	default:
+		sendUsage()
+	}
+}
 
-			cmd.client.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Created match: %s"), g.name))
+func (s *Server) handleSayCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		return
+	}
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Message not sent: There is no one else in the match."))
+		return
+	}
+	defcon := s.defconLevel()
+	if defcon <= 3 && cmd.client.accountID == 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Due to ongoing abuse, some actions are restricted to registered users only. Please log in or register to avoid interruptions."))
+		return
+	} else if defcon <= s.unconfirmedChatDefcon && !cmd.client.confirmed() {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Due to ongoing abuse, chat is restricted to users who have confirmed their email address. Please check your email for a confirmation link."))
+		return
+	} else if cmd.client.muted != 0 {
+		msg := fmt.Sprintf(gotext.GetD(cmd.client.language, "Message not sent: You are muted for another %s."), formatRemaining(cmd.client.language, cmd.client.muted))
+		if cmd.client.muteReason != "" {
+			msg += " " + fmt.Sprintf(gotext.GetD(cmd.client.language, "Reason: %s"), cmd.client.muteReason)
+		}
+		cmd.sendNotice(msg)
+		return
+	}
+	message := bytes.Join(params, []byte(" "))
+	clientGame.addChat(cmd.client.name, message)
+	s.autoDefcon.addChat()
+	ev := &bgammon.EventSay{
+		Message: string(message),
+	}
+	ev.Player = string(cmd.client.name)
+	opponent.sendEvent(ev)
+	if s.relayChat {
+		for _, spectator := range clientGame.spectators {
+			spectator.sendEvent(ev)
+		}
+	}
+}
 
-			if len(g.password) == 0 {
-				cmd.client.sendNotice("Note: A chime will sound when another player joins. While you wait, join the bgammon.org community at bgammon.org/community")
-			}
-		case bgammon.CommandJoin, "j":
-			if clientGame != nil {
-				cmd.client.sendEvent(&bgammon.EventFailedJoin{
-					Reason: gotext.GetD(cmd.client.language, "Please leave the match you are in before joining another."),
-				})
-				continue
-			}
+func (s *Server) handleListCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	s.sendMatchList(cmd.client)
+}
 
-			sendUsage := func() {
-				cmd.client.sendNotice("To join a match please specify its ID or the name of a player in the match. To join a private match, a password must also be specified.")
-			}
+func (s *Server) handleCreateCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	failCreate := func(message string) {
+		cmd.sendEvent(&bgammon.EventFailedCreate{
+			Reason: message,
+		})
+		if !cmd.client.supports(bgammon.CapabilityFailedCreate) {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to create match: %s", message))
+		}
+	}
+	sendUsage := func() {
+		failCreate("To create a public match please specify whether it is public or private, and also specify how many points are needed to win the match. When creating a private match, a password must also be provided.")
+	}
 
-			if len(params) == 0 {
-				sendUsage()
-				continue
-			}
+	if clientGame != nil {
+		failCreate(gotext.GetD(cmd.client.language, "Please leave the match you are in before creating another."))
+		return
+	} else if !s.shutdownTime.IsZero() {
+		failCreate(gotext.GetD(cmd.client.language, "The server is shutting down. Reason: %s", s.shutdownReason))
+		return
+	} else if len(params) < 3 {
+		sendUsage()
+		return
+	}
 
-			var joinGameID int
-			if onlyNumbers.Match(params[0]) {
-				gameID, err := strconv.Atoi(string(params[0]))
-				if err == nil && gameID > 0 {
-					joinGameID = gameID
-				}
+	// Parse match type and name. Store parameter references.
+	gameType := bytes.ToLower(params[0])
+	var gamePassword []byte
+	var gamePoints []byte
+	var gameVariant []byte
+	var gameName []byte
+	switch {
+	case bytes.Equal(gameType, []byte("public")):
+		gamePoints = params[1]
+		gameVariant = params[2]
+		if len(params) > 3 {
+			gameName = bytes.Join(params[3:], []byte(" "))
+		}
+	case bytes.Equal(gameType, []byte("private")):
+		if len(params) < 4 {
+			sendUsage()
+			return
+		}
+		gamePassword = bytes.ReplaceAll(params[1], []byte("_"), []byte(" "))
+		gamePoints = params[2]
+		gameVariant = params[3]
+		if len(params) > 4 {
+			gameName = bytes.Join(params[4:], []byte(" "))
+		}
+	default:
+		sendUsage()
+		return
+	}
 
-				if joinGameID == 0 {
-					sendUsage()
-					continue
-				}
-			} else {
-				paramLower := bytes.ToLower(params[0])
-				s.clientsLock.Lock()
-				for _, sc := range s.clients {
-					if bytes.Equal(paramLower, bytes.ToLower(sc.name)) {
-						g := s.gameByClient(sc)
-						if g != nil {
-							joinGameID = g.id
-						}
-						break
-					}
-				}
-				s.clientsLock.Unlock()
+	// Parse match variant.
+	var variant int8
+	switch {
+	case bytes.Equal(gameVariant, []byte("0")):
+		variant = bgammon.VariantBackgammon
+	case bytes.Equal(gameVariant, []byte("1")):
+		variant = bgammon.VariantAceyDeucey
+	case bytes.Equal(gameVariant, []byte("2")):
+		variant = bgammon.VariantTabula
+	default:
+		sendUsage()
+		return
+	}
 
-				if joinGameID == 0 {
-					cmd.client.sendEvent(&bgammon.EventFailedJoin{
-						Reason: gotext.GetD(cmd.client.language, "Match not found."),
-					})
-					continue
-				}
-			}
+	if !cmd.client.supportsVariant(variant) {
+		failCreate(gotext.GetD(cmd.client.language, "Your client does not support this variant. Please download the latest version at bgammon.org/download"))
+		return
+	}
 
-			s.gamesLock.Lock()
-			for _, g := range s.games {
-				if g.terminated() {
-					continue
-				}
-				if g.id == joinGameID {
-					providedPassword := bytes.ReplaceAll(bytes.Join(params[1:], []byte(" ")), []byte("_"), []byte(" "))
-					if len(g.password) != 0 && (len(params) < 2 || !bytes.Equal(g.password, providedPassword)) {
-						cmd.client.sendEvent(&bgammon.EventFailedJoin{
-							Reason: gotext.GetD(cmd.client.language, "Invalid password."),
-						})
-						s.gamesLock.Unlock()
-						continue COMMANDS
-					}
+	// Parse match points.
+	points, err := strconv.Atoi(string(gamePoints))
+	if err != nil || points < 1 {
+		sendUsage()
+		return
+	} else if points > 127 {
+		points = 127
+	}
 
-					if bytes.HasPrefix(bytes.ToLower(cmd.client.name), []byte("bot_")) && ((g.client1 != nil && !bytes.HasPrefix(bytes.ToLower(g.client1.name), []byte("bot_"))) || (g.client2 != nil && !bytes.HasPrefix(bytes.ToLower(g.client2.name), []byte("bot_")))) {
-						cmd.client.sendEvent(&bgammon.EventFailedJoin{
-							Reason: gotext.GetD(cmd.client.language, "Bots are not allowed to join player matches. Please create a match instead."),
-						})
-						continue COMMANDS
-					}
+	if s.defconLevel() <= 3 && cmd.client.accountID == 0 {
+		gameName = nil
+	}
 
-					spectator := g.addClient(cmd.client)
-					s.gamesLock.Unlock()
-					matchName := string(g.name)
-					if g.Points > 1 {
-						matchName = gotext.GetND(cmd.client.language, "%[1]s (%[2]d point)", "%[1]s (%[2]d points)", int(g.Points), g.name, g.Points)
-					}
-					cmd.client.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Joined match: %s"), matchName))
-					if spectator {
-						cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are spectating this match. Chat messages are not relayed."))
-					}
-					continue COMMANDS
-				}
-			}
-			s.gamesLock.Unlock()
+	// Set default match name.
+	if len(bytes.TrimSpace(gameName)) == 0 {
+		abbr := "'s"
+		lastLetter := cmd.client.name[len(cmd.client.name)-1]
+		if lastLetter == 's' || lastLetter == 'S' {
+			abbr = "'"
+		}
+		gameName = []byte(fmt.Sprintf("%s%s match", cmd.client.name, abbr))
+	}
 
-			cmd.client.sendEvent(&bgammon.EventFailedJoin{
-				Reason: gotext.GetD(cmd.client.language, "Match not found."),
-			})
-		case bgammon.CommandLeave, "l":
-			if clientGame == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedLeave{
-					Reason: gotext.GetD(cmd.client.language, "You are not currently in a match."),
-				})
-				continue
-			}
+	s.createMatch(cmd.client, gameName, gamePassword, int8(points), variant)
+}
 
-			if cmd.client.playerNumber == 1 {
-				clientGame.rejoin1 = false
-			} else {
-				clientGame.rejoin2 = false
-			}
+// createMatch creates a match and adds the client to it.
+func (s *Server) createMatch(c *serverClient, name []byte, password []byte, points int8, variant int8) *serverGame {
+	g := newServerGame(<-s.newGameIDs, variant)
+	g.name = name
+	g.Points = points
+	g.password = password
+	g.requireConfirmed = !s.allowUnconfirmedRated
+	g.server = s
+	s.notifyMatchCreated(g)
+	g.addClient(c)
+
+	s.gamesLock.Lock()
+	s.games = append(s.games, g)
+	s.gamesLock.Unlock()
+
+	c.sendNotice(fmt.Sprintf(gotext.GetD(c.language, "Created match: %s"), g.name))
+
+	if len(g.password) == 0 {
+		c.sendNotice("Note: A chime will sound when another player joins. While you wait, join the bgammon.org community at bgammon.org/community")
+	}
+	return g
+}
 
-			clientGame.removeClient(cmd.client)
-		case bgammon.CommandDouble, "d":
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
-			} else if clientGame.Winner != 0 {
-				continue
-			}
+// challenge is a private match requested on behalf of a player via the HTTP
+// API. The result is sent once the match has been created or the request has
+// been rejected.
+type challenge struct {
+	account  int // ID of the account of the challenger.
+	opponent []byte
+	name     []byte
+	password []byte
+	points   int8
+	variant  int8
+	result   chan *challengeResult
+}
 
-			if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "It is not your turn."))
-				continue
-			}
+type challengeResult struct {
+	status  int    // HTTP status code.
+	message string // Reason the challenge was rejected.
+	match   int
+}
 
-			gameState := &bgammon.GameState{
-				Game:         clientGame.Game,
-				PlayerNumber: cmd.client.playerNumber,
-				Available:    clientGame.LegalMoves(false),
-			}
-			if !gameState.MayDouble() {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You may not double at this time."))
-				continue
-			}
+// handleChallenge creates a private match requested via the HTTP API and
+// invites the opponent to join it.
+func (s *Server) handleChallenge(ch *challenge) {
+	reject := func(status int, message string) {
+		ch.result <- &challengeResult{status: status, message: message}
+	}
 
-			if clientGame.DoublePlayer != 0 && clientGame.DoublePlayer != cmd.client.playerNumber {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You do not currently hold the doubling cube."))
-				continue
-			}
+	var c *serverClient
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if sc.accountID == ch.account && !sc.terminating && !sc.Terminated() {
+			c = sc
+			break
+		}
+	}
+	opponent := s.clientByUsername(ch.opponent)
+	s.clientsLock.Unlock()
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You may not double until your opponent rejoins the match."))
-				continue
-			}
+	switch {
+	case !s.shutdownTime.IsZero():
+		reject(http.StatusServiceUnavailable, "The server is shutting down.")
+		return
+	case c == nil:
+		reject(http.StatusConflict, "You must be logged in to create a challenge.")
+		return
+	case opponent == nil || opponent.accountID == -1 || opponent.terminating || opponent.Terminated():
+		reject(http.StatusNotFound, "Opponent is not online.")
+		return
+	case opponent == c || opponent.accountID == c.accountID:
+		reject(http.StatusBadRequest, "You may not challenge yourself.")
+		return
+	case s.gameByClient(c) != nil:
+		reject(http.StatusConflict, "Please leave the match you are in before creating a challenge.")
+		return
+	case !opponent.supportsVariant(ch.variant):
+		reject(http.StatusConflict, "The opponent's client does not support this variant.")
+		return
+	}
 
-			clientGame.DoubleOffered = true
-			clientGame.NextPartialTurn(opponent.playerNumber)
+	name := ch.name
+	if len(name) == 0 {
+		name = []byte(fmt.Sprintf("%s vs. %s", c.name, opponent.name))
+	}
+	g := s.createMatch(c, name, ch.password, ch.points, ch.variant)
 
-			cmd.client.sendNotice(gotext.GetND(cmd.client.language, "Double offered to opponent (%d point).", "Double offered to opponent (%d points).", int(clientGame.DoubleValue*2), clientGame.DoubleValue*2))
-			clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf(gotext.GetND(clientGame.opponent(cmd.client).language, "%s offers a double (%d point).", "%s offers a double (%d points).", int(clientGame.DoubleValue*2)), cmd.client.name, clientGame.DoubleValue*2))
+	matchName := string(g.name)
+	if g.Points > 1 {
+		matchName = gotext.GetND(opponent.language, "%[1]s (%[2]d point)", "%[1]s (%[2]d points)", int(g.Points), g.name, g.Points)
+	}
+	opponent.sendNotice(fmt.Sprintf(gotext.GetD(opponent.language, "%s challenges you to a match: %s. To accept, send: join %d %s"), c.name, matchName, g.id, ch.password))
 
-			clientGame.eachClient(func(client *serverClient) {
-				if client.json {
-					clientGame.sendBoard(client, false)
-				}
-			})
-		case bgammon.CommandResign:
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
-			} else if clientGame.Winner != 0 {
-				continue
-			}
+	ch.result <- &challengeResult{status: http.StatusCreated, match: g.id}
+}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You may not resign until your opponent rejoins the match."))
-				continue
-			}
+// setConfirmed notifies clients logged in to an account that the email
+// address of the account has been confirmed. The new email address is provided
+// when the email address was changed.
+func (s *Server) setConfirmed(id int, email []byte) {
+	now := time.Now().Unix()
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
 
-			gameState := &bgammon.GameState{
-				Game:         clientGame.Game,
-				PlayerNumber: cmd.client.playerNumber,
-				Available:    clientGame.LegalMoves(false),
-			}
-			if gameState.MayDecline() {
-				clientGame.Winner = opponent.playerNumber
-				clientGame.NextPartialTurn(opponent.playerNumber)
+	for _, sc := range s.clients {
+		if sc.accountID != id || sc.account == nil {
+			continue
+		} else if email != nil {
+			sc.account.email = email
+			sc.account.confirmed = now
+			sc.sendNotice(gotext.GetD(sc.language, "Your email address has been changed."))
+		} else if sc.account.confirmed == 0 {
+			sc.account.confirmed = now
+			sc.sendNotice(gotext.GetD(sc.language, "Your email address has been confirmed."))
+		}
+	}
+}
 
-				// TODO Remove when most users are running Boxcars v1.4.6+
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Declined double offer."))
-				clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf(gotext.GetD(clientGame.opponent(cmd.client).language, "%s declined double offer."), cmd.client.name))
+// spectateRequest adds a viewer of a live match feed to a match as a
+// spectator. The result is sent once the request has been handled.
+type spectateRequest struct {
+	match    int
+	password []byte
+	result   chan int // HTTP status code.
+}
 
-				clientGame.replay = append(clientGame.replay, []byte(fmt.Sprintf("%d d %d 0", clientGame.Turn, clientGame.DoubleValue*2)))
-			} else if gameState.Turn == 0 || gameState.Turn != cmd.client.playerNumber {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You may not resign until it is your turn."))
-				continue
-			} else {
-				clientGame.Winner = opponent.playerNumber
-				clientGame.NextPartialTurn(opponent.playerNumber)
+// handleSpectate adds a viewer of a live match feed to a match and sends the
+// board to the viewer.
+func (s *Server) handleSpectate(cmd serverCommand) {
+	c, req := cmd.client, cmd.spectate
 
-				// TODO Remove when most users are running Boxcars v1.4.6+
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Resigned."))
-				clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf(gotext.GetD(clientGame.opponent(cmd.client).language, "%s resigned."), cmd.client.name))
+	s.gamesLock.Lock()
+	defer s.gamesLock.Unlock()
 
-				clientGame.replay = append(clientGame.replay, []byte(fmt.Sprintf("%d t", cmd.client.playerNumber)))
-			}
-			clientGame.Ended = time.Now().Unix()
+	var game *serverGame
+	for _, g := range s.games {
+		if g.id == req.match && !g.terminated() {
+			game = g
+			break
+		}
+	}
+	if game == nil {
+		req.result <- http.StatusNotFound
+		return
+	} else if len(game.password) != 0 && subtle.ConstantTimeCompare(game.password, req.password) != 1 {
+		req.result <- http.StatusForbidden
+		return
+	}
+	c.playerNumber = 1
+	game.spectators = append(game.spectators, c)
+	game.sendBoard(c, false)
+	req.result <- http.StatusOK
+}
 
-			winPoints := mul8(clientGame.winPoints(clientGame.Winner), clientGame.DoubleValue)
+func (s *Server) handleJoinCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame != nil {
+		cmd.sendEvent(&bgammon.EventFailedJoin{
+			Reason: gotext.GetD(cmd.client.language, "Please leave the match you are in before joining another."),
+		})
+		return
+	}
 
-			var reset bool
-			if clientGame.Winner == 1 {
-				clientGame.Player1.Points = add8(clientGame.Player1.Points, winPoints)
-				reset = clientGame.Player1.Points < clientGame.Points
-			} else {
-				clientGame.Player2.Points = add8(clientGame.Player2.Points, winPoints)
-				reset = clientGame.Player2.Points < clientGame.Points
-			}
-			clientGame.addReplayHeader()
+	sendUsage := func() {
+		cmd.sendNotice("To join a match please specify its ID or the name of a player in the match. To join a private match, a password must also be specified.")
+	}
 
-			var winEvent *bgammon.EventWin
-			if clientGame.Winner != 0 {
-				_, err := recordGameResult(clientGame, 4, clientGame.replay)
-				if err != nil {
-					log.Fatalf("failed to record game result: %s", err)
-				}
+	if len(params) == 0 {
+		sendUsage()
+		return
+	}
 
-				winEvent = &bgammon.EventWin{}
-				if clientGame.Winner == 1 {
-					winEvent.Player = clientGame.Player1.Name
-					winEvent.Resigned = clientGame.Player2.Name
-				} else {
-					winEvent.Player = clientGame.Player2.Name
-					winEvent.Resigned = clientGame.Player1.Name
-				}
-				if clientGame.Points > 1 {
-					winEvent.Points = winPoints
-				}
-			}
+	var joinGameID int
+	if onlyNumbers.Match(params[0]) {
+		gameID, err := strconv.Atoi(string(params[0]))
+		if err == nil && gameID > 0 {
+			joinGameID = gameID
+		}
 
-			if reset {
-				// Reset game and continue match.
-				clientGame.Reset()
-				clientGame.replay = clientGame.replay[:0]
-			} else {
-				// Record match.
-				var err error
-				winEvent.Rating, err = recordMatchResult(clientGame, matchTypeCasual)
-				if err != nil {
-					log.Fatalf("failed to record match result: %s", err)
+		if joinGameID == 0 {
+			sendUsage()
+			return
+		}
+	} else {
+		paramLower := bytes.ToLower(params[0])
+		s.clientsLock.Lock()
+		for _, sc := range s.clients {
+			if bytes.Equal(paramLower, bytes.ToLower(sc.name)) {
+				g := s.gameByClient(sc)
+				if g != nil {
+					joinGameID = g.id
 				}
+				break
 			}
+		}
+		s.clientsLock.Unlock()
 
-			clientGame.eachClient(func(client *serverClient) {
-				if winEvent != nil {
-					client.sendEvent(winEvent)
-				}
-				clientGame.sendBoard(client, false)
+		if joinGameID == 0 {
+			cmd.sendEvent(&bgammon.EventFailedJoin{
+				Reason: gotext.GetD(cmd.client.language, "Match not found."),
 			})
-		case bgammon.CommandRoll, "r":
-			if clientGame == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedRoll{
-					Reason: gotext.GetD(cmd.client.language, "You are not currently in a match."),
+			return
+		}
+	}
+
+	s.gamesLock.Lock()
+	for _, g := range s.games {
+		if g.terminated() {
+			continue
+		}
+		if g.id == joinGameID {
+			providedPassword := bytes.ReplaceAll(bytes.Join(params[1:], []byte(" ")), []byte("_"), []byte(" "))
+			if len(g.password) != 0 && (len(params) < 2 || !bytes.Equal(g.password, providedPassword)) {
+				cmd.sendEvent(&bgammon.EventFailedJoin{
+					Reason: gotext.GetD(cmd.client.language, "Invalid password."),
 				})
-				continue
-			} else if clientGame.Winner != 0 {
-				continue
+				s.gamesLock.Unlock()
+				return
 			}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedRoll{
-					Reason: gotext.GetD(cmd.client.language, "You may not roll until your opponent rejoins the match."),
+			if !cmd.client.supportsVariant(g.Variant) {
+				cmd.sendEvent(&bgammon.EventFailedJoin{
+					Reason: gotext.GetD(cmd.client.language, "Your client does not support this variant. Please download the latest version at bgammon.org/download"),
 				})
-				continue
+				s.gamesLock.Unlock()
+				return
 			}
 
-			if !clientGame.roll(cmd.client.playerNumber) {
-				cmd.client.sendEvent(&bgammon.EventFailedRoll{
-					Reason: gotext.GetD(cmd.client.language, "It is not your turn to roll."),
+			if bytes.HasPrefix(bytes.ToLower(cmd.client.name), []byte("bot_")) && ((g.client1 != nil && !bytes.HasPrefix(bytes.ToLower(g.client1.name), []byte("bot_"))) || (g.client2 != nil && !bytes.HasPrefix(bytes.ToLower(g.client2.name), []byte("bot_")))) {
+				cmd.sendEvent(&bgammon.EventFailedJoin{
+					Reason: gotext.GetD(cmd.client.language, "Bots are not allowed to join player matches. Please create a match instead."),
 				})
-				continue
+				return
 			}
 
-			clientGame.eachClient(func(client *serverClient) {
-				ev := &bgammon.EventRolled{
-					Roll1: clientGame.Roll1,
-					Roll2: clientGame.Roll2,
-					Roll3: clientGame.Roll3,
-				}
-				ev.Player = string(cmd.client.name)
-				if clientGame.Turn == 0 && client.playerNumber == 2 {
-					ev.Roll1, ev.Roll2 = ev.Roll2, ev.Roll1
-				}
-				client.sendEvent(ev)
-			})
+			spectator := g.addClient(cmd.client)
+			s.gamesLock.Unlock()
+			matchName := string(g.name)
+			if g.Points > 1 {
+				matchName = gotext.GetND(cmd.client.language, "%[1]s (%[2]d point)", "%[1]s (%[2]d points)", int(g.Points), g.name, g.Points)
+			}
+			cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Joined match: %s"), matchName))
+			if spectator {
+				cmd.sendNotice(gotext.GetD(cmd.client.language, "You are spectating this match. Chat messages are not relayed."))
+			}
+			return
+		}
+	}
+	s.gamesLock.Unlock()
 
-			// Re-roll automatically when players roll the same value when starting a game.
-			if clientGame.Turn == 0 && clientGame.Roll1 != 0 && clientGame.Roll2 != 0 {
-				reroll := func() {
-					clientGame.Roll1 = 0
-					clientGame.Roll2 = 0
-					if !clientGame.roll(clientGame.Turn) {
-						log.Fatal("failed to re-roll while starting game")
-					}
+	cmd.sendEvent(&bgammon.EventFailedJoin{
+		Reason: gotext.GetD(cmd.client.language, "Match not found."),
+	})
+}
 
-					ev := &bgammon.EventRolled{
-						Roll1: clientGame.Roll1,
-						Roll2: clientGame.Roll2,
-						Roll3: clientGame.Roll3,
-					}
-					ev.Player = string(clientGame.Player1.Name)
-					if clientGame.Turn == 2 {
-						ev.Player = string(clientGame.Player2.Name)
-					}
-					clientGame.eachClient(func(client *serverClient) {
-						clientGame.sendBoard(client, false)
-						client.sendEvent(ev)
-					})
-				}
+func (s *Server) handleLeaveCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if cmd.client.playerNumber == 1 {
+		clientGame.rejoin1 = false
+	} else {
+		clientGame.rejoin2 = false
+	}
 
-				if clientGame.Roll1 > clientGame.Roll2 {
-					clientGame.Turn = 1
-					if clientGame.Variant != bgammon.VariantBackgammon {
-						reroll()
-					}
-				} else if clientGame.Roll2 > clientGame.Roll1 {
-					clientGame.Turn = 2
-					if clientGame.Variant != bgammon.VariantBackgammon {
-						reroll()
-					}
-				} else {
-					for {
-						clientGame.Roll1 = 0
-						clientGame.Roll2 = 0
-						if !clientGame.roll(1) {
-							log.Fatal("failed to re-roll to determine starting player")
-						}
-						if !clientGame.roll(2) {
-							log.Fatal("failed to re-roll to determine starting player")
-						}
-						clientGame.eachClient(func(client *serverClient) {
-							{
-								ev := &bgammon.EventRolled{
-									Roll1: clientGame.Roll1,
-								}
-								ev.Player = clientGame.Player1.Name
-								if clientGame.Turn == 0 && client.playerNumber == 2 {
-									ev.Roll1, ev.Roll2 = ev.Roll2, ev.Roll1
-								}
-								client.sendEvent(ev)
-							}
-							{
-								ev := &bgammon.EventRolled{
-									Roll1: clientGame.Roll1,
-									Roll2: clientGame.Roll2,
-								}
-								ev.Player = clientGame.Player2.Name
-								if clientGame.Turn == 0 && client.playerNumber == 2 {
-									ev.Roll1, ev.Roll2 = ev.Roll2, ev.Roll1
-								}
-								client.sendEvent(ev)
-							}
-						})
-						if clientGame.Roll1 > clientGame.Roll2 {
-							clientGame.Turn = 1
-							if clientGame.Variant != bgammon.VariantBackgammon {
-								reroll()
-							}
-							break
-						} else if clientGame.Roll2 > clientGame.Roll1 {
-							clientGame.Turn = 2
-							if clientGame.Variant != bgammon.VariantBackgammon {
-								reroll()
-							}
-							break
-						}
-					}
-				}
-			}
+	clientGame.removeClient(cmd.client)
+}
 
-			clientGame.NextPartialTurn(clientGame.Turn)
+func (s *Server) handleDoubleCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner != 0 {
+		return
+	}
 
-			forcedMove := clientGame.playForcedMoves()
-			if forcedMove && len(clientGame.LegalMoves(false)) == 0 {
-				chooseRoll := clientGame.Variant == bgammon.VariantAceyDeucey && ((clientGame.Roll1 == 1 && clientGame.Roll2 == 2) || (clientGame.Roll1 == 2 && clientGame.Roll2 == 1)) && len(clientGame.Moves) == 2
-				if clientGame.Variant != bgammon.VariantAceyDeucey || !chooseRoll {
-					clientGame.recordEvent()
-					clientGame.nextTurn(false)
-					continue
-				}
-			}
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "It is not your turn."))
+		return
+	}
 
-			clientGame.eachClient(func(client *serverClient) {
-				if clientGame.Turn != 0 || !client.json {
-					clientGame.sendBoard(client, false)
-				}
-			})
-		case bgammon.CommandMove, "m", "mv":
-			if clientGame == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: gotext.GetD(cmd.client.language, "You are not currently in a match."),
-				})
-				continue
-			} else if clientGame.Winner != 0 {
-				clientGame.sendBoard(cmd.client, false)
-				continue
-			}
+	gameState := &bgammon.GameState{
+		Game:         clientGame.Game,
+		PlayerNumber: cmd.client.playerNumber,
+		Available:    clientGame.LegalMoves(false),
+	}
+	if !gameState.MayDouble() {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You may not double at this time."))
+		return
+	}
 
-			if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: gotext.GetD(cmd.client.language, "It is not your turn to move."),
-				})
-				continue
-			}
+	if clientGame.DoublePlayer != 0 && clientGame.DoublePlayer != cmd.client.playerNumber {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You do not currently hold the doubling cube."))
+		return
+	}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: gotext.GetD(cmd.client.language, "You may not move until your opponent rejoins the match."),
-				})
-				continue
-			}
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You may not double until your opponent rejoins the match."))
+		return
+	}
 
-			sendUsage := func() {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: "Specify one or more moves in the form FROM/TO. For example: 8/4 6/4",
-				})
-			}
+	clientGame.DoubleOffered = true
+	clientGame.NextPartialTurn(opponent.playerNumber)
+	s.notifyDouble(clientGame, cmd.client.name, clientGame.DoubleValue*2, false)
 
-			if len(params) == 0 {
-				sendUsage()
-				continue
-			}
+	cmd.sendNotice(gotext.GetND(cmd.client.language, "Double offered to opponent (%d point).", "Double offered to opponent (%d points).", int(clientGame.DoubleValue*2), clientGame.DoubleValue*2))
+	clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf(gotext.GetND(clientGame.opponent(cmd.client).language, "%s offers a double (%d point).", "%s offers a double (%d points).", int(clientGame.DoubleValue*2)), cmd.client.name, clientGame.DoubleValue*2))
 
-			var moves [][]int8
-			for i := range params {
-				split := bytes.Split(params[i], []byte("/"))
-				if len(split) != 2 {
-					sendUsage()
-					continue COMMANDS
-				}
-				from := bgammon.ParseSpace(string(split[0]))
-				if from == -1 {
-					sendUsage()
-					continue COMMANDS
-				}
-				to := bgammon.ParseSpace(string(split[1]))
-				if to == -1 {
-					sendUsage()
-					continue COMMANDS
-				}
-				if !bgammon.ValidSpace(from) || !bgammon.ValidSpace(to) {
-					cmd.client.sendEvent(&bgammon.EventFailedMove{
-						From:   from,
-						To:     to,
-						Reason: gotext.GetD(cmd.client.language, "Illegal move."),
-					})
-					continue COMMANDS
-				}
+	clientGame.eachClient(func(client *serverClient) {
+		if client.json {
+			clientGame.sendBoard(client, false)
+		}
+	})
+}
 
-				from, to = bgammon.FlipSpace(from, cmd.client.playerNumber, clientGame.Variant), bgammon.FlipSpace(to, cmd.client.playerNumber, clientGame.Variant)
-				moves = append(moves, []int8{from, to})
-			}
+func (s *Server) handleResignCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner != 0 {
+		return
+	}
 
-			ok, expandedMoves := clientGame.AddMoves(moves, false)
-			if !ok {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					From:   0,
-					To:     0,
-					Reason: gotext.GetD(cmd.client.language, "Illegal move."),
-				})
-				continue
-			}
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You may not resign until your opponent rejoins the match."))
+		return
+	}
 
-			clientGame.eachClient(func(client *serverClient) {
-				ev := &bgammon.EventMoved{
-					Moves: bgammon.FlipMoves(expandedMoves, client.playerNumber, clientGame.Variant),
-				}
-				ev.Player = string(cmd.client.name)
-				client.sendEvent(ev)
+	gameState := &bgammon.GameState{
+		Game:         clientGame.Game,
+		PlayerNumber: cmd.client.playerNumber,
+		Available:    clientGame.LegalMoves(false),
+	}
+	if gameState.MayDecline() {
+		clientGame.Winner = opponent.playerNumber
+		clientGame.NextPartialTurn(opponent.playerNumber)
 
-				clientGame.sendBoard(client, false)
-			})
+		if !cmd.client.supports(bgammon.CapabilityResign) {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Declined double offer."))
+		}
+		clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf(gotext.GetD(clientGame.opponent(cmd.client).language, "%s declined double offer."), cmd.client.name))
 
-			clientGame.handleWin()
-		case bgammon.CommandReset:
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
-			} else if clientGame.Winner != 0 {
-				continue
-			}
+		clientGame.replay = append(clientGame.replay, []byte(fmt.Sprintf("%d d %d 0", clientGame.Turn, clientGame.DoubleValue*2)))
+	} else if gameState.Turn == 0 || gameState.Turn != cmd.client.playerNumber {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You may not resign until it is your turn."))
+		return
+	} else {
+		clientGame.Winner = opponent.playerNumber
+		clientGame.NextPartialTurn(opponent.playerNumber)
 
-			if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "It is not your turn."))
-				continue
-			}
+		if !cmd.client.supports(bgammon.CapabilityResign) {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Resigned."))
+		}
+		clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf(gotext.GetD(clientGame.opponent(cmd.client).language, "%s resigned."), cmd.client.name))
 
-			if len(clientGame.Moves) == 0 {
-				continue
-			}
+		clientGame.replay = append(clientGame.replay, []byte(fmt.Sprintf("%d t", cmd.client.playerNumber)))
+	}
+	clientGame.Ended = time.Now().Unix()
 
-			l := len(clientGame.Moves)
-			undoMoves := make([][]int8, l)
-			for i, move := range clientGame.Moves {
-				undoMoves[l-1-i] = []int8{move[1], move[0]}
-			}
-			ok, _ := clientGame.AddMoves(undoMoves, false)
-			if !ok {
-				cmd.client.sendNotice("Failed to undo move: invalid move.")
-			} else {
-				clientGame.eachClient(func(client *serverClient) {
-					ev := &bgammon.EventMoved{
-						Moves: bgammon.FlipMoves(undoMoves, client.playerNumber, clientGame.Variant),
-					}
-					ev.Player = string(cmd.client.name)
+	winPoints := mul8(clientGame.winPoints(clientGame.Winner), clientGame.DoubleValue)
 
-					client.sendEvent(ev)
-					clientGame.sendBoard(client, false)
-				})
-			}
-		case bgammon.CommandOk, "k":
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
-			} else if clientGame.Winner != 0 {
-				continue
-			}
+	var reset bool
+	if clientGame.Winner == 1 {
+		clientGame.Player1.Points = add8(clientGame.Player1.Points, winPoints)
+		reset = clientGame.Player1.Points < clientGame.Points
+	} else {
+		clientGame.Player2.Points = add8(clientGame.Player2.Points, winPoints)
+		reset = clientGame.Player2.Points < clientGame.Points
+	}
+	clientGame.addReplayHeader()
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You must wait until your opponent rejoins the match before continuing the game."))
-				continue
-			}
+	var winEvent *bgammon.EventWin
+	if clientGame.Winner != 0 {
+		_, err := recordGameResult(clientGame, 4, clientGame.replay)
+		if err != nil {
+			s.logger.Printf("failed to record game result: %s", err)
+		}
 
-			if clientGame.DoubleOffered {
-				if clientGame.Turn != cmd.client.playerNumber {
-					opponent := clientGame.opponent(cmd.client)
-					if opponent == nil {
-						cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You may not accept the double until your opponent rejoins the match."))
-						continue
-					}
+		winEvent = &bgammon.EventWin{}
+		if clientGame.Winner == 1 {
+			winEvent.Player = clientGame.Player1.Name
+			winEvent.Resigned = clientGame.Player2.Name
+		} else {
+			winEvent.Player = clientGame.Player2.Name
+			winEvent.Resigned = clientGame.Player1.Name
+		}
+		if clientGame.Points > 1 {
+			winEvent.Points = winPoints
+		}
+		s.notifyGameWon(clientGame, winEvent.Player, winPoints)
+	}
+
+	if reset {
+		// Reset game and continue match.
+		clientGame.Reset()
+		clientGame.replay = clientGame.replay[:0]
+	} else {
+		// Record match.
+		var err error
+		winEvent.Rating, err = recordMatchResult(clientGame, matchTypeCasual)
+		if err != nil {
+			s.logger.Printf("failed to record match result: %s", err)
+		}
+		s.notifyMatchEnded(clientGame)
+	}
 
-					clientGame.DoubleOffered = false
-					clientGame.DoubleValue = clientGame.DoubleValue * 2
-					clientGame.DoublePlayer = cmd.client.playerNumber
-					clientGame.NextPartialTurn(opponent.playerNumber)
+	clientGame.eachClient(func(client *serverClient) {
+		if winEvent != nil {
+			client.sendEvent(winEvent)
+		}
+		clientGame.sendBoard(client, false)
+	})
+}
 
-					cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Accepted double."))
-					opponent.sendNotice(fmt.Sprintf(gotext.GetD(opponent.language, "%s accepted double."), cmd.client.name))
+func (s *Server) handleRollCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner != 0 {
+		return
+	}
 
-					clientGame.replay = append(clientGame.replay, []byte(fmt.Sprintf("%d d %d 1", clientGame.Turn, clientGame.DoubleValue)))
-					clientGame.eachClient(func(client *serverClient) {
-						clientGame.sendBoard(client, false)
-					})
-				} else {
-					cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Waiting for response from opponent."))
-				}
-				continue
-			} else if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "It is not your turn."))
-				continue
-			}
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.sendEvent(&bgammon.EventFailedRoll{
+			Reason: gotext.GetD(cmd.client.language, "You may not roll until your opponent rejoins the match."),
+		})
+		return
+	}
 
-			if clientGame.Roll1 == 0 || clientGame.Roll2 == 0 {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You must roll first."))
-				continue
+	if !clientGame.roll(cmd.client.playerNumber) {
+		cmd.sendEvent(&bgammon.EventFailedRoll{
+			Reason: gotext.GetD(cmd.client.language, "It is not your turn to roll."),
+		})
+		return
+	}
+
+	clientGame.eachClient(func(client *serverClient) {
+		ev := &bgammon.EventRolled{
+			Roll1: clientGame.Roll1,
+			Roll2: clientGame.Roll2,
+			Roll3: clientGame.Roll3,
+		}
+		ev.Player = string(cmd.client.name)
+		if clientGame.Turn == 0 && client.playerNumber == 2 {
+			ev.Roll1, ev.Roll2 = ev.Roll2, ev.Roll1
+		}
+		client.sendEvent(ev)
+	})
+
+	// Re-roll automatically when players roll the same value when starting a game.
+	if clientGame.Turn == 0 && clientGame.Roll1 != 0 && clientGame.Roll2 != 0 {
+		reroll := func() {
+			clientGame.Roll1 = 0
+			clientGame.Roll2 = 0
+			if !clientGame.roll(clientGame.Turn) {
+				s.logger.Printf("failed to re-roll while starting game %d", clientGame.id)
+				return
 			}
 
-			legalMoves := clientGame.LegalMoves(false)
-			if len(legalMoves) != 0 {
-				available := bgammon.FlipMoves(legalMoves, cmd.client.playerNumber, clientGame.Variant)
-				bgammon.SortMoves(available)
-				cmd.client.sendEvent(&bgammon.EventFailedOk{
-					Reason: fmt.Sprintf(gotext.GetD(cmd.client.language, "The following legal moves are available: %s"), bgammon.FormatMoves(available)),
-				})
-				continue
+			ev := &bgammon.EventRolled{
+				Roll1: clientGame.Roll1,
+				Roll2: clientGame.Roll2,
+				Roll3: clientGame.Roll3,
 			}
+			ev.Player = string(clientGame.Player1.Name)
+			if clientGame.Turn == 2 {
+				ev.Player = string(clientGame.Player2.Name)
+			}
+			clientGame.eachClient(func(client *serverClient) {
+				clientGame.sendBoard(client, false)
+				client.sendEvent(ev)
+			})
+		}
 
-			if clientGame.Variant == bgammon.VariantAceyDeucey && ((clientGame.Roll1 == 1 && clientGame.Roll2 == 2) || (clientGame.Roll1 == 2 && clientGame.Roll2 == 1)) && len(clientGame.Moves) == 2 {
-				var doubles int
-				if len(params) > 0 {
-					doubles, _ = strconv.Atoi(string(params[0]))
+		if clientGame.Roll1 > clientGame.Roll2 {
+			clientGame.Turn = 1
+			if clientGame.Variant != bgammon.VariantBackgammon {
+				reroll()
+			}
+		} else if clientGame.Roll2 > clientGame.Roll1 {
+			clientGame.Turn = 2
+			if clientGame.Variant != bgammon.VariantBackgammon {
+				reroll()
+			}
+		} else {
+			for {
+				clientGame.Roll1 = 0
+				clientGame.Roll2 = 0
+				if !clientGame.roll(1) {
+					s.logger.Printf("failed to re-roll to determine starting player in game %d", clientGame.id)
+					return
 				}
-				if doubles < 1 || doubles > 6 {
-					cmd.client.sendEvent(&bgammon.EventFailedOk{
-						Reason: gotext.GetD(cmd.client.language, "Choose which doubles you want for your acey-deucey."),
-					})
-					continue
+				if !clientGame.roll(2) {
+					s.logger.Printf("failed to re-roll to determine starting player in game %d", clientGame.id)
+					return
 				}
-
-				clientGame.recordEvent()
-				clientGame.nextTurn(true)
-				clientGame.Roll1, clientGame.Roll2 = int8(doubles), int8(doubles)
-				clientGame.Reroll = true
-
 				clientGame.eachClient(func(client *serverClient) {
-					ev := &bgammon.EventRolled{
-						Roll1:    clientGame.Roll1,
-						Roll2:    clientGame.Roll2,
-						Selected: true,
+					{
+						ev := &bgammon.EventRolled{
+							Roll1: clientGame.Roll1,
+						}
+						ev.Player = clientGame.Player1.Name
+						if clientGame.Turn == 0 && client.playerNumber == 2 {
+							ev.Roll1, ev.Roll2 = ev.Roll2, ev.Roll1
+						}
+						client.sendEvent(ev)
 					}
-					ev.Player = string(cmd.client.name)
-					client.sendEvent(ev)
-					clientGame.sendBoard(client, false)
-				})
-			} else if clientGame.Variant == bgammon.VariantAceyDeucey && clientGame.Reroll {
-				clientGame.recordEvent()
-				clientGame.nextTurn(true)
-				clientGame.Roll1, clientGame.Roll2 = 0, 0
-				if !clientGame.roll(cmd.client.playerNumber) {
-					cmd.client.Terminate(gotext.GetD(cmd.client.language, "Server error"))
-					opponent.Terminate(gotext.GetD(opponent.language, "Server error"))
-					continue
-				}
-				clientGame.Reroll = false
-
-				clientGame.eachClient(func(client *serverClient) {
-					ev := &bgammon.EventRolled{
-						Roll1: clientGame.Roll1,
-						Roll2: clientGame.Roll2,
+					{
+						ev := &bgammon.EventRolled{
+							Roll1: clientGame.Roll1,
+							Roll2: clientGame.Roll2,
+						}
+						ev.Player = clientGame.Player2.Name
+						if clientGame.Turn == 0 && client.playerNumber == 2 {
+							ev.Roll1, ev.Roll2 = ev.Roll2, ev.Roll1
+						}
+						client.sendEvent(ev)
 					}
-					ev.Player = string(cmd.client.name)
-					client.sendEvent(ev)
-					clientGame.sendBoard(client, false)
 				})
-			} else {
-				clientGame.recordEvent()
-				clientGame.nextTurn(false)
-			}
-		case bgammon.CommandRematch, "rm":
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
-			} else if clientGame.Winner == 0 {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "The match you are in is still in progress."))
-				continue
-			} else if clientGame.rematch == cmd.client.playerNumber {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You have already requested a rematch."))
-				continue
-			} else if clientGame.client1 == nil || clientGame.client2 == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Your opponent left the match."))
-				continue
-			} else if !s.shutdownTime.IsZero() {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Failed to create match: %s", gotext.GetD(cmd.client.language, "The server is shutting down. Reason: %s", s.shutdownReason)))
-				continue
-			} else if clientGame.rematch != 0 && clientGame.rematch != cmd.client.playerNumber {
-				s.gamesLock.Lock()
-
-				newGame := newServerGame(clientGame.id, clientGame.Variant)
-				newGame.name = clientGame.name
-				newGame.Points = clientGame.Points
-				newGame.password = clientGame.password
-				newGame.client1 = clientGame.client1
-				newGame.client2 = clientGame.client2
-				newGame.spectators = make([]*serverClient, len(clientGame.spectators))
-				copy(newGame.spectators, clientGame.spectators)
-				newGame.Player1.Name = clientGame.Player1.Name
-				newGame.Player2.Name = clientGame.Player2.Name
-				newGame.Player1.Rating = clientGame.Player1.Rating
-				newGame.Player2.Rating = clientGame.Player2.Rating
-				newGame.Player1.Icon = clientGame.Player1.Icon
-				newGame.Player2.Icon = clientGame.Player2.Icon
-				newGame.allowed1 = clientGame.allowed1
-				newGame.allowed2 = clientGame.allowed2
-				s.games = append(s.games, newGame)
-
-				clientGame.client1 = nil
-				clientGame.client2 = nil
-				clientGame.spectators = nil
-
-				s.gamesLock.Unlock()
-
-				{
-					ev1 := &bgammon.EventJoined{
-						GameID:       newGame.id,
-						PlayerNumber: 1,
-					}
-					ev1.Player = newGame.Player1.Name
-					ev2 := &bgammon.EventJoined{
-						GameID:       newGame.id,
-						PlayerNumber: 2,
+				if clientGame.Roll1 > clientGame.Roll2 {
+					clientGame.Turn = 1
+					if clientGame.Variant != bgammon.VariantBackgammon {
+						reroll()
 					}
-					ev2.Player = newGame.Player2.Name
-					newGame.client1.sendEvent(ev1)
-					newGame.client1.sendEvent(ev2)
-					newGame.sendBoard(newGame.client1, false)
-				}
-
-				{
-					ev1 := &bgammon.EventJoined{
-						GameID:       newGame.id,
-						PlayerNumber: 1,
-					}
-					ev1.Player = newGame.Player2.Name
-					ev2 := &bgammon.EventJoined{
-						GameID:       newGame.id,
-						PlayerNumber: 2,
+					break
+				} else if clientGame.Roll2 > clientGame.Roll1 {
+					clientGame.Turn = 2
+					if clientGame.Variant != bgammon.VariantBackgammon {
+						reroll()
 					}
-					ev2.Player = newGame.Player1.Name
-					newGame.client2.sendEvent(ev1)
-					newGame.client2.sendEvent(ev2)
-					newGame.sendBoard(newGame.client2, false)
-				}
-
-				for _, spectator := range newGame.spectators {
-					newGame.sendBoard(spectator, false)
+					break
 				}
-			} else {
-				clientGame.rematch = cmd.client.playerNumber
-
-				clientGame.opponent(cmd.client).sendNotice(gotext.GetD(clientGame.opponent(cmd.client).language, "Your opponent would like to play again."))
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Rematch offer sent."))
-				continue
-			}
-		case bgammon.CommandFollow:
-			if len(params) < 1 {
-				cmd.client.sendNotice("Please specify a player: follow <username>")
-				continue
-			} else if cmd.client.accountID == 0 {
-				cmd.client.sendNotice("Failed to follow player: Please log in before following.")
-				continue
 			}
+		}
+	}
 
-			target, err := accountByUsername(string(params[0]))
-			if err != nil || target == nil || target.id == 0 {
-				cmd.client.sendNotice("Failed to follow player: Invalid username.")
-				continue
-			} else if target.id == cmd.client.accountID {
-				cmd.client.sendNotice("Following yourself will get you nowhere quickly.")
-				continue
-			}
+	clientGame.NextPartialTurn(clientGame.Turn)
 
-			err = setAccountFollows(cmd.client.accountID, target.id, true)
-			if err != nil {
-				cmd.client.sendNotice(fmt.Sprintf("You are already following %s.", target.username))
-				continue
-			}
-			cmd.client.account.follows = append(cmd.client.account.follows, target.id)
-			cmd.client.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "You are now following %s."), target.username))
-		case bgammon.CommandUnfollow:
-			if len(params) < 1 {
-				cmd.client.sendNotice("Please specify a player: unfollow <username>")
-				continue
-			} else if cmd.client.accountID == 0 {
-				cmd.client.sendNotice("Failed to un-follow player: Please log in before un-following.")
-				continue
-			}
+	forcedMove := clientGame.playForcedMoves()
+	if forcedMove && len(clientGame.LegalMoves(false)) == 0 {
+		chooseRoll := clientGame.Variant == bgammon.VariantAceyDeucey && ((clientGame.Roll1 == 1 && clientGame.Roll2 == 2) || (clientGame.Roll1 == 2 && clientGame.Roll2 == 1)) && len(clientGame.Moves) == 2
+		if clientGame.Variant != bgammon.VariantAceyDeucey || !chooseRoll {
+			clientGame.recordEvent()
+			clientGame.nextTurn(false)
+			return
+		}
+	}
 
-			target, err := accountByUsername(string(params[0]))
-			if err != nil || target == nil || target.id == 0 {
-				cmd.client.sendNotice("Failed to un-follow player: Invalid username.")
-				continue
-			} else if target.id == cmd.client.accountID {
-				cmd.client.sendNotice("Un-following yourself will get you somewhere slowly.")
-				continue
-			}
+	clientGame.eachClient(func(client *serverClient) {
+		if clientGame.Turn != 0 || !client.json {
+			clientGame.sendBoard(client, false)
+		}
+	})
+}
 
-			err = setAccountFollows(cmd.client.accountID, target.id, false)
-			if err != nil {
-				cmd.client.sendNotice(fmt.Sprintf("You are not following %s.", target.username))
-				continue
-			}
-			cmd.client.account.follows = removeInt(cmd.client.account.follows, target.id)
-			cmd.client.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "You are no longer following %s."), target.username))
-		case bgammon.CommandBoard, "b":
-			if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
-			}
+func (s *Server) handleMoveCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner != 0 {
+		clientGame.sendBoard(cmd.client, false)
+		return
+	}
 
-			clientGame.sendBoard(cmd.client, false)
-		case bgammon.CommandPassword:
-			if cmd.client.account == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Failed to change password: you are logged in as a guest."))
-				continue
-			} else if len(params) < 2 {
-				cmd.client.sendNotice("Please specify your old and new passwords as follows: password <old> <new>")
-				continue
-			}
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.sendEvent(&bgammon.EventFailedMove{
+			Reason: gotext.GetD(cmd.client.language, "It is not your turn to move."),
+		})
+		return
+	}
 
-			a, err := loginAccount(s.passwordSalt, cmd.client.name, params[0])
-			if err != nil || a == nil || a.id == 0 {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Failed to change password: incorrect existing password."))
-				continue
-			}
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.sendEvent(&bgammon.EventFailedMove{
+			Reason: gotext.GetD(cmd.client.language, "You may not move until your opponent rejoins the match."),
+		})
+		return
+	}
 
-			err = setAccountPassword(s.passwordSalt, a.id, string(bytes.Join(params[1:], []byte("_"))))
-			if err != nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Failed to change password."))
-				continue
-			}
-			cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Password changed successfully."))
-		case bgammon.CommandSet:
-			if len(params) < 2 {
-				cmd.client.sendNotice("Please specify the setting name and value as follows: set <name> <value>")
-				continue
-			}
+	sendUsage := func() {
+		cmd.sendEvent(&bgammon.EventFailedMove{
+			Reason: "Specify one or more moves in the form FROM/TO. For example: 8/4 6/4",
+		})
+	}
 
-			name := string(bytes.ToLower(params[0]))
-			settings := []string{"autoplay", "highlight", "pips", "moves", "flip", "traditional", "advanced", "mutejoinleave", "mutechat", "muteroll", "mutemove", "mutebearoff", "dim", "speed"}
-			var found bool
-			for i := range settings {
-				if name == settings[i] {
-					found = true
-					break
-				}
-			}
-			if !found {
-				cmd.client.sendNotice("Please specify the setting name and value as follows: set <name> <value>")
-				continue
-			}
+	if len(params) == 0 {
+		sendUsage()
+		return
+	}
 
-			value, err := strconv.Atoi(string(params[1]))
-			minValue := 0
-			maxValue := 1
-			switch name {
-			case "dim":
-				maxValue = 2
-			case "speed":
-				maxValue = 3
-			}
-			if err != nil || value < minValue || value > maxValue {
-				cmd.client.sendNotice("Invalid setting value provided.")
-				continue
-			}
+	var moves [][]int8
+	for i := range params {
+		split := bytes.Split(params[i], []byte("/"))
+		if len(split) != 2 {
+			sendUsage()
+			return
+		}
+		from := bgammon.ParseSpace(string(split[0]))
+		if from == -1 {
+			sendUsage()
+			return
+		}
+		to := bgammon.ParseSpace(string(split[1]))
+		if to == -1 {
+			sendUsage()
+			return
+		}
+		if !bgammon.ValidSpace(from) || !bgammon.ValidSpace(to) {
+			cmd.sendEvent(&bgammon.EventFailedMove{
+				From:   from,
+				To:     to,
+				Reason: gotext.GetD(cmd.client.language, "Illegal move."),
+			})
+			return
+		}
 
-			if name == "autoplay" {
-				cmd.client.autoplay = value == 1
-			}
+		from, to = bgammon.FlipSpace(from, cmd.client.playerNumber, clientGame.Variant), bgammon.FlipSpace(to, cmd.client.playerNumber, clientGame.Variant)
+		moves = append(moves, []int8{from, to})
+	}
 
-			if cmd.client.account == nil {
-				continue
-			}
-			_ = setAccountSetting(cmd.client.account.id, name, value)
-		case bgammon.CommandAchievements:
-			ev := &bgammon.EventAchievements{}
-			for id, info := range Achievements {
-				ev.Achievements = append(ev.Achievements, &bgammon.EventAchievement{ID: id, Name: gotext.GetD(cmd.client.language, info[0]), Description: gotext.GetD(cmd.client.language, info[1])})
-			}
-			cmd.client.sendEvent(ev)
-		case bgammon.CommandHistory:
-			if len(params) == 0 {
-				cmd.client.sendNotice("Please specify the player as follows: history <username>")
-				continue
-			}
-			const historyPageSize = 50
+	ok, expandedMoves := clientGame.AddMoves(moves, false)
+	if !ok {
+		cmd.sendEvent(&bgammon.EventFailedMove{
+			From:   0,
+			To:     0,
+			Reason: gotext.GetD(cmd.client.language, "Illegal move."),
+		})
+		return
+	}
 
-			page := 1
-			if len(params) > 1 {
-				p, err := strconv.Atoi(string(params[1]))
-				if err == nil && p >= 1 {
-					page = p
-				}
-			}
+	clientGame.eachClient(func(client *serverClient) {
+		ev := &bgammon.EventMoved{
+			Moves: bgammon.FlipMoves(expandedMoves, client.playerNumber, clientGame.Variant),
+		}
+		ev.Player = string(cmd.client.name)
+		client.sendEvent(ev)
 
-			matches, err := matchHistory(string(params[0]))
-			if err != nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Invalid username provided."))
-				continue
-			} else if clientGame != nil {
-				if cmd.client.playerNumber == 1 {
-					clientGame.rejoin1 = false
-				} else {
-					clientGame.rejoin2 = false
-				}
-				clientGame.removeClient(cmd.client)
-			}
+		clientGame.sendBoard(client, false)
+	})
+	s.notifyMove(clientGame, string(cmd.client.name), expandedMoves)
 
-			pages := (len(matches) / historyPageSize)
-			if pages == 0 {
-				pages = 1
-			}
+	clientGame.handleWin()
+}
 
-			ev := &bgammon.EventHistory{
-				Page:  page,
-				Pages: pages,
-			}
-			if len(matches) > 0 && page <= pages {
-				max := page * historyPageSize
-				if max > len(matches) {
-					max = len(matches)
-				}
-				ev.Matches = matches[(page-1)*historyPageSize : max]
-			}
+func (s *Server) handleResetCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner != 0 {
+		return
+	}
 
-			ev.Player = string(params[0])
-			a, err := accountByUsername(string(params[0]))
-			if err == nil && a != nil {
-				ev.CasualBackgammonSingle = a.casual.backgammonSingle / 100
-				ev.CasualBackgammonMulti = a.casual.backgammonMulti / 100
-				ev.CasualAceyDeuceySingle = a.casual.aceySingle / 100
-				ev.CasualAceyDeuceyMulti = a.casual.aceyMulti / 100
-				ev.CasualTabulaSingle = a.casual.tabulaSingle / 100
-				ev.CasualTabulaMulti = a.casual.tabulaMulti / 100
-
-				ev.Achievements = make([]*bgammon.HistoryAchievement, len(a.achievementIDs))
-				for i := range a.achievementIDs {
-					ev.Achievements[i] = &bgammon.HistoryAchievement{
-						ID:        a.achievementIDs[i],
-						Replay:    a.achievementGames[i],
-						Timestamp: a.achievementDates[i],
-					}
-				}
-			}
-			cmd.client.sendEvent(ev)
-		case bgammon.CommandReplay:
-			var (
-				id     int
-				replay []byte
-				err    error
-			)
-			if len(params) == 0 {
-				if clientGame == nil || clientGame.Winner == 0 {
-					cmd.client.sendNotice("Please specify the game as follows: replay <id>")
-					continue
-				}
-				id = -1
-				replay = bytes.Join(clientGame.replay, []byte("\n"))
-			} else {
-				id, err = strconv.Atoi(string(params[0]))
-				if err != nil || id < 0 {
-					cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Invalid replay ID provided."))
-					continue
-				}
-				replay, err = replayByID(id)
-				if err != nil {
-					cmd.client.sendNotice(gotext.GetD(cmd.client.language, "Invalid replay ID provided."))
-					continue
-				}
-			}
-			if len(replay) == 0 {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "No replay was recorded for that game."))
-				continue
-			} else if clientGame != nil {
-				if cmd.client.playerNumber == 1 {
-					clientGame.rejoin1 = false
-				} else {
-					clientGame.rejoin2 = false
-				}
-				clientGame.removeClient(cmd.client)
-			}
-			cmd.client.sendEvent(&bgammon.EventReplay{
-				ID:      id,
-				Content: replay,
-			})
-		case bgammon.CommandPong:
-			// Do nothing.
-		case bgammon.CommandDisconnect:
-			if clientGame != nil {
-				clientGame.removeClient(cmd.client)
-			}
-			cmd.client.Terminate("Client disconnected")
-		case bgammon.CommandMOTD:
-			if len(params) == 0 {
-				cmd.client.sendNotice("Message of the day:")
-				s.sendMOTD(cmd.client)
-				continue
-			} else if !cmd.client.Admin() {
-				cmd.client.sendNotice("Access denied.")
-				continue
-			}
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "It is not your turn."))
+		return
+	}
 
-			motd := bytes.Join(params, []byte(" "))
-			if bytes.Equal(bytes.ToLower(motd), clearBytes) {
-				motd = nil
-			}
-			s.motd = string(motd)
-			cmd.client.sendNotice("MOTD updated.")
-		case bgammon.CommandBroadcast:
-			if !cmd.client.Admin() {
-				cmd.client.sendNotice("Access denied.")
-				continue
-			} else if len(params) == 0 {
-				cmd.client.sendNotice("Please specify a message to broadcast.")
-				continue
-			}
+	if len(clientGame.Moves) == 0 {
+		return
+	}
 
-			message := string(bytes.Join(params, []byte(" ")))
-			s.clientsLock.Lock()
-			for _, sc := range s.clients {
-				sc.sendBroadcast(message)
-			}
-			s.clientsLock.Unlock()
-		case bgammon.CommandDefcon:
-			if len(params) == 0 {
-				cmd.client.sendNotice(fmt.Sprintf("Current DEFCON level: %d.", s.defcon))
-				continue
-			} else if !cmd.client.Admin() && !cmd.client.Mod() {
-				cmd.client.sendNotice("Access denied.")
-				continue
+	l := len(clientGame.Moves)
+	undoMoves := make([][]int8, l)
+	for i, move := range clientGame.Moves {
+		undoMoves[l-1-i] = []int8{move[1], move[0]}
+	}
+	ok, _ := clientGame.AddMoves(undoMoves, false)
+	if !ok {
+		cmd.sendNotice("Failed to undo move: invalid move.")
+	} else {
+		clientGame.eachClient(func(client *serverClient) {
+			ev := &bgammon.EventMoved{
+				Moves: bgammon.FlipMoves(undoMoves, client.playerNumber, clientGame.Variant),
 			}
+			ev.Player = string(cmd.client.name)
 
-			v, err := strconv.Atoi(string(params[0]))
-			if err != nil || v < 1 || v > 5 {
-				cmd.client.sendNotice("Failed to update DEFCON level: invalid level.")
-				continue
-			} else if v == s.defcon {
-				cmd.client.sendNotice("Failed to update DEFCON level: already at specified DEFCON level.")
-				continue
-			}
+			client.sendEvent(ev)
+			clientGame.sendBoard(client, false)
+		})
+	}
+}
 
-			s.defcon = v
-			cmd.client.sendNotice(fmt.Sprintf("Updated DEFCON level to %d.", v))
+func (s *Server) handleOkCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner != 0 {
+		return
+	}
 
-			s.clientsLock.Lock()
-			for _, sc := range s.clients {
-				sc.sendDefconWarning(s.defcon)
-			}
-			s.clientsLock.Unlock()
-		case bgammon.CommandRename:
-			if len(params) < 2 {
-				cmd.client.sendNotice("Please specify the account's current username and a new username.")
-				continue
-			} else if !cmd.client.Admin() {
-				cmd.client.sendNotice("Access denied.")
-				continue
-			}
-			oldUsername := strings.ToLower(string(params[0]))
-			newUsername := strings.ToLower(string(params[1]))
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You must wait until your opponent rejoins the match before continuing the game."))
+		return
+	}
 
-			s.clientsLock.Lock()
-			for _, sc := range s.clients {
-				if bytes.Equal(bytes.ToLower(sc.name), []byte(oldUsername)) {
-					sc.Client.Terminate("Renaming account.")
-					break
-				}
+	if clientGame.DoubleOffered {
+		if clientGame.Turn != cmd.client.playerNumber {
+			opponent := clientGame.opponent(cmd.client)
+			if opponent == nil {
+				cmd.sendNotice(gotext.GetD(cmd.client.language, "You may not accept the double until your opponent rejoins the match."))
+				return
 			}
-			s.clientsLock.Unlock()
 
-			oldAccount, err := accountByUsername(oldUsername)
-			if err != nil {
-				oldAccount = nil
-			}
-			if oldAccount == nil {
-				cmd.client.sendNotice("No account was found with that username.")
-				continue
-			}
+			clientGame.DoubleOffered = false
+			clientGame.DoubleValue = clientGame.DoubleValue * 2
+			clientGame.DoublePlayer = cmd.client.playerNumber
+			clientGame.NextPartialTurn(opponent.playerNumber)
+			s.notifyDouble(clientGame, cmd.client.name, clientGame.DoubleValue, true)
 
-			newAccount, err := accountByUsername(newUsername)
-			if err != nil {
-				newAccount = nil
-			}
-			if newAccount != nil {
-				cmd.client.sendNotice("An account already exists with that username.")
-				continue
-			}
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Accepted double."))
+			opponent.sendNotice(fmt.Sprintf(gotext.GetD(opponent.language, "%s accepted double."), cmd.client.name))
 
-			err = renameAccount(oldAccount.id, oldUsername, newUsername)
-			if err != nil {
-				cmd.client.sendNotice(fmt.Sprintf("Failed to rename account %s: %s", oldUsername, err))
-				continue
-			}
-			cmd.client.sendNotice(fmt.Sprintf("Renamed account %s.", params[0]))
-		case bgammon.CommandKick:
-			if len(params) == 0 {
-				cmd.client.sendNotice("Please specify a username.")
-				continue
-			} else if !cmd.client.Admin() && !cmd.client.Mod() {
-				cmd.client.sendNotice("Access denied.")
-				continue
-			}
+			clientGame.replay = append(clientGame.replay, []byte(fmt.Sprintf("%d d %d 1", clientGame.Turn, clientGame.DoubleValue)))
+			clientGame.eachClient(func(client *serverClient) {
+				clientGame.sendBoard(client, false)
+			})
+		} else {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Waiting for response from opponent."))
+		}
+		return
+	} else if clientGame.Turn != cmd.client.playerNumber {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "It is not your turn."))
+		return
+	}
 
-			var reason string
-			if len(params) > 1 {
-				reason = string(bytes.Join(params[1:], []byte(" ")))
-			}
+	if clientGame.Roll1 == 0 || clientGame.Roll2 == 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You must roll first."))
+		return
+	}
 
-			msg := "Kicked"
-			if reason != "" {
-				msg += ": " + reason
-			}
+	legalMoves := clientGame.LegalMoves(false)
+	if len(legalMoves) != 0 {
+		available := bgammon.FlipMoves(legalMoves, cmd.client.playerNumber, clientGame.Variant)
+		bgammon.SortMoves(available)
+		cmd.sendEvent(&bgammon.EventFailedOk{
+			Reason: fmt.Sprintf(gotext.GetD(cmd.client.language, "The following legal moves are available: %s"), bgammon.FormatMoves(available)),
+		})
+		return
+	}
 
-			var found bool
-			nameLower := bytes.ToLower(params[0])
-			s.clientsLock.Lock()
-			for _, sc := range s.clients {
-				if bytes.Equal(bytes.ToLower(sc.name), nameLower) {
-					found = true
-					sc.Client.Terminate(msg)
-					break
-				}
-			}
-			s.clientsLock.Unlock()
+	if clientGame.Variant == bgammon.VariantAceyDeucey && ((clientGame.Roll1 == 1 && clientGame.Roll2 == 2) || (clientGame.Roll1 == 2 && clientGame.Roll2 == 1)) && len(clientGame.Moves) == 2 {
+		var doubles int
+		if len(params) > 0 {
+			doubles, _ = strconv.Atoi(string(params[0]))
+		}
+		if doubles < 1 || doubles > 6 {
+			cmd.sendEvent(&bgammon.EventFailedOk{
+				Reason: gotext.GetD(cmd.client.language, "Choose which doubles you want for your acey-deucey."),
+			})
+			return
+		}
 
-			if !found {
-				cmd.client.sendNotice("No client was found with that username.")
-			} else {
-				cmd.client.sendNotice(fmt.Sprintf("Kicked %s.", params[0]))
-			}
-		case bgammon.CommandBan:
-			if len(params) == 0 {
-				cmd.client.sendNotice("Please specify an IP address or username.")
-				continue
-			} else if !cmd.client.Admin() && !cmd.client.Mod() {
-				cmd.client.sendNotice("Access denied.")
-				continue
-			}
+		clientGame.recordEvent()
+		clientGame.nextTurn(true)
+		clientGame.Roll1, clientGame.Roll2 = int8(doubles), int8(doubles)
+		clientGame.Reroll = true
 
-			var reason string
-			if len(params) > 1 {
-				reason = string(bytes.Join(params[1:], []byte(" ")))
+		clientGame.eachClient(func(client *serverClient) {
+			ev := &bgammon.EventRolled{
+				Roll1:    clientGame.Roll1,
+				Roll2:    clientGame.Roll2,
+				Selected: true,
 			}
+			ev.Player = string(cmd.client.name)
+			client.sendEvent(ev)
+			clientGame.sendBoard(client, false)
+		})
+	} else if clientGame.Variant == bgammon.VariantAceyDeucey && clientGame.Reroll {
+		clientGame.recordEvent()
+		clientGame.nextTurn(true)
+		clientGame.Roll1, clientGame.Roll2 = 0, 0
+		if !clientGame.roll(cmd.client.playerNumber) {
+			cmd.client.Terminate(gotext.GetD(cmd.client.language, "Server error"))
+			opponent.Terminate(gotext.GetD(opponent.language, "Server error"))
+			return
+		}
+		clientGame.Reroll = false
 
-			msg := "You are banned"
-			if reason != "" {
-				msg += ": " + reason
+		clientGame.eachClient(func(client *serverClient) {
+			ev := &bgammon.EventRolled{
+				Roll1: clientGame.Roll1,
+				Roll2: clientGame.Roll2,
 			}
+			ev.Player = string(cmd.client.name)
+			client.sendEvent(ev)
+			clientGame.sendBoard(client, false)
+		})
+	} else {
+		clientGame.recordEvent()
+		clientGame.nextTurn(false)
+	}
+}
 
-			isIP := bytes.ContainsRune(params[0], '.') || bytes.ContainsRune(params[0], ':')
-			if isIP {
-				ip := s.hashIP(string(params[0]))
-				err := addBan(ip, 0, cmd.client.accountID, reason)
-				if err != nil {
-					cmd.client.sendNotice("Failed to add ban: " + err.Error())
-				}
-
-				s.clientsLock.Lock()
-				for _, sc := range s.clients {
-					if sc.Address() == ip {
-						sc.Client.Terminate(msg)
-					}
-				}
-				s.clientsLock.Unlock()
+func (s *Server) handleRematchCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame.Winner == 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "The match you are in is still in progress."))
+		return
+	} else if clientGame.rematch == cmd.client.playerNumber {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You have already requested a rematch."))
+		return
+	} else if clientGame.client1 == nil || clientGame.client2 == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Your opponent left the match."))
+		return
+	} else if !s.shutdownTime.IsZero() {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to create match: %s", gotext.GetD(cmd.client.language, "The server is shutting down. Reason: %s", s.shutdownReason)))
+		return
+	} else if clientGame.rematch != 0 && clientGame.rematch != cmd.client.playerNumber {
+		s.gamesLock.Lock()
+
+		newGame := newServerGame(clientGame.id, clientGame.Variant)
+		newGame.name = clientGame.name
+		newGame.Points = clientGame.Points
+		newGame.password = clientGame.password
+		newGame.requireConfirmed = clientGame.requireConfirmed
+		newGame.server = s
+		newGame.client1 = clientGame.client1
+		newGame.client2 = clientGame.client2
+		newGame.spectators = make([]*serverClient, len(clientGame.spectators))
+		copy(newGame.spectators, clientGame.spectators)
+		newGame.Player1.Name = clientGame.Player1.Name
+		newGame.Player2.Name = clientGame.Player2.Name
+		newGame.Player1.Rating = clientGame.Player1.Rating
+		newGame.Player2.Rating = clientGame.Player2.Rating
+		newGame.Player1.Icon = clientGame.Player1.Icon
+		newGame.Player2.Icon = clientGame.Player2.Icon
+		newGame.allowed1 = clientGame.allowed1
+		newGame.allowed2 = clientGame.allowed2
+		s.games = append(s.games, newGame)
+
+		clientGame.client1 = nil
+		clientGame.client2 = nil
+		clientGame.spectators = nil
+
+		s.gamesLock.Unlock()
+
+		s.notifyMatchCreated(newGame)
+
+		{
+			ev1 := &bgammon.EventJoined{
+				GameID:       newGame.id,
+				PlayerNumber: 1,
+			}
+			ev1.Player = newGame.Player1.Name
+			ev2 := &bgammon.EventJoined{
+				GameID:       newGame.id,
+				PlayerNumber: 2,
+			}
+			ev2.Player = newGame.Player2.Name
+			newGame.client1.sendEvent(ev1)
+			newGame.client1.sendEvent(ev2)
+			newGame.sendBoard(newGame.client1, false)
+		}
 
-				cmd.client.sendNotice(fmt.Sprintf("Banned %s.", params[0]))
-				continue
+		{
+			ev1 := &bgammon.EventJoined{
+				GameID:       newGame.id,
+				PlayerNumber: 1,
 			}
-
-			var banned bool
-			s.clientsLock.Lock()
-			for _, sc := range s.clients {
-				if !bytes.Equal(bytes.ToLower(sc.name), bytes.ToLower(params[0])) {
-					continue
-				}
-				err := addBan(sc.Address(), 0, cmd.client.accountID, reason)
-				if err != nil {
-					cmd.client.sendNotice("Failed to add ban: " + err.Error())
-				}
-				sc.Client.Terminate(msg)
-				banned = true
-				break
+			ev1.Player = newGame.Player2.Name
+			ev2 := &bgammon.EventJoined{
+				GameID:       newGame.id,
+				PlayerNumber: 2,
 			}
-			s.clientsLock.Unlock()
+			ev2.Player = newGame.Player1.Name
+			newGame.client2.sendEvent(ev1)
+			newGame.client2.sendEvent(ev2)
+			newGame.sendBoard(newGame.client2, false)
+		}
 
-			account, err := accountByUsername(string(params[0]))
-			if err != nil || account == nil || account.id == 0 {
-				if banned {
-					cmd.client.sendNotice(fmt.Sprintf("Banned %s.", params[0]))
-				} else {
-					cmd.client.sendNotice("No users with that name are registered or connected.")
-				}
-				continue
-			}
+		for _, spectator := range newGame.spectators {
+			newGame.sendBoard(spectator, false)
+		}
+	} else {
+		clientGame.rematch = cmd.client.playerNumber
 
-			err = addBan("", account.id, cmd.client.accountID, reason)
-			if err != nil {
-				cmd.client.sendNotice("Failed to add ban: " + err.Error())
-			}
+		clientGame.opponent(cmd.client).sendNotice(gotext.GetD(clientGame.opponent(cmd.client).language, "Your opponent would like to play again."))
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Rematch offer sent."))
+		return
+	}
+}
 
-			s.clientsLock.Lock()
-			for _, sc := range s.clients {
-				if sc.accountID == account.id {
-					sc.Client.Terminate(msg)
-					break
-				}
-			}
-			s.clientsLock.Unlock()
+func (s *Server) handleFollowCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 1 {
+		cmd.sendNotice("Please specify a player: follow <username>")
+		return
+	} else if cmd.client.accountID == 0 {
+		cmd.sendNotice("Failed to follow player: Please log in before following.")
+		return
+	}
 
-			cmd.client.sendNotice(fmt.Sprintf("Banned %s.", params[0]))
-		case bgammon.CommandUnban:
-			if len(params) == 0 {
-				cmd.client.sendNotice("Please specify an IP address or username.")
-				continue
-			} else if !cmd.client.Admin() && !cmd.client.Mod() {
-				cmd.client.sendNotice("Access denied.")
-				continue
+	target, err := accountByUsername(string(params[0]))
+	if err != nil || target == nil || target.id == 0 {
+		cmd.sendNotice("Failed to follow player: Invalid username.")
+		return
+	} else if target.id == cmd.client.accountID {
+		cmd.sendNotice("Following yourself will get you nowhere quickly.")
+		return
+	}
+
+	err = setAccountFollows(cmd.client.accountID, target.id, true)
+	if err != nil {
+		cmd.sendNotice(fmt.Sprintf("You are already following %s.", target.username))
+		return
+	}
+	cmd.client.account.follows = append(cmd.client.account.follows, target.id)
+	cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "You are now following %s."), target.username))
+}
+
+func (s *Server) handleUnfollowCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 1 {
+		cmd.sendNotice("Please specify a player: unfollow <username>")
+		return
+	} else if cmd.client.accountID == 0 {
+		cmd.sendNotice("Failed to un-follow player: Please log in before un-following.")
+		return
+	}
+
+	target, err := accountByUsername(string(params[0]))
+	if err != nil || target == nil || target.id == 0 {
+		cmd.sendNotice("Failed to un-follow player: Invalid username.")
+		return
+	} else if target.id == cmd.client.accountID {
+		cmd.sendNotice("Un-following yourself will get you somewhere slowly.")
+		return
+	}
+
+	err = setAccountFollows(cmd.client.accountID, target.id, false)
+	if err != nil {
+		cmd.sendNotice(fmt.Sprintf("You are not following %s.", target.username))
+		return
+	}
+	cmd.client.account.follows = removeInt(cmd.client.account.follows, target.id)
+	cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "You are no longer following %s."), target.username))
+}
+
+func (s *Server) handleWhoCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	s.sendOnlineList(cmd.client, params)
+}
+
+func (s *Server) handleBoardCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	clientGame.sendBoard(cmd.client, false)
+}
+
+func (s *Server) handlePasswordCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if cmd.client.account == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to change password: you are logged in as a guest."))
+		return
+	} else if len(params) < 2 {
+		cmd.sendNotice("Please specify your old and new passwords as follows: password <old> <new>")
+		return
+	}
+
+	a, err := loginAccount(s.mailServer, s.passwordSalt, cmd.client.name, accountPassword(params[:1]))
+	var locked *lockedError
+	if errors.As(err, &locked) {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Too many failed login attempts. Please try again in %s or reset your password."), formatRemaining(cmd.client.language, locked.until)))
+		return
+	} else if err != nil || a == nil || a.id == 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to change password: incorrect existing password."))
+		return
+	}
+
+	err = setAccountPassword(s.passwordSalt, a.id, string(accountPassword(params[1:])))
+	if err != nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to change password."))
+		return
+	}
+	cmd.sendNotice(gotext.GetD(cmd.client.language, "Password changed successfully."))
+}
+
+func (s *Server) handleRegisterCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if cmd.client.accountID != 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You are already logged in to an account."))
+		return
+	} else if !cmd.client.registering.CompareAndSwap(false, true) {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Your account is already being registered."))
+		return
+	}
+	go func() {
+		if !s.handleRegisterGuest(cmd, params) {
+			cmd.client.registering.Store(false)
+		}
+	}()
+}
+
+func (s *Server) handleDeleteAccountCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	a := cmd.client.account
+	if a == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to delete account: you are logged in as a guest."))
+		return
+	} else if len(params) == 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Please confirm your password as follows: deleteaccount <password>"))
+		return
+	}
+
+	if len(params) == 1 && strings.ToLower(string(params[0])) == "cancel" {
+		if a.deletion == 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Your account is not scheduled to be deleted."))
+			return
+		}
+		err := scheduleAccountDeletion(a.id, 0)
+		if err != nil {
+			s.logger.Printf("failed to cancel account deletion: %s", err)
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to cancel account deletion."))
+			return
+		}
+		a.deletion = 0
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Account deletion cancelled."))
+		return
+	} else if a.deletion != 0 {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Your account will be deleted in %s. To cancel, send: deleteaccount cancel"), formatRemaining(cmd.client.language, a.deletion)))
+		return
+	}
+
+	verified, err := loginAccount(s.mailServer, s.passwordSalt, cmd.client.name, accountPassword(params))
+	var locked *lockedError
+	if errors.As(err, &locked) {
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Too many failed login attempts. Please try again in %s or reset your password."), formatRemaining(cmd.client.language, locked.until)))
+		return
+	} else if err != nil || verified == nil || verified.id != a.id {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to delete account: incorrect password."))
+		return
+	}
+
+	deletion := time.Now().Add(accountDeletionGrace).Unix()
+	err = scheduleAccountDeletion(a.id, deletion)
+	if err != nil {
+		s.logger.Printf("failed to schedule account deletion: %s", err)
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to delete account."))
+		return
+	}
+	a.deletion = deletion
+	cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Your account will be deleted in %s. To cancel, send: deleteaccount cancel"), formatRemaining(cmd.client.language, a.deletion)))
+}
+
+func (s *Server) handleTwoFactorCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	a := cmd.client.account
+	if a == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication is not available: you are logged in as a guest."))
+		return
+	}
+
+	var action string
+	if len(params) > 0 {
+		action = string(bytes.ToLower(params[0]))
+	}
+	var code string
+	if len(params) > 1 {
+		code = string(params[1])
+	}
+	switch action {
+	case "enable":
+		if a.totp != 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication is already enabled."))
+			return
+		}
+		secret := generateTOTPSecret()
+		err := setAccountTOTP(a.id, secret, 0, nil)
+		if err != nil {
+			s.logger.Printf("failed to set two-factor authentication secret: %s", err)
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to enable two-factor authentication."))
+			return
+		}
+		a.totpSecret = secret
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Two-factor authentication secret: %s"), secret))
+		cmd.sendNotice(totpURI(secret, string(a.username)))
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Add the secret (or the URI above) to your authenticator application, then confirm using the command: twofactor confirm <code>"))
+	case "confirm":
+		if a.totp != 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication is already enabled."))
+			return
+		} else if a.totpSecret == "" {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Please enable two-factor authentication first using the command: twofactor enable"))
+			return
+		} else if !validateTOTP(a.totpSecret, code, time.Now()) {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Invalid two-factor authentication code."))
+			return
+		}
+		codes := generateRecoveryCodes()
+		hashes := make([]string, len(codes))
+		for i := range codes {
+			hashes[i] = hashRecoveryCode(codes[i], s.passwordSalt)
+		}
+		now := time.Now().Unix()
+		err := setAccountTOTP(a.id, a.totpSecret, now, hashes)
+		if err != nil {
+			s.logger.Printf("failed to enable two-factor authentication: %s", err)
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to enable two-factor authentication."))
+			return
+		}
+		a.totp = now
+		cmd.client.staffDisabled = false
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication enabled. Store the following recovery codes in a safe place. Each code may be used once to log in without your authenticator application."))
+		for _, recoveryCode := range codes {
+			cmd.sendNotice(recoveryCode)
+		}
+	case "disable":
+		if a.totp == 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication is not enabled."))
+			return
+		}
+		if !validateTOTP(a.totpSecret, code, time.Now()) {
+			ok, _, err := useRecoveryCode(a.id, hashRecoveryCode(code, s.passwordSalt))
+			if err != nil || !ok {
+				cmd.sendNotice(gotext.GetD(cmd.client.language, "Invalid two-factor authentication code."))
+				return
 			}
+		}
+		err := setAccountTOTP(a.id, "", 0, nil)
+		if err != nil {
+			s.logger.Printf("failed to disable two-factor authentication: %s", err)
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to disable two-factor authentication."))
+			return
+		}
+		a.totpSecret, a.totp = "", 0
+		cmd.client.staffDisabled = s.requireStaffTwoFactor && cmd.client.roles() != 0
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication disabled."))
+	default:
+		if a.totp != 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication is enabled."))
+		} else {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Two-factor authentication is not enabled. Enable it using the command: twofactor enable"))
+		}
+	}
+}
 
-			isIP := bytes.ContainsRune(params[0], '.') || bytes.ContainsRune(params[0], ':')
-			if isIP {
-				err := deleteBan(s.hashIP(string(params[0])), 0)
-				if err != nil {
-					cmd.client.sendNotice("Failed to remove ban: " + err.Error())
-					continue
-				}
-			} else {
-				account, err := accountByUsername(string(params[0]))
-				if err != nil {
-					cmd.client.sendNotice("Failed to remove ban: " + err.Error())
-					continue
-				} else if account == nil || account.id == 0 {
-					cmd.client.sendNotice("No account was found with that username.")
-					continue
-				}
-				err = deleteBan("", account.id)
-				if err != nil {
-					cmd.client.sendNotice("Failed to remove ban: " + err.Error())
-					continue
-				}
+func (s *Server) handleAPITokenCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	a := cmd.client.account
+	if a == nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "API tokens are not available: you are logged in as a guest."))
+		return
+	}
+
+	var action string
+	if len(params) > 0 {
+		action = string(bytes.ToLower(params[0]))
+	}
+	switch action {
+	case "new":
+		token := generateAPIToken()
+		err := setAccountAPIToken(a.id, hashAPIToken(token, s.passwordSalt))
+		if err != nil {
+			s.logger.Printf("failed to set API token: %s", err)
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to create API token."))
+			return
+		}
+		cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "API token: %s"), token))
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Store the token in a safe place. It will not be shown again. Any previously created token has been revoked."))
+	case "revoke":
+		err := setAccountAPIToken(a.id, "")
+		if err != nil {
+			s.logger.Printf("failed to revoke API token: %s", err)
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to revoke API token."))
+			return
+		}
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "API token revoked."))
+	default:
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "To create a new API token, send: apitoken new. To revoke your API token, send: apitoken revoke"))
+	}
+}
+
+func (s *Server) handleSetCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 2 {
+		cmd.sendNotice("Please specify the setting name and value as follows: set <name> <value>")
+		return
+	}
+
+	name := string(bytes.ToLower(params[0]))
+	if name == "email" {
+		if cmd.client.account == nil {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to change email address: you are logged in as a guest."))
+			return
+		} else if len(params) < 3 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Please specify your new email address and password as follows: set email <address> <password>"))
+			return
+		}
+
+		a, err := loginAccount(s.mailServer, s.passwordSalt, cmd.client.name, accountPassword(params[2:]))
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Too many failed login attempts. Please try again in %s or reset your password."), formatRemaining(cmd.client.language, locked.until)))
+			return
+		} else if err != nil || a == nil || a.id != cmd.client.accountID {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to change email address: incorrect password."))
+			return
+		}
+
+		err = requestEmailChange(s.mailServer, s.resetSalt, a.id, params[1])
+		if err != nil {
+			cmd.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Failed to change email address: %s"), err))
+			return
+		}
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Confirmation links have been sent to your current and new email addresses. Your email address will be changed once the change is confirmed via both email addresses."))
+		return
+	}
+
+	settings := []string{"autoplay", "highlight", "pips", "moves", "flip", "traditional", "advanced", "mutejoinleave", "mutechat", "muteroll", "mutemove", "mutebearoff", "dim", "speed"}
+	var found bool
+	for i := range settings {
+		if name == settings[i] {
+			found = true
+			break
+		}
+	}
+	if !found {
+		cmd.sendNotice("Please specify the setting name and value as follows: set <name> <value>")
+		return
+	}
+
+	value, err := strconv.Atoi(string(params[1]))
+	minValue := 0
+	maxValue := 1
+	switch name {
+	case "dim":
+		maxValue = 2
+	case "speed":
+		maxValue = 3
+	}
+	if err != nil || value < minValue || value > maxValue {
+		cmd.sendNotice("Invalid setting value provided.")
+		return
+	}
+
+	if name == "autoplay" {
+		cmd.client.autoplay = value == 1
+	}
+
+	if cmd.client.account == nil {
+		return
+	}
+	_ = setAccountSetting(cmd.client.account.id, name, value)
+}
+
+func (s *Server) handleAchievementsCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	ev := &bgammon.EventAchievements{}
+	for id, info := range Achievements {
+		ev.Achievements = append(ev.Achievements, &bgammon.EventAchievement{ID: id, Name: gotext.GetD(cmd.client.language, info[0]), Description: gotext.GetD(cmd.client.language, info[1])})
+	}
+	cmd.sendEvent(ev)
+}
+
+func (s *Server) handleHistoryCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Please specify the player as follows: history <username>")
+		return
+	}
+	const historyPageSize = 50
+
+	page := 1
+	if len(params) > 1 {
+		p, err := strconv.Atoi(string(params[1]))
+		if err == nil && p >= 1 {
+			page = p
+		}
+	}
+
+	matches, err := matchHistory(string(params[0]))
+	if err != nil {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Invalid username provided."))
+		return
+	} else if clientGame != nil {
+		if cmd.client.playerNumber == 1 {
+			clientGame.rejoin1 = false
+		} else {
+			clientGame.rejoin2 = false
+		}
+		clientGame.removeClient(cmd.client)
+	}
+
+	pages := (len(matches) / historyPageSize)
+	if pages == 0 {
+		pages = 1
+	}
+
+	ev := &bgammon.EventHistory{
+		Page:  page,
+		Pages: pages,
+	}
+	if len(matches) > 0 && page <= pages {
+		max := page * historyPageSize
+		if max > len(matches) {
+			max = len(matches)
+		}
+		ev.Matches = matches[(page-1)*historyPageSize : max]
+	}
+
+	ev.Player = string(params[0])
+	a, err := accountByUsername(string(params[0]))
+	if err == nil && a != nil {
+		ev.CasualBackgammonSingle = a.casual.backgammonSingle / 100
+		ev.CasualBackgammonMulti = a.casual.backgammonMulti / 100
+		ev.CasualAceyDeuceySingle = a.casual.aceySingle / 100
+		ev.CasualAceyDeuceyMulti = a.casual.aceyMulti / 100
+		ev.CasualTabulaSingle = a.casual.tabulaSingle / 100
+		ev.CasualTabulaMulti = a.casual.tabulaMulti / 100
+
+		ev.Achievements = make([]*bgammon.HistoryAchievement, len(a.achievementIDs))
+		for i := range a.achievementIDs {
+			ev.Achievements[i] = &bgammon.HistoryAchievement{
+				ID:        a.achievementIDs[i],
+				Replay:    a.achievementGames[i],
+				Timestamp: a.achievementDates[i],
 			}
-			cmd.client.sendNotice(fmt.Sprintf("Unbanned %s.", params[0]))
-		case bgammon.CommandShutdown:
-			if !cmd.client.Admin() {
-				cmd.client.sendNotice("Access denied.")
-				continue
-			} else if len(params) < 2 {
-				cmd.client.sendNotice("Please specify the number of minutes until shutdown and the reason.")
-				continue
-			} else if !s.shutdownTime.IsZero() {
-				cmd.client.sendNotice("Server shutdown already in progress.")
-				continue
+		}
+	}
+	cmd.sendEvent(ev)
+}
+
+func (s *Server) handleReplayCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	var (
+		id     int
+		replay []byte
+		err    error
+	)
+	if len(params) == 0 {
+		if clientGame == nil || clientGame.Winner == 0 {
+			cmd.sendNotice("Please specify the game as follows: replay <id>")
+			return
+		}
+		id = -1
+		replay = bytes.Join(clientGame.replay, []byte("\n"))
+	} else {
+		id, err = strconv.Atoi(string(params[0]))
+		if err != nil || id < 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Invalid replay ID provided."))
+			return
+		}
+		replay, err = replayByID(id)
+		if err != nil {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "Invalid replay ID provided."))
+			return
+		}
+	}
+	if len(replay) == 0 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "No replay was recorded for that game."))
+		return
+	} else if clientGame != nil {
+		if cmd.client.playerNumber == 1 {
+			clientGame.rejoin1 = false
+		} else {
+			clientGame.rejoin2 = false
+		}
+		clientGame.removeClient(cmd.client)
+	}
+	cmd.sendEvent(&bgammon.EventReplay{
+		ID:      id,
+		Content: replay,
+	})
+}
+
+func (s *Server) handlePongCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+}
+
+func (s *Server) handleDisconnectCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if clientGame != nil {
+		clientGame.removeClient(cmd.client)
+	}
+	cmd.client.Terminate("Client disconnected")
+}
+
+func (s *Server) handleMOTDCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Message of the day:")
+		s.sendMOTD(cmd.client)
+		return
+	}
+
+	motd := bytes.Join(params, []byte(" "))
+	if bytes.Equal(bytes.ToLower(motd), clearBytes) {
+		motd = nil
+	}
+	s.motd = string(motd)
+	s.recordAudit(cmd.client, keyword, "", s.motd)
+	cmd.sendNotice("MOTD updated.")
+}
+
+func (s *Server) handleBroadcastCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Please specify a message to broadcast.")
+		return
+	}
+
+	message := string(bytes.Join(params, []byte(" ")))
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		sc.sendBroadcast(message)
+	}
+	s.clientsLock.Unlock()
+	s.recordAudit(cmd.client, keyword, "", message)
+}
+
+func (s *Server) handleDefconCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice(fmt.Sprintf("Current DEFCON level: %d.", s.defconLevel()))
+		return
+	}
+
+	v, err := strconv.Atoi(string(params[0]))
+	if err != nil || v < 1 || v > 5 {
+		cmd.sendNotice("Failed to update DEFCON level: invalid level.")
+		return
+	} else if v == s.defconLevel() {
+		cmd.sendNotice("Failed to update DEFCON level: already at specified DEFCON level.")
+		return
+	}
+
+	s.defcon.Store(int32(v))
+	s.autoDefcon.manual()
+	s.recordAudit(cmd.client, keyword, strconv.Itoa(v), "")
+	cmd.sendNotice(fmt.Sprintf("Updated DEFCON level to %d.", v))
+
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		sc.sendDefconWarning(v)
+	}
+	s.clientsLock.Unlock()
+}
+
+func (s *Server) handleRenameCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 2 {
+		cmd.sendNotice("Please specify the account's current username and a new username.")
+		return
+	}
+	oldUsername := strings.ToLower(string(params[0]))
+	newUsername := strings.ToLower(string(params[1]))
+
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if bytes.Equal(bytes.ToLower(sc.name), []byte(oldUsername)) {
+			sc.disconnect("Renaming account.")
+			break
+		}
+	}
+	s.clientsLock.Unlock()
+
+	oldAccount, err := accountByUsername(oldUsername)
+	if err != nil {
+		oldAccount = nil
+	}
+	if oldAccount == nil {
+		cmd.sendNotice("No account was found with that username.")
+		return
+	}
+
+	newAccount, err := accountByUsername(newUsername)
+	if err != nil {
+		newAccount = nil
+	}
+	if newAccount != nil {
+		cmd.sendNotice("An account already exists with that username.")
+		return
+	}
+
+	err = renameAccount(oldAccount.id, oldUsername, newUsername)
+	if err != nil {
+		cmd.sendNotice(fmt.Sprintf("Failed to rename account %s: %s", oldUsername, err))
+		return
+	}
+	s.recordAudit(cmd.client, keyword, oldUsername, newUsername)
+	cmd.sendNotice(fmt.Sprintf("Renamed account %s.", params[0]))
+}
+
+func (s *Server) handleKickCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Please specify a username.")
+		return
+	}
+
+	var reason string
+	if len(params) > 1 {
+		reason = string(bytes.Join(params[1:], []byte(" ")))
+	}
+
+	msg := "Kicked"
+	if reason != "" {
+		msg += ": " + reason
+	}
+
+	var found bool
+	nameLower := bytes.ToLower(params[0])
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if bytes.Equal(bytes.ToLower(sc.name), nameLower) {
+			found = true
+			sc.disconnect(msg)
+			break
+		}
+	}
+	s.clientsLock.Unlock()
+
+	if !found {
+		cmd.sendNotice("No client was found with that username.")
+	} else {
+		s.recordAudit(cmd.client, keyword, string(params[0]), reason)
+		cmd.sendNotice(fmt.Sprintf("Kicked %s.", params[0]))
+	}
+}
+
+func (s *Server) handleBanCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Please specify an IP address, network or username.")
+		return
+	}
+
+	var expires int64
+	var duration string
+	reasonStart := 1
+	if len(params) > 1 {
+		d, ok := parseDuration(string(params[1]))
+		if ok {
+			expires = time.Now().Add(d).Unix()
+			duration = string(params[1])
+			reasonStart = 2
+		}
+	}
+
+	var reason string
+	if len(params) > reasonStart {
+		reason = string(bytes.Join(params[reasonStart:], []byte(" ")))
+	}
+	auditReason := strings.TrimSpace(duration + " " + reason)
+
+	banMessage := func(sc *serverClient) string {
+		msg := gotext.GetD(sc.language, "You are banned")
+		if expires != 0 {
+			msg = fmt.Sprintf(gotext.GetD(sc.language, "You are banned for %s"), formatRemaining(sc.language, expires))
+		}
+		if reason != "" {
+			msg += ": " + reason
+		}
+		return msg
+	}
+
+	isIP := bytes.ContainsRune(params[0], '.') || bytes.ContainsRune(params[0], ':')
+	if isIP {
+		var ip string
+		if bytes.ContainsRune(params[0], '/') {
+			var err error
+			ip, err = s.hashNetwork(string(params[0]))
+			if err != nil {
+				cmd.sendNotice("Failed to add ban: " + err.Error())
+				return
 			}
+		} else {
+			ip = s.hashIP(string(params[0]))
+		}
+		err := addBan(ip, 0, cmd.client.accountID, reason, expires)
+		if err != nil {
+			cmd.sendNotice("Failed to add ban: " + err.Error())
+		}
 
-			minutes, err := strconv.Atoi(string(params[0]))
-			if err != nil || minutes <= 0 {
-				cmd.client.sendNotice("Error: Invalid shutdown delay.")
-				continue
+		s.clientsLock.Lock()
+		for _, sc := range s.clients {
+			if slices.Contains(sc.addresses, ip) {
+				sc.disconnect(banMessage(sc))
 			}
+		}
+		s.clientsLock.Unlock()
 
-			s.shutdown(time.Duration(minutes)*time.Minute, string(bytes.Join(params[1:], []byte(" "))))
-		case "endgame":
-			if !s.debug {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not allowed to use that command."))
-				continue
-			} else if clientGame == nil {
-				cmd.client.sendNotice(gotext.GetD(cmd.client.language, "You are not currently in a match."))
-				continue
+		s.recordAudit(cmd.client, keyword, string(params[0]), auditReason)
+		cmd.sendNotice(fmt.Sprintf("Banned %s.", params[0]))
+		return
+	}
+
+	var banned bool
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if !bytes.Equal(bytes.ToLower(sc.name), bytes.ToLower(params[0])) {
+			continue
+		}
+		err := addBan(sc.Address(), 0, cmd.client.accountID, reason, expires)
+		if err != nil {
+			cmd.sendNotice("Failed to add ban: " + err.Error())
+		}
+		sc.disconnect(banMessage(sc))
+		banned = true
+		break
+	}
+	s.clientsLock.Unlock()
+
+	account, err := accountByUsername(string(params[0]))
+	if err != nil || account == nil || account.id == 0 {
+		if banned {
+			s.recordAudit(cmd.client, keyword, string(params[0]), auditReason)
+			cmd.sendNotice(fmt.Sprintf("Banned %s.", params[0]))
+		} else {
+			cmd.sendNotice("No users with that name are registered or connected.")
+		}
+		return
+	}
+
+	err = addBan("", account.id, cmd.client.accountID, reason, expires)
+	if err != nil {
+		cmd.sendNotice("Failed to add ban: " + err.Error())
+	}
+
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if sc.accountID == account.id {
+			sc.disconnect(banMessage(sc))
+			break
+		}
+	}
+	s.clientsLock.Unlock()
+
+	s.recordAudit(cmd.client, keyword, string(params[0]), auditReason)
+	cmd.sendNotice(fmt.Sprintf("Banned %s.", params[0]))
+}
+
+func (s *Server) handleUnbanCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Please specify an IP address, network or username.")
+		return
+	}
+
+	isIP := bytes.ContainsRune(params[0], '.') || bytes.ContainsRune(params[0], ':')
+	if isIP {
+		ip := s.hashIP(string(params[0]))
+		if bytes.ContainsRune(params[0], '/') {
+			var err error
+			ip, err = s.hashNetwork(string(params[0]))
+			if err != nil {
+				cmd.sendNotice("Failed to remove ban: " + err.Error())
+				return
 			}
+		}
+		err := deleteBan(ip, 0)
+		if err != nil {
+			cmd.sendNotice("Failed to remove ban: " + err.Error())
+			return
+		}
+	} else {
+		account, err := accountByUsername(string(params[0]))
+		if err != nil {
+			cmd.sendNotice("Failed to remove ban: " + err.Error())
+			return
+		} else if account == nil || account.id == 0 {
+			cmd.sendNotice("No account was found with that username.")
+			return
+		}
+		err = deleteBan("", account.id)
+		if err != nil {
+			cmd.sendNotice("Failed to remove ban: " + err.Error())
+			return
+		}
+	}
+	s.recordAudit(cmd.client, keyword, string(params[0]), "")
+	cmd.sendNotice(fmt.Sprintf("Unbanned %s.", params[0]))
+}
 
-			clientGame.Turn = 1
-			clientGame.Roll1 = 5
-			clientGame.Roll2 = 5
-			clientGame.Roll3 = 0
-			clientGame.Variant = bgammon.VariantBackgammon
-			clientGame.Player1.Entered = true
-			clientGame.Player2.Entered = true
-			clientGame.Board = []int8{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, -1, 0, 0, 0, 0}
+func (s *Server) handleMuteCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 2 {
+		cmd.sendNotice("Please specify a username and duration as follows: mute <username> <duration> [reason]")
+		return
+	}
 
-			log.Println(clientGame.Board[0:28])
+	d, ok := parseDuration(string(params[1]))
+	if !ok {
+		cmd.sendNotice("Invalid duration. Specify a number followed by m (minutes), h (hours), d (days) or w (weeks).")
+		return
+	}
+	expires := time.Now().Add(d).Unix()
 
-			clientGame.eachClient(func(client *serverClient) {
-				clientGame.sendBoard(client, false)
-			})
-		default:
-			log.Printf("Received unknown command from client %s: %s", cmd.client.label(), cmd.command)
-			cmd.client.sendNotice(fmt.Sprintf(gotext.GetD(cmd.client.language, "Unknown command: %s"), cmd.command))
+	var reason string
+	if len(params) > 2 {
+		reason = string(bytes.Join(params[2:], []byte(" ")))
+	}
+
+	var muted bool
+	nameLower := bytes.ToLower(params[0])
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if !bytes.Equal(bytes.ToLower(sc.name), nameLower) {
+			continue
+		}
+		ipHash := sc.Address()
+		if sc.accountID > 0 {
+			ipHash = ""
+		}
+		err := addMute(ipHash, sc.accountID, cmd.client.accountID, reason, expires)
+		if err != nil {
+			cmd.sendNotice("Failed to add mute: " + err.Error())
+		}
+		sc.muted, sc.muteReason = expires, reason
+		sc.sendNotice(fmt.Sprintf(gotext.GetD(sc.language, "You have been muted for %s."), formatRemaining(sc.language, expires)))
+		muted = true
+		break
+	}
+	s.clientsLock.Unlock()
+
+	if !muted {
+		account, err := accountByUsername(string(params[0]))
+		if err != nil || account == nil || account.id == 0 {
+			cmd.sendNotice("No users with that name are registered or connected.")
+			return
+		}
+		err = addMute("", account.id, cmd.client.accountID, reason, expires)
+		if err != nil {
+			cmd.sendNotice("Failed to add mute: " + err.Error())
+			return
+		}
+	}
+
+	s.recordAudit(cmd.client, keyword, string(params[0]), strings.TrimSpace(string(params[1])+" "+reason))
+	cmd.sendNotice(fmt.Sprintf("Muted %s.", params[0]))
+}
+
+func (s *Server) handleUnmuteCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) == 0 {
+		cmd.sendNotice("Please specify a username.")
+		return
+	}
+
+	var found bool
+	nameLower := bytes.ToLower(params[0])
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if !bytes.Equal(bytes.ToLower(sc.name), nameLower) {
+			continue
+		}
+		err := deleteMute(sc.Address(), sc.accountID)
+		if err != nil {
+			cmd.sendNotice("Failed to remove mute: " + err.Error())
+		}
+		if sc.muted != 0 {
+			sc.muted, sc.muteReason = 0, ""
+			sc.sendNotice(gotext.GetD(sc.language, "You are no longer muted."))
 		}
+		found = true
+		break
 	}
+	s.clientsLock.Unlock()
+
+	if !found {
+		account, err := accountByUsername(string(params[0]))
+		if err != nil || account == nil || account.id == 0 {
+			cmd.sendNotice("No users with that name are registered or connected.")
+			return
+		}
+		err = deleteMute("", account.id)
+		if err != nil {
+			cmd.sendNotice("Failed to remove mute: " + err.Error())
+			return
+		}
+	}
+
+	s.recordAudit(cmd.client, keyword, string(params[0]), "")
+	cmd.sendNotice(fmt.Sprintf("Unmuted %s.", params[0]))
+}
+
+func (s *Server) handleShutdownCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 2 {
+		cmd.sendNotice("Please specify the number of minutes until shutdown and the reason.")
+		return
+	} else if !s.shutdownTime.IsZero() {
+		cmd.sendNotice("Server shutdown already in progress.")
+		return
+	}
+
+	minutes, err := strconv.Atoi(string(params[0]))
+	if err != nil || minutes <= 0 {
+		cmd.sendNotice("Error: Invalid shutdown delay.")
+		return
+	}
+
+	reason := string(bytes.Join(params[1:], []byte(" ")))
+	s.shutdown(time.Duration(minutes)*time.Minute, reason)
+	s.recordAudit(cmd.client, keyword, strconv.Itoa(minutes), reason)
+}
+
+func (s *Server) handleRoleCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 2 {
+		cmd.sendNotice(fmt.Sprintf("Please specify a username and role as follows: %s <username> <admin/mod/td>", keyword))
+		return
+	}
+	grant := keyword == bgammon.CommandGrant
+
+	role := roleNames[strings.ToLower(string(params[1]))]
+	if role == 0 {
+		cmd.sendNotice("Invalid role. Available roles: admin, mod and td.")
+		return
+	}
+
+	account, err := accountByUsername(string(params[0]))
+	if err != nil || account == nil || account.id == 0 {
+		cmd.sendNotice("No account was found with that username.")
+		return
+	}
+
+	err = setAccountRole(account.id, role, grant)
+	if err != nil {
+		cmd.sendNotice(fmt.Sprintf("Failed to update roles of account %s: %s", account.username, err))
+		return
+	}
+
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if sc.accountID != account.id || sc.account == nil {
+			continue
+		}
+		if grant {
+			sc.account.roles |= role
+		} else {
+			sc.account.roles &^= role
+		}
+	}
+	s.clientsLock.Unlock()
+
+	s.recordAudit(cmd.client, keyword, string(account.username), strings.ToLower(string(params[1])))
+	if grant {
+		cmd.sendNotice(fmt.Sprintf("Granted role %s to %s.", strings.ToLower(string(params[1])), account.username))
+	} else {
+		cmd.sendNotice(fmt.Sprintf("Revoked role %s from %s.", strings.ToLower(string(params[1])), account.username))
+	}
+}
+
+func (s *Server) handleAuditCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	const auditPageSize = 25
+
+	var filter string
+	page := 1
+	for _, param := range params {
+		p, err := strconv.Atoi(string(param))
+		if err == nil && p >= 1 {
+			page = p
+		} else {
+			filter = string(param)
+		}
+	}
+
+	entries, err := auditLog(filter, (page-1)*auditPageSize, auditPageSize)
+	if err != nil {
+		cmd.sendNotice(fmt.Sprintf("Failed to retrieve audit log: %s", err))
+		return
+	} else if len(entries) == 0 {
+		cmd.sendNotice("No staff actions were found.")
+		return
+	}
+	cmd.sendNotice(fmt.Sprintf("Staff actions (page %d):", page))
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %s %s", time.Unix(entry.Timestamp, 0).In(s.tz).Format("2006-01-02 15:04"), entry.Staff, entry.Action)
+		if entry.Target != "" {
+			line += " " + entry.Target
+		}
+		if entry.Reason != "" {
+			line += ": " + entry.Reason
+		}
+		cmd.sendNotice(line)
+	}
+}
+
+func (s *Server) handleReportCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	if len(params) < 2 {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Please specify a username and reason as follows: report <username> <reason>"))
+		return
+	}
+	now := time.Now().Unix()
+	if now-cmd.client.lastReport < reportInterval {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Please wait before submitting another report."))
+		return
+	} else if bytes.EqualFold(params[0], cmd.client.name) {
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "You may not report yourself."))
+		return
+	}
+
+	var targetName []byte
+	var targetAccount int
+	var targetGame *serverGame
+	s.clientsLock.Lock()
+	target := s.clientByUsername(params[0])
+	s.clientsLock.Unlock()
+	if target != nil {
+		targetName, targetAccount = target.name, target.accountID
+		targetGame = s.gameByClient(target)
+	} else {
+		a, err := accountByUsername(string(params[0]))
+		if err != nil || a == nil || a.id == 0 {
+			cmd.sendNotice(gotext.GetD(cmd.client.language, "No users with that name are registered or connected."))
+			return
+		}
+		targetName, targetAccount = a.username, a.id
+	}
+
+	r := &playerReport{
+		Reporter: string(cmd.client.name),
+		Target:   string(targetName),
+		Reason:   string(bytes.Join(params[1:], []byte(" "))),
+	}
+	reportGame := clientGame
+	if reportGame == nil {
+		reportGame = targetGame
+	}
+	if reportGame != nil {
+		r.Game = reportGame.id
+		r.Replay = reportGame.replaySnapshot()
+		r.Chat = bytes.Join(reportGame.chat, []byte("\n"))
+	}
+	id, err := addReport(r, cmd.client.accountID, targetAccount)
+	if err != nil {
+		s.logger.Printf("failed to add report: %s", err)
+		cmd.sendNotice(gotext.GetD(cmd.client.language, "Failed to submit report."))
+		return
+	}
+	cmd.client.lastReport = now
+
+	s.logger.Printf("%s reported %s (report %d): %s", r.Reporter, r.Target, id, r.Reason)
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if s.allowed(sc, bgammon.CommandReports) {
+			sc.sendNotice(fmt.Sprintf("New report #%d: %s reported %s: %s", id, r.Reporter, r.Target, r.Reason))
+		}
+	}
+	s.clientsLock.Unlock()
+	cmd.sendNotice(gotext.GetD(cmd.client.language, "Thank you. Your report has been submitted to the server staff."))
+}
+
+func (s *Server) handleReportsCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	const reportsPageSize = 25
+
+	var action string
+	if len(params) > 0 {
+		action = string(bytes.ToLower(params[0]))
+	}
+	switch action {
+	case "view":
+		var id int
+		if len(params) > 1 {
+			id, _ = strconv.Atoi(string(params[1]))
+		}
+		r, err := playerReportByID(id)
+		if err != nil {
+			cmd.sendNotice(fmt.Sprintf("Failed to retrieve report: %s", err))
+			return
+		} else if r == nil {
+			cmd.sendNotice("No report was found with that ID.")
+			return
+		}
+		cmd.sendNotice(s.formatReport(r))
+		cmd.sendNotice("Reason: " + r.Reason)
+		if r.Status == reportResolved {
+			cmd.sendNotice("Resolution: " + r.Resolution)
+		}
+		if r.Game == 0 {
+			return
+		}
+		cmd.sendNotice("Chat:")
+		if len(r.Chat) > 0 {
+			for _, line := range bytes.Split(r.Chat, []byte("\n")) {
+				cmd.sendNotice(string(line))
+			}
+		}
+		cmd.sendNotice("Replay:")
+		for _, line := range bytes.Split(r.Replay, []byte("\n")) {
+			cmd.sendNotice(string(line))
+		}
+	case "claim", "resolve":
+		var id int
+		if len(params) > 1 {
+			id, _ = strconv.Atoi(string(params[1]))
+		}
+		if id <= 0 || (action == "resolve" && len(params) < 3) {
+			cmd.sendNotice("Please specify a report ID as follows: reports claim <id> / reports resolve <id> <resolution>")
+			return
+		}
+		status := reportClaimed
+		var resolution string
+		if action == "resolve" {
+			status = reportResolved
+			resolution = string(bytes.Join(params[2:], []byte(" ")))
+		}
+		ok, err := updatePlayerReport(id, cmd.client.accountID, status, resolution)
+		if err != nil {
+			cmd.sendNotice(fmt.Sprintf("Failed to update report: %s", err))
+			return
+		} else if !ok {
+			cmd.sendNotice("No unresolved report was found with that ID.")
+			return
+		}
+		s.recordAudit(cmd.client, keyword+" "+action, strconv.Itoa(id), resolution)
+		cmd.sendNotice(fmt.Sprintf("Report #%d marked as %s.", id, reportStatusNames[status]))
+	default:
+		status := reportOpen
+		page := 1
+		for _, param := range params {
+			p, err := strconv.Atoi(string(param))
+			if err == nil && p >= 1 {
+				page = p
+				continue
+			}
+			switch string(bytes.ToLower(param)) {
+			case "claimed":
+				status = reportClaimed
+			case "resolved":
+				status = reportResolved
+			case "all":
+				status = -1
+			}
+		}
+		reports, err := playerReports(status, (page-1)*reportsPageSize, reportsPageSize)
+		if err != nil {
+			cmd.sendNotice(fmt.Sprintf("Failed to retrieve reports: %s", err))
+			return
+		} else if len(reports) == 0 {
+			cmd.sendNotice("No reports were found.")
+			return
+		}
+		cmd.sendNotice(fmt.Sprintf("Reports (page %d):", page))
+		for _, r := range reports {
+			cmd.sendNotice(s.formatReport(r) + ": " + r.Reason)
+		}
+	}
+}
+
+func (s *Server) handleEndgameCommand(cmd serverCommand, keyword string, params [][]byte, clientGame *serverGame) {
+	clientGame.Turn = 1
+	clientGame.Roll1 = 5
+	clientGame.Roll2 = 5
+	clientGame.Roll3 = 0
+	clientGame.Variant = bgammon.VariantBackgammon
+	clientGame.Player1.Entered = true
+	clientGame.Player2.Entered = true
+	clientGame.Board = []int8{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, -1, 0, 0, 0, 0}
+
+	s.logger.Println(clientGame.Board[0:28])
+
+	clientGame.eachClient(func(client *serverClient) {
+		clientGame.sendBoard(client, false)
+	})
 }
 
 func removeInt(s []int, v int) []int {
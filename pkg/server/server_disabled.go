@@ -3,11 +3,13 @@
 package server
 
 import (
-	"log"
+	"fmt"
 )
 
-func (s *server) Listen(network string, address string) {
-	log.Fatal("bgammon-server was built without the 'full' tag. Only local connections are possible.")
+// Listen listens for connections on the specified address. Servers built
+// without the 'full' tag only accept local connections.
+func (s *Server) Listen(network string, address string) error {
+	return fmt.Errorf("bgammon-server was built without the 'full' tag. Only local connections are possible.")
 }
 
 func hashIP(address string) string {
@@ -5,8 +5,8 @@ package server
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"strconv"
@@ -17,54 +17,126 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func (s *server) Listen(network string, address string) {
-	if s.passwordSalt == "" || s.resetSalt == "" || s.ipAddressSalt == "" {
-		log.Fatal("error: password, reset and ip salts must be configured before listening for remote clients")
+// Listen listens for connections on the specified address. The network may be
+// tcp (or tcp4 and tcp6), tls (TCP with TLS), ws (WebSocket) or http (WebSocket
+// without TLS, for use behind a reverse proxy). The tls and ws networks require
+// a certificate. The server must be started first.
+func (s *Server) Listen(network string, address string) error {
+	if !s.started {
+		return fmt.Errorf("server not started")
+	} else if s.passwordSalt == "" || s.resetSalt == "" || s.ipAddressSalt == "" {
+		return fmt.Errorf("password, reset and ip salts must be configured before listening for remote clients")
 	}
 
-	if strings.ToLower(network) == "ws" {
-		go s.listenWebSocket(address)
-		return
+	network = strings.ToLower(network)
+	transport, secure := transportTCP, false
+	switch network {
+	case "ws":
+		transport, secure = transportWebSocket, true
+		network = "tcp"
+	case "http":
+		transport = transportWebSocket
+		network = "tcp"
+	case "tls":
+		transport, secure = transportTLS, true
+		network = "tcp"
+	}
+
+	var config *tls.Config
+	if secure || (transport == transportTCP && s.startTLS) {
+		var err error
+		config, err = s.tlsConfig()
+		if err != nil {
+			return err
+		}
 	}
 
-	log.Printf("Listening for %s connections on %s...", strings.ToUpper(network), address)
 	listener, err := net.Listen(network, address)
 	if err != nil {
-		log.Fatalf("failed to listen on %s: %s", address, err)
+		return fmt.Errorf("failed to listen on %s: %s", address, err)
+	}
+
+	if transport == transportWebSocket {
+		s.listenWebSocket(listener, config)
+		return nil
 	}
-	go s.handleListener(listener)
+
+	if transport == transportTLS {
+		s.logger.Printf("Listening for TLS connections on %s...", address)
+	} else {
+		s.logger.Printf("Listening for %s connections on %s...", strings.ToUpper(network), address)
+	}
+	s.listenersLock.Lock()
 	s.listeners = append(s.listeners, listener)
+	s.listenersLock.Unlock()
+	go s.handleListener(listener, transport, config)
+	return nil
 }
 
-func (s *server) handleListener(listener net.Listener) {
+// handleListener accepts connections to a TCP listener. Connections to TLS
+// listeners are secured using config. Otherwise, config is used when clients
+// upgrade their connection using the starttls command.
+func (s *Server) handleListener(listener net.Listener, transport string, config *tls.Config) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatalf("failed to accept connection: %s", err)
+			if s.stopping() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Printf("failed to accept connection: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
 		}
-		go s.handleConnection(conn)
+		go s.acceptConnection(conn, transport, config)
 	}
 }
 
-func (s *server) addCORSHeader(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+func (s *Server) acceptConnection(conn net.Conn, transport string, config *tls.Config) {
+	if s.proxyProtocol && s.trustedProxy(conn.RemoteAddr().String()) {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			s.logger.Printf("failed to accept connection from proxy %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+	if !s.connections.allow(s.hashIP(conn.RemoteAddr().String())) {
+		conn.Close()
+		return
+	}
+
+	startTLS := config
+	if transport == transportTLS {
+		conn, startTLS = tls.Server(conn, config), nil
+	}
+	s.handleConnection(conn, transport, startTLS)
+}
+
+func (s *Server) addCORSHeader(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		f(w, r)
 	}
 }
 
-func (s *server) listenWebSocket(address string) {
-	log.Printf("Listening for WebSocket connections on %s...", address)
-
+// newRouter returns the handler of WebSocket and HTTP requests.
+func (s *Server) newRouter() *mux.Router {
 	m := mux.NewRouter()
 	handle := func(path string, f func(http.ResponseWriter, *http.Request)) *mux.Route {
 		return m.HandleFunc(path, s.addCORSHeader(f))
 	}
 
 	handle("/reset/{id:[0-9]+}/{key:[A-Za-z0-9]+}", s.handleResetPassword)
+	handle("/confirm/{id:[0-9]+}/{key:[A-Za-z0-9]+}", s.handleConfirmEmail)
+	handle("/email/{id:[0-9]+}/{key:[A-Za-z0-9]+}", s.handleConfirmEmailChange)
 	handle("/match/{id:[0-9]+}", s.handleMatch)
+	handle("/match/{id:[0-9]+}/live", s.handleMatchFeed)
 	handle("/dice", s.handleDiceStats)
 	handle("/matches.json", s.handleListMatches)
+	handle("/online.json", s.handleListOnline)
+	handle("/audit.json", s.handleAudit)
+	handle("/export.json", s.handleExport)
 	handle("/leaderboard-casual-backgammon-single.json", s.handleLeaderboardFunc(matchTypeCasual, bgammon.VariantBackgammon, false))
 	handle("/leaderboard-casual-backgammon-multi.json", s.handleLeaderboardFunc(matchTypeCasual, bgammon.VariantBackgammon, true))
 	handle("/leaderboard-casual-acey-single.json", s.handleLeaderboardFunc(matchTypeCasual, bgammon.VariantAceyDeucey, false))
@@ -89,30 +161,55 @@ func (s *server) listenWebSocket(address string) {
 	handle("/stats/{username:[A-Za-z0-9_\\-]+}/backgammon.json", s.handleAccountStatsFunc(matchTypeCasual, bgammon.VariantBackgammon))
 	handle("/stats/{username:[A-Za-z0-9_\\-]+}/acey.json", s.handleAccountStatsFunc(matchTypeCasual, bgammon.VariantAceyDeucey))
 	handle("/stats/{username:[A-Za-z0-9_\\-]+}/tabula.json", s.handleAccountStatsFunc(matchTypeCasual, bgammon.VariantTabula))
+	s.handleAPI(handle)
 	handle("/", s.handleWebSocket)
+	return m
+}
 
+func (s *Server) listenWebSocket(listener net.Listener, config *tls.Config) {
 	server := &http.Server{
-		Addr:    address,
-		Handler: m,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
+		Handler:   s.newRouter(),
+		TLSConfig: config,
+		ErrorLog:  s.logger,
 	}
-
-	err := server.ListenAndServeTLS(s.certFile, s.certKey)
-	log.Fatalf("failed to listen on %s: %s", address, err)
+	s.listenersLock.Lock()
+	s.httpServers = append(s.httpServers, server)
+	s.listenersLock.Unlock()
+
+	if config != nil {
+		s.logger.Printf("Listening for WebSocket connections on %s...", listener.Addr())
+	} else {
+		s.logger.Printf("Listening for WebSocket connections (without TLS) on %s...", listener.Addr())
+	}
+	go func() {
+		var err error
+		if config != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Printf("failed to serve WebSocket connections on %s: %s", listener.Addr(), err)
+		}
+	}()
 }
 
-func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.connections.allow(s.hashIP(s.requestAddress(r))) {
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+
 	const bufferSize = 8
 	commands := make(chan []byte, bufferSize)
 	events := make(chan []byte, bufferSize)
 
-	wsClient := newWebSocketClient(r, w, commands, events, s.verbose)
+	wsClient := newWebSocketClient(r, w, commands, events, s.verboseLogger())
 	if wsClient == nil {
 		return
 	}
-	wsClient.address = s.hashIP(r.RemoteAddr)
+	addresses := s.hashIPPrefixes(s.requestAddress(r))
+	wsClient.address = addresses[0]
 
 	now := time.Now().Unix()
 
@@ -123,17 +220,20 @@ func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		connected: now,
 		active:    now,
 		commands:  commands,
+		events:    events,
+		transport: transportWebSocket,
+		addresses: addresses,
 		Client:    wsClient,
 	}
 	s.handleClient(c)
 }
 
-func (s *server) cachedMatches() []byte {
+func (s *Server) cachedMatches() ([]byte, error) {
 	s.gamesCacheLock.Lock()
 	defer s.gamesCacheLock.Unlock()
 
 	if time.Since(s.gamesCacheTime) < 5*time.Second {
-		return s.gamesCache
+		return s.gamesCache, nil
 	}
 
 	s.gamesLock.Lock()
@@ -148,20 +248,39 @@ func (s *server) cachedMatches() []byte {
 		games = append(games, listing)
 	}
 
-	s.gamesCacheTime = time.Now()
 	if len(games) == 0 {
-		s.gamesCache = []byte("[]")
-		return s.gamesCache
+		s.gamesCache, s.gamesCacheTime = []byte("[]"), time.Now()
+		return s.gamesCache, nil
 	}
-	var err error
-	s.gamesCache, err = json.Marshal(games)
+	buf, err := json.Marshal(games)
 	if err != nil {
-		log.Fatalf("failed to marshal %+v: %s", games, err)
+		return nil, fmt.Errorf("failed to marshal %+v: %s", games, err)
+	}
+	s.gamesCache, s.gamesCacheTime = buf, time.Now()
+	return s.gamesCache, nil
+}
+
+// cachedOnline returns the list of online players. The list is built by the
+// command handler.
+func (s *Server) cachedOnline() []bgammon.OnlinePlayer {
+	s.onlineCacheLock.Lock()
+	defer s.onlineCacheLock.Unlock()
+
+	if time.Since(s.onlineCacheTime) < 5*time.Second {
+		return s.onlineCache
+	}
+
+	result := make(chan []bgammon.OnlinePlayer, 1)
+	s.queueCommand(serverCommand{online: result})
+	select {
+	case players := <-result:
+		s.onlineCache, s.onlineCacheTime = players, time.Now()
+	case <-s.done:
 	}
-	return s.gamesCache
+	return s.onlineCache
 }
 
-func (s *server) cachedLeaderboard(matchType int, variant int8, multiPoint bool) []byte {
+func (s *Server) cachedLeaderboard(matchType int, variant int8, multiPoint bool) ([]byte, error) {
 	s.leaderboardCacheLock.Lock()
 	defer s.leaderboardCacheLock.Unlock()
 
@@ -186,110 +305,61 @@ func (s *server) cachedLeaderboard(matchType int, variant int8, multiPoint bool)
 	}
 
 	if !s.leaderboardCacheTime[i].IsZero() && time.Since(s.leaderboardCacheTime[i]) < 5*time.Minute {
-		return s.leaderboardCache[i]
+		return s.leaderboardCache[i], nil
 	}
-	s.leaderboardCacheTime[i] = time.Now()
 
 	result, err := getLeaderboard(matchType, variant, multiPoint)
 	if err != nil {
-		log.Fatalf("failed to get leaderboard: %s", err)
+		return nil, fmt.Errorf("failed to get leaderboard: %s", err)
 	}
-	s.leaderboardCache[i], err = json.Marshal(result)
+	buf, err := json.Marshal(result)
 	if err != nil {
-		log.Fatalf("failed to marshal %+v: %s", result, err)
+		return nil, fmt.Errorf("failed to marshal %+v: %s", result, err)
 	}
-
-	return s.leaderboardCache[i]
+	s.leaderboardCache[i], s.leaderboardCacheTime[i] = buf, time.Now()
+	return s.leaderboardCache[i], nil
 }
 
-func (s *server) cachedStats(statsType int) []byte {
+func (s *Server) cachedStats(statsType int) ([]byte, error) {
 	s.statsCacheLock.Lock()
 	defer s.statsCacheLock.Unlock()
 
 	if !s.statsCacheTime[statsType].IsZero() && time.Since(s.statsCacheTime[statsType]) < 5*time.Minute {
-		return s.statsCache[statsType]
+		return s.statsCache[statsType], nil
 	}
-	s.statsCacheTime[statsType] = time.Now()
 
+	var stats interface{}
+	var err error
 	switch statsType {
 	case 0:
-		stats, err := dailyStats(s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch server statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to marshal %+v: %s", stats, err)
-		}
+		stats, err = dailyStats(s.tz)
 	case 1:
-		stats, err := monthlyStats(s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch server statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to marshal %+v: %s", stats, err)
-		}
+		stats, err = monthlyStats(s.tz)
 	case 2:
-		stats, err := cumulativeStats(s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch server statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to serialize server statistics: %s", err)
-		}
+		stats, err = cumulativeStats(s.tz)
 	case 3:
-		stats, err := accountStats("BOT_tabula", matchTypeCasual, bgammon.VariantBackgammon, s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch tabula statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to serialize tabula statistics: %s", err)
-		}
+		stats, err = accountStats("BOT_tabula", matchTypeCasual, bgammon.VariantBackgammon, s.tz)
 	case 4:
-		stats, err := accountStats("BOT_wildbg", matchTypeCasual, bgammon.VariantBackgammon, s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch wildbg statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to serialize wildbg statistics: %s", err)
-		}
+		stats, err = accountStats("BOT_wildbg", matchTypeCasual, bgammon.VariantBackgammon, s.tz)
 	case 5:
-		stats, err := playerVsPlayerStats(s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch player statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to marshal %+v: %s", stats, err)
-		}
+		stats, err = playerVsPlayerStats(s.tz)
 	case 6:
-		stats, err := accountStats("BOT_gnubg", matchTypeCasual, bgammon.VariantBackgammon, s.tz)
-		if err != nil {
-			log.Fatalf("failed to fetch gnubg statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to serialize gnubg statistics: %s", err)
-		}
+		stats, err = accountStats("BOT_gnubg", matchTypeCasual, bgammon.VariantBackgammon, s.tz)
 	default: // 7
-		stats, err := achievementStats()
-		if err != nil {
-			log.Fatalf("failed to fetch achievement statistics: %s", err)
-		}
-		s.statsCache[statsType], err = json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to serialize achievement statistics: %s", err)
-		}
+		stats, err = achievementStats()
 	}
-
-	return s.statsCache[statsType]
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch statistics: %s", err)
+	}
+	buf, err := json.Marshal(stats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize statistics: %s", err)
+	}
+	s.statsCache[statsType], s.statsCacheTime[statsType] = buf, time.Now()
+	return s.statsCache[statsType], nil
 }
 
-func (s *server) cachedDiceStats() []byte {
+func (s *Server) cachedDiceStats() []byte {
 	s.diceStatsCacheLock.Lock()
 	defer s.diceStatsCacheLock.Unlock()
 
@@ -304,7 +374,7 @@ func (s *server) cachedDiceStats() []byte {
 	return s.diceStatsCache
 }
 
-func (s *server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil || id <= 0 {
@@ -314,7 +384,7 @@ func (s *server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
 
 	username, newPassword, err := confirmResetAccount(s.resetSalt, s.passwordSalt, id, key)
 	if err != nil {
-		log.Printf("failed to reset password: %s", err)
+		s.logger.Printf("failed to reset password: %s", err)
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -322,10 +392,70 @@ func (s *server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<!DOCTYPE html><html><body><h1>Invalid or expired password reset link.</h1></body></html>`))
 		return
 	}
+	s.logins.clear(s.hashIP(s.requestAddress(r)))
 	w.Write([]byte(`<!DOCTYPE html><html><body><h1>Your bgammon.org password has been reset.</h1>Your username is <b>` + username + `</b><br><br>Your new password is <b>` + newPassword + `</b></body></html>`))
 }
 
-func (s *server) handleMatch(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id <= 0 {
+		return
+	}
+	key := vars["key"]
+
+	username, err := confirmAccount(s.resetSalt, id, key)
+	if err != nil {
+		s.logger.Printf("failed to confirm email address: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err != nil || username == "" {
+		w.Write([]byte(`<!DOCTYPE html><html><body><h1>Invalid or expired email confirmation link.</h1></body></html>`))
+		return
+	}
+
+	// Clients logged in to the account are updated by the command handler.
+	s.queueCommand(serverCommand{confirmed: id})
+
+	w.Write([]byte(`<!DOCTYPE html><html><body><h1>Your bgammon.org email address has been confirmed.</h1>Thank you, <b>` + username + `</b>.</body></html>`))
+}
+
+func (s *Server) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id <= 0 {
+		return
+	}
+	key := vars["key"]
+
+	username, oldEmail, newEmail, err := confirmEmailChange(s.resetSalt, id, key)
+	if err != nil {
+		s.logger.Printf("failed to confirm email address change: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err != nil || username == "" {
+		w.Write([]byte(`<!DOCTYPE html><html><body><h1>Invalid or expired email confirmation link.</h1></body></html>`))
+		return
+	} else if newEmail == nil {
+		w.Write([]byte(`<!DOCTYPE html><html><body><h1>Email address change confirmed.</h1>Please also follow the link sent to your other email address to complete the change.</body></html>`))
+		return
+	}
+
+	s.logger.Printf("Account %s changed email address from %s to %s", username, redactEmail(oldEmail), redactEmail(newEmail))
+
+	// Clients logged in to the account are updated by the command handler.
+	s.queueCommand(serverCommand{confirmed: id, email: newEmail})
+
+	w.Write([]byte(`<!DOCTYPE html><html><body><h1>Your bgammon.org email address has been changed.</h1>Thank you, <b>` + username + `</b>.</body></html>`))
+
+	// Notify the previous email address in case the change was not made by
+	// the account owner.
+	sendEmailChangeNotice(s.mailServer, oldEmail, username, newEmail)
+}
+
+func (s *Server) handleMatch(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil || id <= 0 {
@@ -334,7 +464,7 @@ func (s *server) handleMatch(w http.ResponseWriter, r *http.Request) {
 
 	timestamp, player1, player2, replay, err := matchInfo(id)
 	if err != nil || len(replay) == 0 {
-		log.Printf("failed to retrieve match: %s", err)
+		s.logger.Printf("failed to retrieve match: %s", err)
 		return
 	}
 
@@ -343,17 +473,246 @@ func (s *server) handleMatch(w http.ResponseWriter, r *http.Request) {
 	w.Write(replay)
 }
 
-func (s *server) handleListMatches(w http.ResponseWriter, r *http.Request) {
+// handleMatchFeed streams the board, roll, move and win events of a match in
+// progress using Server-Sent Events. The password of a private match must be
+// provided via the password query parameter.
+func (s *Server) handleMatchFeed(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		http.Error(w, "Match not found.", http.StatusNotFound)
+		return
+	}
+
+	if !s.connections.allow(s.hashIP(s.requestAddress(r))) {
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	viewer := &serverClient{
+		json:      true,
+		language:  "bgammon-en",
+		accountID: -1,
+	}
+	sse := newSSEClient(w, r, func() bool {
+		viewing := make(chan bool, 1)
+		s.queueCommand(serverCommand{client: viewer, viewing: viewing})
+		select {
+		case v := <-viewing:
+			return v
+		case <-s.done:
+			return false
+		}
+	})
+	if sse == nil {
+		http.Error(w, "Streaming unsupported.", http.StatusInternalServerError)
+		return
+	}
+	sse.address = s.hashIP(s.requestAddress(r))
+	viewer.Client = sse
+
+	// Viewers are added to and removed from matches by the command handler.
+	result := make(chan int, 1)
+	s.queueCommand(serverCommand{
+		client: viewer,
+		spectate: &spectateRequest{
+			match:    id,
+			password: []byte(strings.ReplaceAll(r.URL.Query().Get("password"), "_", " ")),
+			result:   result,
+		},
+	})
+	var status int
+	select {
+	case status = <-result:
+	case <-s.done:
+		status = http.StatusServiceUnavailable
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		http.Error(w, "Match not found.", status)
+		return
+	case http.StatusForbidden:
+		http.Error(w, "Invalid password.", status)
+		return
+	default:
+		http.Error(w, "The server is shutting down.", status)
+		return
+	}
+
+	sse.HandleReadWrite()
+
+	removed := make(chan struct{})
+	s.queueCommand(serverCommand{client: viewer, removed: removed})
+	select {
+	case <-removed:
+	case <-s.done:
+	}
+}
+
+// writeResponse writes a response body, or an internal server error when the
+// response could not be generated.
+func (s *Server) writeResponse(w http.ResponseWriter, buf []byte, err error) {
+	if err != nil {
+		s.logger.Printf("failed to write response: %s", err)
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		return
+	}
+	w.Write(buf)
+}
+
+func (s *Server) handleListMatches(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(s.cachedMatches())
+	buf, err := s.cachedMatches()
+	s.writeResponse(w, buf, err)
 }
 
-func (s *server) handleDiceStats(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleListOnline(w http.ResponseWriter, r *http.Request) {
+	var filters [][]byte
+	for _, filter := range r.URL.Query()["filter"] {
+		for _, f := range strings.Fields(strings.ReplaceAll(filter, ",", " ")) {
+			if strings.ToLower(f) == "following" {
+				continue
+			}
+			filters = append(filters, []byte(f))
+		}
+	}
+
+	var players []bgammon.OnlinePlayer
+	for _, p := range s.cachedOnline() {
+		if onlinePlayerMatches([]byte(p.Name), p.Status, p.Followed, filters) {
+			players = append(players, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(players) == 0 {
+		w.Write([]byte("[]"))
+		return
+	}
+	buf, err := json.Marshal(players)
+	s.writeResponse(w, buf, err)
+}
+
+// authenticateHTTP authenticates a request using HTTP basic authentication. When
+// two-factor authentication is enabled, a code must be provided via the X-OTP
+// header. An error response is written and nil is returned when authentication fails.
+func (s *Server) authenticateHTTP(w http.ResponseWriter, r *http.Request, realm string) *account {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		http.Error(w, "Authentication required.", http.StatusUnauthorized)
+		return nil
+	}
+	address := s.hashIP(s.requestAddress(r))
+	if s.logins.locked(address) != 0 {
+		http.Error(w, "Too many failed login attempts.", http.StatusTooManyRequests)
+		return nil
+	}
+	a, err := loginAccount(s.mailServer, s.passwordSalt, []byte(username), []byte(strings.ReplaceAll(password, " ", "_")))
+	if err != nil || a == nil {
+		if a == nil {
+			s.logins.fail(address)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		http.Error(w, "Invalid username or password.", http.StatusUnauthorized)
+		return nil
+	}
+	if a.totp != 0 {
+		code := r.Header.Get("X-OTP")
+		if !validateTOTP(a.totpSecret, code, time.Now()) {
+			if code != "" {
+				s.logins.fail(address)
+				_, err = failLogin(s.mailServer, a.id)
+				if err != nil {
+					s.logger.Printf("failed to record failed login: %s", err)
+				}
+			}
+			http.Error(w, "Two-factor authentication code required via X-OTP header.", http.StatusUnauthorized)
+			return nil
+		}
+		err = clearLoginFailures(a.id)
+		if err != nil {
+			s.logger.Printf("failed to clear failed logins: %s", err)
+		}
+	}
+	s.logins.clear(address)
+	return a
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	a := s.authenticateHTTP(w, r, "bgammon.org")
+	if a == nil {
+		return
+	}
+
+	e, err := exportAccount(a.id)
+	if err != nil || e == nil {
+		s.logger.Printf("failed to export account %d: %s", a.id, err)
+		http.Error(w, "Failed to export account.", http.StatusInternalServerError)
+		return
+	}
+	e.Matches, err = matchHistory(e.Username)
+	if err != nil {
+		s.logger.Printf("failed to export match history of account %d: %s", a.id, err)
+		http.Error(w, "Failed to export account.", http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		s.writeResponse(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="bgammon-`+e.Username+`.json"`)
+	w.Write(buf)
+}
+
+// handleAudit serves the staff action log. Staff members authenticate using
+// HTTP basic authentication with their username and password.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	a := s.authenticateHTTP(w, r, "bgammon.org staff")
+	if a == nil {
+		return
+	}
+	staff := &serverClient{
+		account:   a,
+		accountID: a.id,
+	}
+	staff.staffDisabled = s.requireStaffTwoFactor && a.totp == 0
+	if !s.allowed(staff, bgammon.CommandAudit) {
+		http.Error(w, "Access denied.", http.StatusForbidden)
+		return
+	}
+
+	const auditPageSize = 100
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	entries, err := auditLog(r.URL.Query().Get("filter"), (page-1)*auditPageSize, auditPageSize)
+	if err != nil {
+		s.logger.Printf("failed to retrieve audit log: %s", err)
+		http.Error(w, "Failed to retrieve audit log.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(entries) == 0 {
+		w.Write([]byte("[]"))
+		return
+	}
+	buf, err := json.Marshal(entries)
+	s.writeResponse(w, buf, err)
+}
+
+func (s *Server) handleDiceStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write(s.cachedDiceStats())
 }
 
-func (s *server) handleAccountStatsFunc(matchType int, variant int8) func(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleAccountStatsFunc(matchType int, variant int8) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		username := strings.ToLower(strings.TrimSpace(vars["username"]))
@@ -369,51 +728,55 @@ func (s *server) handleAccountStatsFunc(matchType int, variant int8) func(w http
 		w.Header().Set("Content-Type", "application/json")
 		stats, err := accountStats(username, matchType, variant, s.tz)
 		if err != nil {
-			log.Fatalf("failed to fetch account statistics: %s", err)
+			s.writeResponse(w, nil, fmt.Errorf("failed to fetch account statistics: %s", err))
+			return
 		}
 		buf, err := json.Marshal(stats)
-		if err != nil {
-			log.Fatalf("failed to serialize account statistics: %s", err)
-		}
-		w.Write(buf)
+		s.writeResponse(w, buf, err)
 
 	}
 }
 
-func (s *server) handleLeaderboardFunc(matchType int, variant int8, multiPoint bool) func(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleLeaderboardFunc(matchType int, variant int8, multiPoint bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(s.cachedLeaderboard(matchType, variant, multiPoint))
+		buf, err := s.cachedLeaderboard(matchType, variant, multiPoint)
+		s.writeResponse(w, buf, err)
 	}
 }
 
-func (s *server) handleStatsFunc(statsType int) func(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleStatsFunc(statsType int) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(s.cachedStats(statsType))
+		buf, err := s.cachedStats(statsType)
+		s.writeResponse(w, buf, err)
 	}
 }
 
-func (s *server) handlePrintDailyStats(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handlePrintDailyStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 }
 
-func (s *server) handlePrintStats(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handlePrintStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(s.cachedStats(0))
+	buf, err := s.cachedStats(0)
+	s.writeResponse(w, buf, err)
 }
 
-func (s *server) handlePrintCumulativeStats(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handlePrintCumulativeStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(s.cachedStats(2))
+	buf, err := s.cachedStats(2)
+	s.writeResponse(w, buf, err)
 }
 
-func (s *server) handlePrintTabulaStats(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handlePrintTabulaStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(s.cachedStats(3))
+	buf, err := s.cachedStats(3)
+	s.writeResponse(w, buf, err)
 }
 
-func (s *server) handlePrintWildBGStats(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handlePrintWildBGStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(s.cachedStats(4))
+	buf, err := s.cachedStats(4)
+	s.writeResponse(w, buf, err)
 }
@@ -0,0 +1,434 @@
+//go:build full
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+)
+
+// startTestServer starts a server which is stopped when the test finishes.
+func startTestServer(t *testing.T, hooks Hooks) *Server {
+	s, err := New(&Options{
+		Logger: log.New(io.Discard, "", 0),
+		Hooks:  hooks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Stop(context.Background())
+	})
+	return s
+}
+
+// testClient is a client connected to a test server via a local connection.
+type testClient struct {
+	t     *testing.T
+	lines chan string
+	write func(command string)
+}
+
+// connectTestClient connects to a server and logs in as a guest.
+func connectTestClient(t *testing.T, s *Server, username string) *testClient {
+	conn := <-s.ListenLocal()
+	c := &testClient{
+		t:     t,
+		lines: make(chan string, 256),
+		write: func(command string) {
+			_, err := conn.Write([]byte(command + "\n"))
+			if err != nil {
+				t.Error(err)
+			}
+		},
+	}
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+	c.write("login " + username)
+	c.expect("welcome Guest_" + username)
+	return c
+}
+
+// loginAccount logs the client in to an account as if the guest had
+// registered it.
+func (c *testClient) loginAccount(s *Server, guestName string, id int, username string) {
+	c.t.Helper()
+	s.clientsLock.Lock()
+	sc := s.clientByUsername([]byte(guestName))
+	s.clientsLock.Unlock()
+	if sc == nil {
+		c.t.Fatalf("client %s not found", guestName)
+	}
+	for sc.loggingIn.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	s.queueCommand(serverCommand{
+		client: sc,
+		account: &account{
+			id:          id,
+			username:    []byte(username),
+			casual:      &clientRating{},
+			competitive: &clientRating{},
+		},
+	})
+	c.expect("welcome " + username)
+}
+
+// expect waits for a message containing the provided text.
+func (c *testClient) expect(message string) {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-c.lines:
+			if strings.Contains(line, message) {
+				return
+			}
+		case <-timeout:
+			c.t.Fatalf("expected message: %s", message)
+		}
+	}
+}
+
+func TestMatchFeed(t *testing.T) {
+	created := make(chan *Match, 1)
+	s := startTestServer(t, Hooks{
+		MatchCreated: func(m *Match) { created <- m },
+	})
+	ctx := context.Background()
+
+	alice := connectTestClient(t, s, "alice")
+	alice.write("create public 1 0 test")
+	var m *Match
+	select {
+	case m = <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("match created hook not called")
+	}
+
+	ts := httptest.NewServer(s.newRouter())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/match/999/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status for unknown match: %d", res.StatusCode)
+	}
+
+	feedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(feedCtx, http.MethodGet, ts.URL+"/match/"+strconv.Itoa(m.ID)+"/live", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	events := make(chan [2]string, 16)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		scanner.Buffer(nil, 1024*1024)
+		var eventType string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				eventType = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				events <- [2]string{eventType, v}
+			}
+		}
+		close(events)
+	}()
+	readEvent := func() *bgammon.EventBoard {
+		t.Helper()
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			ev := &bgammon.EventBoard{}
+			err := json.Unmarshal([]byte(e[1]), ev)
+			if err != nil {
+				t.Fatalf("failed to parse event data %s: %s", e[1], err)
+			} else if e[0] != bgammon.EventTypeBoard || ev.Type != e[0] {
+				t.Fatalf("unexpected event: %s %s", e[0], e[1])
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received")
+		}
+		return nil
+	}
+
+	// The viewer is sent the board when joining and whenever a player joins.
+	// Players are seated randomly, so either player may be the creator.
+	ev := readEvent()
+	if ev.Player1.Name != "Guest_alice" && ev.Player2.Name != "Guest_alice" {
+		t.Errorf("unexpected board: %+v", ev.Game)
+	}
+	var viewer *serverClient
+	s.gamesLock.RLock()
+	for _, g := range s.games {
+		for _, spectator := range g.spectators {
+			if g.id == m.ID && spectator.accountID == -1 {
+				viewer = spectator
+			}
+		}
+	}
+	s.gamesLock.RUnlock()
+	if viewer == nil {
+		t.Fatal("expected viewer to join the match as a spectator")
+	}
+	// Matches are modified by the command handler.
+	viewing := func() bool {
+		result := make(chan bool, 1)
+		s.queueCommand(serverCommand{client: viewer, viewing: result})
+		return <-result
+	}
+
+	bob := connectTestClient(t, s, "bob")
+	bob.write("join " + strconv.Itoa(m.ID))
+	bob.expect("joined")
+	for ev.Player1.Name != "Guest_bob" && ev.Player2.Name != "Guest_bob" {
+		ev = readEvent()
+	}
+
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); viewing(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected viewer to be removed from the match")
+		}
+	}
+}
+
+// apiRequest sends a request to the HTTP API and decodes the response into v.
+func apiRequest(t *testing.T, h http.Handler, method string, path string, token string, body string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil {
+		err := json.Unmarshal(rec.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("failed to parse response %s: %s", rec.Body, err)
+		}
+	}
+	return rec
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	s := startTestServer(t, Hooks{})
+	h := s.newRouter()
+
+	const body = `{"Opponent":"bob","Points":1}`
+	testCases := []struct {
+		token   string
+		message string
+	}{
+		{"", "API token required."},
+		{"Bearer ", "API token required."},
+		{"Basic YWxpY2U6c2VjcmV0", "API token required."},
+		{"Bearer " + generateAPIToken(), "Invalid API token."},
+	}
+	for _, c := range testCases {
+		res := &apiError{}
+		rec := apiRequest(t, h, http.MethodPost, apiPrefix+"/challenges", c.token, body, res)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("unexpected status for token %q: %d", c.token, rec.Code)
+		} else if rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("expected authentication challenge for token %q", c.token)
+		} else if res.Error != c.message {
+			t.Errorf("unexpected error for token %q: expected %q, got %q", c.token, c.message, res.Error)
+		}
+	}
+}
+
+func TestAPIMatches(t *testing.T) {
+	created := make(chan *Match, 1)
+	s := startTestServer(t, Hooks{
+		MatchCreated: func(m *Match) { created <- m },
+	})
+	h := s.newRouter()
+
+	var ids []int
+	for _, create := range []string{"public 1 0 one", "public 3 0 three", "private secret 1 0 hidden"} {
+		c := connectTestClient(t, s, "player"+strconv.Itoa(len(ids)))
+		c.write("create " + create)
+		c.expect("Created match")
+		select {
+		case m := <-created:
+			ids = append(ids, m.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("match created hook not called")
+		}
+	}
+
+	testCases := []struct {
+		query string
+		ids   []int
+		more  bool
+	}{
+		{"", ids, false},
+		{"?limit=2", ids[:2], true},
+		{"?limit=2&page=2", ids[2:], false},
+		{"?limit=2&page=3", nil, false},
+		{"?points=3", ids[1:2], false},
+		{"?private=1", ids[2:], false},
+		{"?private=false", ids[:2], false},
+		{"?variant=backgammon&points=1", []int{ids[0], ids[2]}, false},
+		{"?variant=acey", nil, false},
+		{"?open=1", ids, false},
+	}
+	for _, c := range testCases {
+		var res struct {
+			apiPage
+			Results []*bgammon.GameListing
+		}
+		rec := apiRequest(t, h, http.MethodGet, apiPrefix+"/matches"+c.query, "", "", &res)
+		if rec.Code != http.StatusOK {
+			t.Errorf("unexpected status for %q: %d", c.query, rec.Code)
+			continue
+		}
+		var got []int
+		for _, listing := range res.Results {
+			got = append(got, listing.ID)
+		}
+		if !slices.Equal(got, c.ids) || res.More != c.more {
+			t.Errorf("unexpected matches for %q: expected %v (more %t), got %v (more %t)", c.query, c.ids, c.more, got, res.More)
+		}
+	}
+
+	rec := apiRequest(t, h, http.MethodGet, apiPrefix+"/matches?variant=chess", "", "", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for invalid variant: %d", rec.Code)
+	}
+}
+
+func TestAPIChallenge(t *testing.T) {
+	s := startTestServer(t, Hooks{})
+
+	alice := connectTestClient(t, s, "alice")
+	alice.loginAccount(s, "Guest_alice", 1, "alice")
+	bob := connectTestClient(t, s, "bob")
+	bob.loginAccount(s, "Guest_bob", 2, "bob")
+	connectTestClient(t, s, "carol")
+
+	challenge := func(id int, opponent string) (*httptest.ResponseRecorder, []byte) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, apiPrefix+"/challenges", nil)
+		s.apiChallenge(rec, req, id, &apiChallengeRequest{
+			Opponent: opponent,
+			Points:   3,
+		})
+		return rec, rec.Body.Bytes()
+	}
+
+	testCases := []struct {
+		id       int
+		opponent string
+		status   int
+	}{
+		{3, "bob", http.StatusConflict},
+		{1, "dave", http.StatusNotFound},
+		{1, "alice", http.StatusBadRequest},
+	}
+	for _, c := range testCases {
+		rec, body := challenge(c.id, c.opponent)
+		if rec.Code != c.status {
+			t.Errorf("unexpected status for challenge from %d to %s: expected %d, got %d: %s", c.id, c.opponent, c.status, rec.Code, body)
+		}
+	}
+
+	rec, body := challenge(1, "bob")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d: %s", rec.Code, body)
+	}
+	res := &apiChallenge{}
+	err := json.Unmarshal(body, res)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Match == 0 || res.Password == "" {
+		t.Fatalf("unexpected challenge: %+v", res)
+	}
+	alice.expect("Created match: alice vs. bob")
+	join := "join " + strconv.Itoa(res.Match) + " " + res.Password
+	bob.expect("alice challenges you to a match: alice vs. bob (3 points). To accept, send: " + join)
+
+	rec, body = challenge(1, "bob")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("unexpected status for challenge while in a match: %d: %s", rec.Code, body)
+	}
+
+	bob.write(join)
+	bob.expect("joined")
+}
+
+func TestListOnline(t *testing.T) {
+	s := startTestServer(t, Hooks{})
+	h := s.newRouter()
+
+	alice := connectTestClient(t, s, "alice")
+	alice.write("create public 1 0 test")
+	alice.expect("Created match")
+	connectTestClient(t, s, "bob")
+
+	testCases := []struct {
+		query   string
+		players []string
+	}{
+		{"", []string{"Guest_alice", "Guest_bob"}},
+		{"?filter=bob", []string{"Guest_bob"}},
+		{"?filter=idle", []string{"Guest_bob"}},
+		{"?filter=guest,seeking", []string{"Guest_alice"}},
+		{"?filter=following", []string{"Guest_alice", "Guest_bob"}},
+		{"?filter=carol", nil},
+	}
+	for _, c := range testCases {
+		var players []bgammon.OnlinePlayer
+		rec := apiRequest(t, h, http.MethodGet, "/online.json"+c.query, "", "", &players)
+		if rec.Code != http.StatusOK {
+			t.Errorf("unexpected status for %q: %d", c.query, rec.Code)
+			continue
+		}
+		var names []string
+		for _, p := range players {
+			names = append(names, p.Name)
+		}
+		if !slices.Equal(names, c.players) {
+			t.Errorf("unexpected players for %q: expected %v, got %v", c.query, c.players, names)
+		}
+	}
+}
@@ -0,0 +1,888 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+)
+
+func TestParseDuration(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}
+
+	var testCases = []*testCase{
+		{value: "30m", expected: 30 * time.Minute, ok: true},
+		{value: "12h", expected: 12 * time.Hour, ok: true},
+		{value: "7d", expected: 7 * 24 * time.Hour, ok: true},
+		{value: "2W", expected: 14 * 24 * time.Hour, ok: true},
+		{value: "0d"},
+		{value: "-1h"},
+		{value: "h"},
+		{value: "spam"},
+	}
+	for _, c := range testCases {
+		d, ok := parseDuration(c.value)
+		if ok != c.ok || d != c.expected {
+			t.Fatalf("unexpected duration for %s: expected %s (%v), got %s (%v)", c.value, c.expected, c.ok, d, ok)
+		}
+	}
+}
+
+func TestHashIPPrefixes(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{ipAddressSalt: "salt"}
+
+	type testCase struct {
+		address string
+		network string
+		match   bool
+	}
+
+	var testCases = []*testCase{
+		{address: "203.0.113.7:1337", network: "203.0.113.0/24", match: true},
+		{address: "203.0.113.7:1337", network: "203.0.0.0/16", match: true},
+		{address: "203.0.113.7:1337", network: "203.0.113.7/32", match: true},
+		{address: "203.0.114.7:1337", network: "203.0.113.0/24", match: false},
+		{address: "[2001:db8::1]:1337", network: "2001:db8::/32", match: true},
+		{address: "[2001:db9::1]:1337", network: "2001:db8::/32", match: false},
+	}
+	for _, c := range testCases {
+		hash, err := s.hashNetwork(c.network)
+		if err != nil {
+			t.Fatalf("failed to hash network %s: %s", c.network, err)
+		}
+		prefixes := s.hashIPPrefixes(c.address)
+		if prefixes[0] != s.hashIP(c.address) {
+			t.Fatalf("unexpected first prefix hash for %s", c.address)
+		} else if slices.Contains(prefixes, hash) != c.match {
+			t.Fatalf("unexpected match for address %s and network %s: expected %v", c.address, c.network, c.match)
+		}
+	}
+
+	_, err := s.hashNetwork("10.0.0.0/4")
+	if err == nil {
+		t.Fatal("expected error when hashing a network which is too large")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(1, 3)
+	now := b.last
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("expected token %d to be available", i+1)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("expected bucket to be empty")
+	}
+	if !b.allow(now.Add(time.Second)) {
+		t.Fatal("expected bucket to refill")
+	} else if b.full(now.Add(2 * time.Second)) {
+		t.Fatal("expected bucket to not be full")
+	} else if !b.full(now.Add(time.Hour)) {
+		t.Fatal("expected bucket to be full")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Unix()
+	if loginLockout(accountLockFailures-1, accountLockFailures) != 0 {
+		t.Fatal("expected no lockout below threshold")
+	}
+	first := loginLockout(accountLockFailures, accountLockFailures) - now
+	second := loginLockout(accountLockFailures+1, accountLockFailures) - now
+	if first < 59 || first > 61 || second < 119 || second > 121 {
+		t.Fatalf("unexpected lockout durations: %d, %d", first, second)
+	}
+	if d := loginLockout(accountLockFailures+100, accountLockFailures) - now; d < int64(maxLockout.Seconds())-1 || d > int64(maxLockout.Seconds())+1 {
+		t.Fatalf("expected maximum lockout, got %d", d)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	t.Parallel()
+
+	// RFC 6238 test vectors, truncated to six digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	type testCase struct {
+		timestamp int64
+		code      string
+	}
+	var testCases = []*testCase{
+		{timestamp: 59, code: "287082"},
+		{timestamp: 1111111109, code: "081804"},
+		{timestamp: 1234567890, code: "005924"},
+		{timestamp: 2000000000, code: "279037"},
+	}
+	for _, c := range testCases {
+		code := totpCode(secret, uint64(c.timestamp/totpPeriod))
+		if code != c.code {
+			t.Fatalf("unexpected code at %d: expected %s, got %s", c.timestamp, c.code, code)
+		} else if !validateTOTP(secret, code, time.Unix(c.timestamp+totpPeriod, 0)) {
+			t.Fatalf("expected code %s to be valid within allowed skew", code)
+		} else if validateTOTP(secret, code, time.Unix(c.timestamp+totpPeriod*3, 0)) {
+			t.Fatalf("expected code %s to be invalid outside allowed skew", code)
+		}
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	t.Parallel()
+
+	token := generateAPIToken()
+	if len(token) != apiTokenLength*2 {
+		t.Fatalf("unexpected token length %d", len(token))
+	} else if token == generateAPIToken() {
+		t.Fatal("expected unique tokens")
+	}
+	hash := hashAPIToken(token, "salt")
+	if hash != hashAPIToken(token, "salt") {
+		t.Fatal("expected identical hashes")
+	} else if hash == hashAPIToken(token, "pepper") {
+		t.Fatal("expected hashes to depend on salt")
+	}
+}
+
+func TestParseClientInfo(t *testing.T) {
+	testCases := []struct {
+		info         string
+		name         string
+		language     string
+		protocol     int
+		capabilities []string
+	}{
+		{"example-client-v1.2.3", "example-client-v1.2.3", "", 0, nil},
+		{"example-client-v1.2.3/en", "example-client-v1.2.3", "en", 0, nil},
+		{"example-client-v1.2.3/en/2", "example-client-v1.2.3", "en", 2, nil},
+		{"example-client-v1.2.3/en/2/failedcreate,Tabula,tabula", "example-client-v1.2.3", "en", 2, []string{"failedcreate", "tabula"}},
+		{"example-client-v1.2.3/en/x/resign", "example-client-v1.2.3", "en", 0, []string{"resign"}},
+	}
+	for _, c := range testCases {
+		name, language, protocol, capabilities := parseClientInfo([]byte(c.info))
+		if string(name) != c.name || string(language) != c.language || protocol != c.protocol || !slices.Equal(capabilities, c.capabilities) {
+			t.Errorf("unexpected client info for %s: got %s %s %d %v, expected %s %s %d %v", c.info, name, language, protocol, capabilities, c.name, c.language, c.protocol, c.capabilities)
+		}
+	}
+}
+
+func TestTextClientInfo(t *testing.T) {
+	for arg, expected := range map[string]bool{
+		"example-client-v1.2.3/en/2": true,
+		"example-client-v1.2.3/en":   true,
+		"alice":                      false,
+		"alice@example.com":          false,
+		"a/b@example.com":            false,
+	} {
+		if textClientInfo([]byte(arg)) != expected {
+			t.Errorf("unexpected result for %s: expected %v", arg, expected)
+		}
+	}
+}
+
+func TestParseCommandRequest(t *testing.T) {
+	s := &Server{}
+	s.registerBuiltinCommands()
+
+	testCases := []struct {
+		accountID int
+		request   string
+		command   string
+		params    []string
+	}{
+		{-1, `{"Type":"login","Args":{"username":"alice","password":"secret phrase"},"ID":"1"}`, "loginjson", []string{"unspecified", "alice", "secret_phrase"}},
+		{-1, `{"Type":"login","Args":{"client":"example-client-v1.2.3/en"}}`, "loginjson", []string{"example-client-v1.2.3/en"}},
+		{0, `{"Type":"register","Args":{"client":"example","email":"a@b.c","username":"alice","password":"x"}}`, "register", []string{"a@b.c", "alice", "x"}},
+		{1, `{"Type":"create","Args":{"visibility":"public","points":5,"variant":0}}`, "create", []string{"public", "5", "0"}},
+		{1, `{"Type":"create","Args":{"visibility":"public","password":"x","points":5,"variant":0}}`, "create", []string{"public", "5", "0"}},
+		{1, `{"Type":"create","Args":{"visibility":"private","password":"x","points":5,"variant":0}}`, "create", []string{"private", "x", "5", "0"}},
+		{1, `{"Type":"move","Args":{"moves":["24-18","13-10"]}}`, "move", []string{"24-18", "13-10"}},
+		{1, `{"Type":"reports","Args":{"action":"view","id":3}}`, "reports", []string{"view", "3"}},
+		{1, `{"Type":"SAY","Args":{"message":"hello  there"}}`, "say", []string{"hello  there"}},
+		{1, `{"Type":"mv","Args":{"moves":"24/18"}}`, "move", []string{"24/18"}},
+	}
+	for _, c := range testCases {
+		cmd, err := s.parseCommandRequest(&serverClient{accountID: c.accountID}, []byte(c.request))
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", c.request, err)
+			continue
+		}
+		var params []string
+		for _, param := range cmd.params {
+			params = append(params, string(param))
+		}
+		if string(cmd.command) != c.command || !slices.Equal(params, c.params) || !cmd.request {
+			t.Errorf("unexpected command for %s: got %s %q, expected %s %q", c.request, cmd.command, params, c.command, c.params)
+		}
+	}
+
+	for _, request := range []string{`{"Type":"unknown"}`, `{"Type":"loginjson"}`, `{"Type":"endgame"}`, `{"Type":"say","Args":{"message":{}}}`, `{"Type":"move","Args":{"moves":[["1-2"]]}}`, `{"Type":"create","Args":{"visibility":"private","points":5,"variant":0}}`, `{"Type":"audit","Args":{"page":2}}`, `not json`} {
+		_, err := s.parseCommandRequest(&serverClient{}, []byte(request))
+		if err == nil {
+			t.Errorf("expected error when parsing %s", request)
+		}
+	}
+}
+
+func TestAccountPassword(t *testing.T) {
+	s := &Server{}
+	s.registerBuiltinCommands()
+
+	parse := func(accountID int, request string) [][]byte {
+		t.Helper()
+		cmd, err := s.parseCommandRequest(&serverClient{accountID: accountID}, []byte(request))
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", request, err)
+		}
+		return cmd.params
+	}
+
+	// Passwords set via JSON formatted commands must be accepted when logging
+	// in via JSON formatted and text commands.
+	const expected = "secret_phrase"
+	login := map[string][]byte{
+		"loginjson":  accountPassword(parse(-1, `{"Type":"login","Args":{"username":"alice","password":"secret phrase"}}`)[2:]),
+		"login text": accountPassword(bytes.Fields([]byte("alice secret phrase"))[1:]),
+	}
+	set := map[string][]byte{
+		"register":      accountPassword(parse(0, `{"Type":"register","Args":{"email":"a@b.c","username":"alice","password":"secret phrase"}}`)[2:]),
+		"password":      accountPassword(parse(1, `{"Type":"password","Args":{"old":"old phrase","new":"secret phrase"}}`)[1:]),
+		"deleteaccount": accountPassword(parse(1, `{"Type":"deleteaccount","Args":{"password":"secret phrase"}}`)),
+		"set email":     accountPassword(parse(1, `{"Type":"set","Args":{"name":"email","value":"a@b.c","password":"secret phrase"}}`)[2:]),
+	}
+	for name, password := range login {
+		if string(password) != expected {
+			t.Errorf("unexpected password when logging in via %s: %s", name, password)
+		}
+	}
+	for name, password := range set {
+		if string(password) != expected {
+			t.Errorf("unexpected password when using %s: %s", name, password)
+		}
+	}
+	if old := parse(1, `{"Type":"password","Args":{"old":"old phrase","new":"secret phrase"}}`)[0]; string(old) != "old_phrase" {
+		t.Errorf("unexpected old password: %s", old)
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	s := &Server{}
+	s.registerBuiltinCommands()
+
+	for _, def := range s.commandList() {
+		if def.handler == nil && def.first == nil {
+			t.Errorf("command %s has no handler", def.name)
+		}
+		for _, alias := range def.aliases {
+			if s.command(alias) != def {
+				t.Errorf("alias %s does not refer to command %s", alias, def.name)
+			}
+		}
+	}
+	if s.commandLimit("MV 1-2") != limitDefault || s.commandLimit("mv") != limitMove || s.commandLimit("unknown") != limitDefault {
+		t.Error("unexpected rate limit class")
+	}
+
+	handler := func(c *CommandContext) {}
+	err := s.RegisterCommand(&Command{Name: "wave", Aliases: []string{"w"}, Arguments: []string{"username"}, Handler: handler})
+	if err != nil {
+		t.Fatalf("failed to register command: %s", err)
+	}
+	for _, c := range []*Command{
+		{Name: "wave", Handler: handler},
+		{Name: "hug", Aliases: []string{"s"}, Handler: handler},
+		{Name: "two words", Handler: handler},
+		{Name: "Hug", Handler: handler},
+		{Name: "hug"},
+		{Name: "hug", Roles: []string{"janitor"}, Handler: handler},
+	} {
+		if s.RegisterCommand(c) == nil {
+			t.Errorf("expected error when registering command %s", c.Name)
+		}
+	}
+	def := s.command("w")
+	if def == nil || def.name != "wave" || !slices.Equal(def.arguments, []string{"username"}) {
+		t.Fatalf("unexpected definition of registered command: %+v", def)
+	}
+
+	staff := &serverClient{account: &account{roles: roleModerator}}
+	player := &serverClient{}
+	if !s.allowed(staff, "kick") || s.allowed(player, "kick") || !s.allowed(player, "say") {
+		t.Error("unexpected command permissions")
+	}
+	if s.allowed(staff, "shutdown") || !s.allowed(&serverClient{accountID: 1}, "shutdown") {
+		t.Error("unexpected command permissions")
+	}
+}
+
+func TestCommandReference(t *testing.T) {
+	const begin, end = "<!-- BEGIN COMMAND REFERENCE -->\n", "<!-- END COMMAND REFERENCE -->"
+	protocol, err := os.ReadFile("../../PROTOCOL.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, stop := bytes.Index(protocol, []byte(begin)), bytes.Index(protocol, []byte(end))
+	if start == -1 || stop < start {
+		t.Fatal("command reference not found in PROTOCOL.md")
+	}
+	if !bytes.Equal(protocol[start+len(begin):stop], CommandReference()) {
+		t.Fatal("command reference in PROTOCOL.md does not match the command registry, run go generate to update it")
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	created := make(chan *Match, 1)
+	joined := make(chan string, 1)
+	s, err := New(&Options{
+		Logger: log.New(io.Discard, "", 0),
+		Hooks: Hooks{
+			MatchCreated: func(m *Match) { created <- m },
+			PlayerJoined: func(m *Match, player string) { joined <- player },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if s.Stop(ctx) == nil {
+		t.Fatal("expected error when stopping server which has not been started")
+	}
+	err = s.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-s.ListenLocal()
+	scanner := bufio.NewScanner(conn)
+	go func() {
+		conn.Write([]byte("login alice\ncreate public 1 0 test\n"))
+	}()
+	go func() {
+		for scanner.Scan() {
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case m := <-created:
+		if m.Name != "test" || m.Points != 1 {
+			t.Errorf("unexpected match: %+v", m)
+		}
+	case <-timeout:
+		t.Fatal("match created hook not called")
+	}
+	select {
+	case player := <-joined:
+		if player != "Guest_alice" {
+			t.Errorf("unexpected player: %s", player)
+		}
+	case <-timeout:
+		t.Fatal("player joined hook not called")
+	}
+
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err = s.Stop(stopCtx)
+	if err != nil {
+		t.Fatalf("failed to stop server: %s", err)
+	}
+	if len(s.clients) != 0 {
+		t.Fatal("expected all clients to be disconnected")
+	}
+}
+
+func TestRegisterGuest(t *testing.T) {
+	s, err := New(&Options{Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = s.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(ctx)
+
+	// A registered user is connected as carol.
+	s.addClient(&serverClient{
+		name:      []byte("carol"),
+		accountID: 2,
+		Client:    newDetachedClient(""),
+	})
+
+	conn := <-s.ListenLocal()
+	lines := make(chan string, 256)
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	send := func(command string) {
+		_, err := conn.Write([]byte(command + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(message string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if strings.Contains(line, message) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("expected message: %s", message)
+			}
+		}
+	}
+
+	send("login bob")
+	expect("welcome Guest_bob")
+	send("create public 1 0 test")
+	expect("Created match: test")
+
+	s.defcon.Store(1)
+	send("register bob@example.com bob secret")
+	expect("registration is disabled")
+	s.defcon.Store(5)
+
+	send("register carol@example.com carol secret")
+	expect("Failed to register: username already in use")
+
+	// Without a database, registration succeeds but logging in to the
+	// account fails. Further registrations are rejected.
+	send("register dave@example.com dave secret")
+	expect("Your account was registered")
+	send("register erin@example.com erin secret")
+	expect("Your account is already being registered.")
+
+	s.clientsLock.Lock()
+	c := s.clientByUsername([]byte("Guest_bob"))
+	s.clientsLock.Unlock()
+	if c == nil {
+		t.Fatal("guest client not found")
+	}
+	s.queueCommand(serverCommand{
+		client: c,
+		account: &account{
+			id:          3,
+			username:    []byte("dave"),
+			casual:      &clientRating{},
+			competitive: &clientRating{},
+		},
+	})
+	expect("welcome dave")
+	expect("dave (0)")
+
+	send("register erin@example.com erin secret")
+	expect("You are already logged in to an account.")
+}
+
+func TestRegisterGuestDuringMatch(t *testing.T) {
+	s, err := New(&Options{Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guest := &serverClient{
+		name:   []byte("Guest_bob"),
+		Client: newDetachedClient(""),
+	}
+	opponent := &serverClient{
+		name:      []byte("carol"),
+		accountID: 2,
+		Client:    newDetachedClient(""),
+	}
+	g := newServerGame(1, bgammon.VariantBackgammon)
+	g.client1, g.client2 = guest, opponent
+	g.account2 = opponent.accountID
+	g.Started = time.Now().Unix()
+	g.requireConfirmed = true
+	s.games = append(s.games, g)
+
+	s.upgradeGuest(serverCommand{
+		client: guest,
+		account: &account{
+			id:          3,
+			username:    []byte("bob"),
+			casual:      &clientRating{},
+			competitive: &clientRating{},
+		},
+	})
+	if g.account1 != 3 {
+		t.Fatalf("unexpected account: expected 3, got %d", g.account1)
+	}
+
+	// The converted account is not required to be confirmed for the match
+	// in progress to be rated.
+	if ids := g.confirmationRequired(); len(ids) != 1 || ids[0] != opponent.accountID {
+		t.Errorf("unexpected accounts: expected [%d], got %v", opponent.accountID, ids)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	t.Parallel()
+
+	b := &eventBus{}
+	all := b.subscribe(nil)
+	rolls := b.subscribe([]string{EventRoll})
+
+	b.publish(&Event{Type: EventMatchCreated})
+	b.publish(&Event{Type: EventRoll, Roll: []int8{3, 1}})
+
+	for i, expected := range []string{EventMatchCreated, EventRoll} {
+		ev := <-all.C
+		if ev.Type != expected || ev.ID != int64(i+1) || ev.Time == 0 {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	}
+	ev := <-rolls.C
+	if ev.Type != EventRoll {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	rolls.Close()
+	rolls.Close()
+	if _, ok := <-rolls.C; ok {
+		t.Fatal("expected closed subscription")
+	}
+
+	for i := 0; i < subscriptionBufferSize; i++ {
+		b.publish(&Event{Type: EventMove})
+	}
+	if dropped := b.publish(&Event{Type: EventMove}); dropped != 1 {
+		t.Fatalf("expected 1 dropped event, got %d", dropped)
+	}
+
+	b.stop()
+	for range all.C {
+	}
+	if _, ok := <-b.subscribe(nil).C; ok {
+		t.Fatal("expected closed subscription after stopping")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	webhookRetryDelay = time.Millisecond
+
+	const secret = "secret"
+	var attempts int
+	received := make(chan *Event, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Bgammon-Timestamp"), 10, 64)
+		if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+			t.Errorf("invalid webhook timestamp %q", r.Header.Get("X-Bgammon-Timestamp"))
+		} else if r.Header.Get("X-Bgammon-Signature") != "sha256="+SignWebhook(secret, timestamp, body) {
+			t.Error("invalid webhook signature")
+		} else if r.Header.Get("X-Bgammon-Signature") == "sha256="+SignWebhook(secret, timestamp-1, body) {
+			t.Error("webhook signature does not depend on timestamp")
+		} else if r.Header.Get("X-Bgammon-Event") != EventAccountRegistered {
+			t.Errorf("unexpected event type %s", r.Header.Get("X-Bgammon-Event"))
+		}
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ev := &Event{}
+		err = json.Unmarshal(body, ev)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer hook.Close()
+
+	started := time.Now()
+	s, err := New(&Options{
+		Logger:        log.New(io.Discard, "", 0),
+		Webhooks:      []string{hook.URL},
+		WebhookSecret: secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = s.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.notifyAccountRegistered([]byte("alice"))
+	select {
+	case ev := <-received:
+		if ev.Type != EventAccountRegistered || ev.Player != "alice" {
+			t.Errorf("unexpected event: %+v", ev)
+		} else if ev.ID <= started.UnixMicro() {
+			t.Errorf("expected event ID to follow the time the server was created, got %d", ev.ID)
+		} else if attempts != 2 {
+			t.Errorf("expected 2 attempts, got %d", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err = s.Stop(stopCtx)
+	if err != nil {
+		t.Fatalf("failed to stop server: %s", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, err := New(&Options{
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.metrics.commands.observe(bgammon.CommandRoll, 3*time.Millisecond)
+	s.metrics.staffActions.inc("ban")
+	s.logins.fail("127.0.0.1")
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"bgammon_clients{transport=\"tcp\"} 0\n",
+		"bgammon_matches{variant=\"backgammon\"} 0\n",
+		"bgammon_command_duration_seconds_bucket{command=\"roll\",le=\"0.0025\"} 0\n",
+		"bgammon_command_duration_seconds_bucket{command=\"roll\",le=\"0.005\"} 1\n",
+		"bgammon_command_duration_seconds_count{command=\"roll\"} 1\n",
+		"bgammon_login_failures_total 1\n",
+		"bgammon_staff_actions_total{action=\"ban\"} 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metric %q not found in:\n%s", expected, body)
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and key to dir.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestStartTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	s, err := New(&Options{
+		Logger:   log.New(io.Discard, "", 0),
+		CertFile: certFile,
+		CertKey:  keyFile,
+		StartTLS: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = s.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(ctx)
+
+	config, err := s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := config.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, filepath.Dir(certFile))
+	err = s.ReloadCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := config.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(first.Certificate[0], reloaded.Certificate[0]) {
+		t.Fatal("expected certificate to be reloaded")
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	go s.handleConnection(remote, transportTCP, config)
+
+	_, err = local.Write([]byte("starttls\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(local)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		} else if line == startTLSReady+"\n" {
+			break
+		}
+	}
+
+	conn := tls.Client(local, &tls.Config{InsecureSkipVerify: true})
+	_, err = conn.Write([]byte("login alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if bytes.HasPrefix(scanner.Bytes(), []byte("welcome ")) {
+			return
+		}
+	}
+	t.Fatalf("welcome message not received: %v", scanner.Err())
+}
+
+func TestRequestAddress(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{}
+	var err error
+	s.trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		remote   string
+		header   string
+		value    string
+		expected string
+	}{
+		{"192.0.2.1:1000", "X-Forwarded-For", "198.51.100.1", "192.0.2.1:1000"},
+		{"10.0.0.1:1000", "", "", "10.0.0.1:1000"},
+		{"10.0.0.1:1000", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1000", "X-Forwarded-For", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"[::1]:1000", "Forwarded", `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`, "[2001:db8::1]:4711"},
+		{"10.0.0.1:1000", "Forwarded", "for=unknown", "10.0.0.1:1000"},
+	}
+	for _, c := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remote
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		if address := s.requestAddress(r); address != c.expected {
+			t.Errorf("unexpected address for %s %s: expected %s, got %s", c.remote, c.value, c.expected, address)
+		}
+	}
+
+	_, err = parseTrustedProxies([]string{"proxy"})
+	if err == nil {
+		t.Fatal("expected error when parsing invalid trusted proxy")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 198, 51, 100, 1, 192, 0, 2, 1, 0x30, 0x39, 0x05, 0x39)
+
+	testCases := []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 198.51.100.1 192.0.2.1 12345 1337\r\n"), "198.51.100.1:12345"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 1337\r\n"), "[2001:db8::1]:12345"},
+		{[]byte("PROXY UNKNOWN\r\n"), "pipe"},
+		{v2, "198.51.100.1:12345"},
+	}
+	for _, c := range testCases {
+		local, remote := net.Pipe()
+		go func() {
+			local.Write(append(c.header, "login\n"...))
+		}()
+		conn, err := readProxyHeader(remote)
+		if err != nil {
+			t.Fatal(err)
+		} else if conn.RemoteAddr().String() != c.expected {
+			t.Errorf("unexpected address: expected %s, got %s", c.expected, conn.RemoteAddr())
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		} else if line != "login\n" {
+			t.Errorf("unexpected data following header: %q", line)
+		}
+		local.Close()
+		remote.Close()
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	go local.Write([]byte("login alice\r\n"))
+	if _, err := readProxyHeader(remote); err == nil {
+		t.Fatal("expected error when reading invalid header")
+	}
+}
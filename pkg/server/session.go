@@ -0,0 +1,234 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+	"codeberg.org/tslocum/gotext"
+)
+
+// sessionGracePeriod is how long a session may be resumed after the client disconnects.
+const sessionGracePeriod = 2 * time.Minute
+
+// maxMissedEvents is the maximum number of events buffered while a client is
+// disconnected. The oldest events are discarded first.
+const maxMissedEvents = 500
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panicf("failed to generate session token: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// detachedClient buffers events sent to a client while it is disconnected.
+type detachedClient struct {
+	address    string
+	events     [][]byte
+	wake       chan struct{}
+	terminated bool
+	sync.Mutex
+}
+
+func newDetachedClient(address string) *detachedClient {
+	return &detachedClient{
+		address: address,
+		wake:    make(chan struct{}),
+	}
+}
+
+func (c *detachedClient) Address() string {
+	return c.address
+}
+
+func (c *detachedClient) HandleReadWrite() {
+}
+
+func (c *detachedClient) Write(message []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.terminated {
+		return
+	} else if len(c.events) == maxMissedEvents {
+		c.events = append(c.events[:0], c.events[1:]...)
+	}
+	c.events = append(c.events, append([]byte{}, message...))
+}
+
+func (c *detachedClient) Terminate(reason string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.terminated {
+		return
+	}
+	c.terminated = true
+	close(c.wake)
+}
+
+func (c *detachedClient) Terminated() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.terminated
+}
+
+func (c *detachedClient) missed() [][]byte {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.events
+}
+
+// startSession issues a session token to a client which has logged in.
+func (s *Server) startSession(c *serverClient) {
+	s.clientsLock.Lock()
+	c.session = newSessionToken()
+	s.clientsLock.Unlock()
+
+	c.sendEvent(&bgammon.EventSession{
+		Token: c.session,
+	})
+}
+
+// detachClient keeps the session of a disconnected client open so that it may
+// be resumed by another connection. Events sent to the client are buffered.
+func (s *Server) detachClient(c *serverClient) bool {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	if c.session == "" || c.replaced || c.terminating {
+		return false
+	}
+	detached := newDetachedClient(c.Address())
+	c.connLock.Lock()
+	c.detached, c.Client = detached, detached
+	c.connLock.Unlock()
+	return true
+}
+
+// waitDetached waits until the session of a detached client is resumed, ended
+// or the grace period expires. It returns whether the session was resumed.
+func (s *Server) waitDetached(c *serverClient) bool {
+	select {
+	case <-time.After(sessionGracePeriod):
+	case <-c.detached.wake:
+	case <-s.done:
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	c.session = ""
+	return c.replaced
+}
+
+// replaceClient removes a client whose session is being taken over by another
+// connection. The caller must hold clientsLock.
+func (s *Server) replaceClient(old *serverClient) {
+	old.replaced = true
+	old.session = ""
+	for i, sc := range s.clients {
+		if sc == old {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	// Wake the detached client, or disconnect the unresponsive connection.
+	old.conn().Terminate("")
+}
+
+// resumeSession attaches a new connection to the session of a previously
+// connected client, restoring its match and replaying missed events.
+func (s *Server) resumeSession(c *serverClient, token []byte) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	s.clientsLock.Lock()
+	var old *serverClient
+	for _, sc := range s.clients {
+		if sc != c && sc.session != "" && sc.session == string(token) && !sc.terminating {
+			old = sc
+			break
+		}
+	}
+	if old == nil {
+		s.clientsLock.Unlock()
+		return false
+	}
+
+	// Bans may have been added since the client logged in. The session of a
+	// banned client is ended.
+	if msg := s.checkBan(old.language, c.addresses, old.accountID); msg != "" {
+		old.session = ""
+		old.disconnect("")
+		s.clientsLock.Unlock()
+		c.Terminate(msg)
+		return true
+	}
+	s.replaceClient(old)
+
+	c.name = old.name
+	c.language = old.language
+	c.json = old.json
+	c.account = old.account
+	c.accountID = old.accountID
+	c.staffDisabled = old.staffDisabled
+	c.autoplay = old.autoplay
+	c.playerNumber = old.playerNumber
+	c.muted, c.muteReason = old.muted, old.muteReason
+	c.lastReport = old.lastReport
+	c.protocol, c.capabilities = old.protocol, old.capabilities
+	c.session = newSessionToken()
+
+	var missed [][]byte
+	if old.detached != nil {
+		missed = old.detached.missed()
+	}
+
+	s.gamesLock.Lock()
+	var game *serverGame
+	for _, g := range s.games {
+		if g.client1 == old {
+			g.client1, game = c, g
+		} else if g.client2 == old {
+			g.client2, game = c, g
+		}
+		for i, spectator := range g.spectators {
+			if spectator == old {
+				g.spectators[i], game = c, g
+			}
+		}
+	}
+	s.gamesLock.Unlock()
+	s.clientsLock.Unlock()
+
+	s.logger.Printf("Client %d resumed session of client %d as %s", c.id, old.id, c.name)
+
+	c.sendEvent(&bgammon.EventSession{
+		Token: c.session,
+	})
+	c.sendEvent(&bgammon.EventWelcome{
+		PlayerName:   string(c.name),
+		Clients:      len(s.clients),
+		Games:        len(s.games),
+		Protocol:     c.protocol,
+		Capabilities: c.capabilities,
+	})
+	for _, message := range missed {
+		c.Write(message)
+	}
+	if game != nil {
+		game.sendBoard(c, false)
+	}
+	c.sendNotice(gotext.GetD(c.language, "Session resumed."))
+	return true
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"codeberg.org/tslocum/bgammon"
+	"codeberg.org/tslocum/gotext"
+)
+
+// Time-based one-time passwords (RFC 6238) are used for two-factor authentication.
+const (
+	totpDigits = 6
+	totpPeriod = 30 // Seconds.
+	totpSkew   = 1  // Number of periods before and after the current period which are accepted.
+)
+
+const (
+	recoveryCodes       = 10
+	recoveryCodeLength  = 10
+	recoveryCodeLetters = "abcdefghkmnpqrstwxyz23456789"
+)
+
+// Clients must provide a valid code within this time after logging in.
+const (
+	totpTimeout     = 2 * time.Minute
+	maxTOTPAttempts = 3
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Panicf("failed to generate two-factor authentication secret: %s", err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI returns a URI which may be imported by authenticator applications.
+func totpURI(secret string, username string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", "bgammon.org")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return "otpauth://totp/" + url.PathEscape("bgammon.org:"+username) + "?" + v.Encode()
+}
+
+func totpCode(secret string, counter uint64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// validateTOTP returns whether the code is valid for the secret at the specified time.
+func validateTOTP(secret string, code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+	if secret == "" || len(code) != totpDigits {
+		return false
+	}
+	counter := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		if hmac.Equal([]byte(totpCode(secret, uint64(counter+int64(i)))), []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+func generateRecoveryCodes() []string {
+	codes := make([]string, recoveryCodes)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength)
+		_, err := rand.Read(b)
+		if err != nil {
+			log.Panicf("failed to generate recovery code: %s", err)
+		}
+		for j := range b {
+			b[j] = recoveryCodeLetters[int(b[j])%len(recoveryCodeLetters)]
+		}
+		codes[i] = string(b)
+	}
+	return codes
+}
+
+func hashRecoveryCode(code string, salt string) string {
+	h := sha256.New()
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(code)) + salt))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// challengeTOTP requests a two-factor authentication code (or recovery code)
+// from a client logging in to an account. It returns whether a valid code was
+// provided. The client is terminated otherwise. Each invalid code counts as a
+// failed login attempt.
+func (s *Server) challengeTOTP(c *serverClient, a *account) bool {
+	accept := func() bool {
+		err := clearLoginFailures(a.id)
+		if err != nil {
+			s.logger.Printf("failed to clear failed logins: %s", err)
+		}
+		return true
+	}
+
+	c.sendEvent(&bgammon.EventOTP{})
+
+	timeout := time.After(totpTimeout)
+	for attempt := 0; attempt < maxTOTPAttempts; attempt++ {
+		select {
+		case code := <-c.otpCodes:
+			code = bytes.TrimSpace(code)
+			if validateTOTP(a.totpSecret, string(code), time.Now()) {
+				return accept()
+			}
+			ok, remaining, err := useRecoveryCode(a.id, hashRecoveryCode(string(code), s.passwordSalt))
+			if err != nil {
+				s.logger.Printf("failed to use recovery code: %s", err)
+			} else if ok {
+				c.sendNotice(fmt.Sprintf(gotext.GetD(c.language, "Recovery code accepted. %d recovery codes remain."), remaining))
+				return accept()
+			}
+			s.logins.fail(c.Address())
+			lockedUntil, err := failLogin(s.mailServer, a.id)
+			if err != nil {
+				s.logger.Printf("failed to record failed login: %s", err)
+			}
+			if until := s.logins.locked(c.Address()); until > lockedUntil {
+				lockedUntil = until
+			}
+			if lockedUntil != 0 {
+				c.Terminate(fmt.Sprintf(gotext.GetD(c.language, "Too many failed login attempts. Please try again in %s or reset your password."), formatRemaining(c.language, lockedUntil)))
+				return false
+			}
+			c.sendNotice(gotext.GetD(c.language, "Invalid two-factor authentication code."))
+			if attempt < maxTOTPAttempts-1 {
+				c.sendEvent(&bgammon.EventOTP{})
+			}
+		case <-timeout:
+			c.Terminate(gotext.GetD(c.language, "Two-factor authentication code was not provided in time."))
+			return false
+		}
+	}
+	c.Terminate(gotext.GetD(c.language, "Too many invalid two-factor authentication codes."))
+	return false
+}
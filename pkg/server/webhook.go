@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Webhook requests are retried with exponential backoff, starting at
+// webhookRetryDelay, until webhookAttempts have been made.
+var (
+	webhookAttempts   = 5
+	webhookRetryDelay = 2 * time.Second
+	webhookTimeout    = 10 * time.Second
+)
+
+// SignWebhook returns the signature of a webhook request. The signature is
+// calculated over the Unix timestamp sent in the X-Bgammon-Timestamp header, a
+// period and the request body. It is sent in the X-Bgammon-Signature header in
+// the form sha256=SIGNATURE.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handleWebhook sends events to a webhook URL. Events are delivered one at a
+// time, in the order they were published.
+func (s *Server) handleWebhook(address string, sub *Subscription) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client := &http.Client{
+		Timeout: webhookTimeout,
+	}
+	for ev := range sub.C {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			s.logger.Printf("failed to encode %s event: %s", ev.Type, err)
+			continue
+		}
+		s.deliverWebhook(ctx, client, address, ev, body)
+	}
+}
+
+// deliverWebhook sends an event to a webhook URL, retrying until the request
+// succeeds, the request is rejected or the server stops.
+func (s *Server) deliverWebhook(ctx context.Context, client *http.Client, address string, ev *Event, body []byte) {
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.postWebhook(ctx, client, address, ev, body)
+		if err == nil {
+			return
+		} else if !retry || attempt == webhookAttempts {
+			s.logger.Printf("Failed to deliver %s event %d to webhook %s: %s", ev.Type, ev.ID, address, err)
+			return
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		delay *= 2
+	}
+}
+
+// postWebhook sends a single webhook request. It returns whether a failed
+// request may be retried.
+func (s *Server) postWebhook(ctx context.Context, client *http.Client, address string, ev *Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bgammon-webhook")
+	req.Header.Set("X-Bgammon-Event", ev.Type)
+	req.Header.Set("X-Bgammon-Delivery", strconv.FormatInt(ev.ID, 10))
+	if s.webhookSecret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set("X-Bgammon-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-Bgammon-Signature", "sha256="+SignWebhook(s.webhookSecret, timestamp, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,17 @@
+package bgammon
+
+// ProtocolVersion is the version of the protocol implemented by the server.
+// Clients which do not announce a protocol version are assumed to implement
+// version 1.
+const ProtocolVersion = 2
+
+// Capabilities which clients may announce when logging in.
+const (
+	CapabilityFailedCreate = "failedcreate" // Displays failedcreate events. Notices are not sent when creating a match fails.
+	CapabilityResign       = "resign"       // Displays resignations and declined doubles. Notices are not sent.
+	CapabilityAcey         = "acey"         // Supports acey-deucey matches.
+	CapabilityTabula       = "tabula"       // Supports tabula matches.
+)
+
+// LegacyCapabilities are the capabilities of clients which do not announce a protocol version.
+var LegacyCapabilities = []string{CapabilityAcey, CapabilityTabula}
@@ -0,0 +1,150 @@
+package bgammon
+
+//go:generate go run ./cmd/bgammon-schema -o schema.json -protocol PROTOCOL.md
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Schema returns a JSON Schema describing every command and event of the
+// protocol. Commands are listed with their help text and argument names.
+// Events and the types they contain are described as JSON Schema objects.
+func Schema() ([]byte, error) {
+	defs := make(map[string]interface{})
+
+	commands := make(map[string]interface{})
+	for command, names := range CommandArguments {
+		arguments := make([]interface{}, len(names))
+		for i, name := range names {
+			alternatives := strings.Split(name, "/")
+			argument := map[string]interface{}{
+				"name": alternatives[0],
+			}
+			if len(alternatives) > 1 {
+				argument["alternatives"] = alternatives[1:]
+			}
+			arguments[i] = argument
+		}
+		commands[command] = map[string]interface{}{
+			"description": HelpText[command],
+			"arguments":   arguments,
+		}
+	}
+
+	eventSchemas := make(map[string]interface{})
+	for eventType, newEvent := range events {
+		s := structSchema(reflect.TypeOf(newEvent()).Elem(), defs)
+		s["properties"].(map[string]interface{})["Type"] = map[string]interface{}{
+			"type":  "string",
+			"const": eventType,
+		}
+		eventSchemas[eventType] = s
+	}
+
+	schema := map[string]interface{}{
+		"$schema":  "https://json-schema.org/draft/2020-12/schema",
+		"title":    "bgammon.org protocol",
+		"version":  ProtocolVersion,
+		"request":  typeSchema(reflect.TypeOf(CommandRequest{}), defs),
+		"commands": commands,
+		"events":   eventSchemas,
+		"$defs":    defs,
+	}
+	buf, err := json.MarshalIndent(schema, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// typeSchema returns the JSON Schema of a type. Named struct types are added
+// to defs and referenced.
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	nullable := func(s map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}},
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(typeSchema(t.Elem(), defs))
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nullable(map[string]interface{}{"type": "string", "contentEncoding": "base64"})
+		}
+		return nullable(map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs)})
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return nullable(map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)})
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, defs)
+		}
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = nil // Placeholder for recursive types.
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the JSON Schema of a struct. The fields of embedded
+// structs are included as they are encoded by encoding/json.
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			} else if field.Anonymous && name == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Ptr {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					addFields(embedded)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			} else if name == "" {
+				name = field.Name
+			}
+			if _, ok := properties[name]; ok {
+				continue // Shadowed by a field of the outer struct.
+			}
+			properties[name] = typeSchema(field.Type, defs)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	s := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
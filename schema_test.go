@@ -0,0 +1,127 @@
+package bgammon
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile("schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(schema, expected) {
+		t.Fatal("schema.json does not match the protocol types, run go generate to update it")
+	}
+}
+
+// declarations returns the values of the string constants and the names of the
+// struct types declared in a source file.
+func declarations(t *testing.T, file string) (constants map[string]string, structs map[string]*ast.StructType) {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constants = make(map[string]string)
+	structs = make(map[string]*ast.StructType)
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			switch spec := spec.(type) {
+			case *ast.ValueSpec:
+				for i, name := range spec.Names {
+					if i >= len(spec.Values) {
+						continue
+					}
+					lit, ok := spec.Values[i].(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						continue
+					}
+					value, err := strconv.Unquote(lit.Value)
+					if err != nil {
+						t.Fatal(err)
+					}
+					constants[name.Name] = value
+				}
+			case *ast.TypeSpec:
+				if s, ok := spec.Type.(*ast.StructType); ok {
+					structs[spec.Name.Name] = s
+				}
+			}
+		}
+	}
+	return constants, structs
+}
+
+func TestEventTypes(t *testing.T) {
+	constants, _ := declarations(t, "command.go")
+	for name, eventType := range constants {
+		if strings.HasPrefix(name, "EventType") && name != "EventTypeHelp" && events[eventType] == nil {
+			t.Errorf("event type %s is not registered", eventType)
+		}
+	}
+
+	registered := make(map[string]bool)
+	for eventType, newEvent := range events {
+		ev := newEvent()
+		registered[reflect.TypeOf(ev).Elem().Name()] = true
+
+		buf, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = bytes.Replace(buf, []byte(`"Type":""`), []byte(`"Type":"`+eventType+`"`), 1)
+		decoded, err := DecodeEvent(buf)
+		if err != nil {
+			t.Errorf("failed to decode %s event: %s", eventType, err)
+		} else if reflect.TypeOf(decoded) != reflect.TypeOf(ev) {
+			t.Errorf("decoded %s event as %T, expected %T", eventType, decoded, ev)
+		}
+	}
+
+	// All structs which embed Event must be registered.
+	_, structs := declarations(t, "event.go")
+	for name, s := range structs {
+		for _, field := range s.Fields.List {
+			ident, ok := field.Type.(*ast.Ident)
+			if ok && len(field.Names) == 0 && ident.Name == "Event" && !registered[name] {
+				t.Errorf("event %s is not registered", name)
+			}
+		}
+	}
+}
+
+func TestCommandArguments(t *testing.T) {
+	constants, _ := declarations(t, "command.go")
+	for name, command := range constants {
+		if !strings.HasPrefix(name, "Command") || command == CommandLoginJSON || command == CommandRegisterJSON {
+			continue
+		}
+		if _, ok := CommandArguments[command]; !ok {
+			t.Errorf("arguments of command %s are not listed", command)
+		}
+		if _, ok := HelpText[command]; !ok {
+			t.Errorf("help text of command %s is missing", command)
+		}
+	}
+	for command := range CommandArguments {
+		if _, ok := HelpText[command]; !ok {
+			t.Errorf("arguments are listed for unknown command %s", command)
+		}
+	}
+}